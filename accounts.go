@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"      // For Logging errors and info messages
+	"net/http" // For HTTP server and client funcionality
+	"os"       // For OS interface
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User is an optional persistent account. Unlike rounds and sessions these are stored WITHOUT a TTL,
+// so a producer keeps the same identity across as many rounds as they like. Guests never need one.
+type User struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AccountSession is the long-lived login, kept apart from the per-round Session so that leaving
+// a round never logs you out of your account (and logging out never kicks you from a round).
+type AccountSession struct {
+	Token     string    `json:"token"`
+	UserID    string    `json:"userId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RoundHistoryEntry is one round in a user's history; it's a snapshot, so it sticks around after the round itself expires
+type RoundHistoryEntry struct {
+	RoundID     string               `json:"roundId"`
+	JoinCode    string               `json:"joinCode"`
+	RoundName   string               `json:"roundName"`
+	Mode        RoundMode            `json:"mode"`
+	WasHost     bool                 `json:"wasHost"`
+	JoinedAt    time.Time            `json:"joinedAt"`
+	Submissions []*HistorySubmission `json:"submissions"`
+}
+
+// HistorySubmission points at the user's own copy of a file they submitted (see libraryDir)
+type HistorySubmission struct {
+	Filename     string    `json:"filename"`
+	OriginalName string    `json:"originalName"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	ContentHash  string    `json:"contentHash,omitempty"` // to spot the same file turning up in a later round (see duplicates.go)
+}
+
+const (
+	// OWASP's current recommendation for PBKDF2-HMAC-SHA256; slow on purpose so stolen hashes are expensive to crack
+	passwordIterations = 600000
+	passwordSaltBytes  = 16
+	passwordKeyBytes   = 32
+
+	// Replacing an entry over and over mustn't fill the disk, so only the latest few from each round are kept
+	maxLibraryCopiesPerRound = 3
+)
+
+// Redis key helper functions for accounts
+func userKey(id string) string {
+	return "user:" + id
+}
+
+func usernameKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+func accountSessionKey(token string) string {
+	return "account:" + token
+}
+
+func userHistoryKey(userID string) string {
+	return "userhistory:" + userID
+}
+
+// libraryDir is where copies of an account holder's submissions live, so they outlast the round's upload folder
+func (s *Server) libraryDir(userID string) string {
+	return filepath.Join(s.cfg.LibraryDir, userID)
+}
+
+/*
+hashPassword runs the password through PBKDF2 with a random salt and encodes everything needed to verify it later
+into one string: "pbkdf2-sha256$<iterations>$<salt>$<hash>". Storing the iteration count means we can bump it later
+without breaking older accounts.
+*/
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s",
+		passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(encoded string, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	// Constant time so the comparison itself doesn't leak how many bytes matched
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// getAccount mirrors getSession: returns the logged-in user or nil for guests
+func (s *Server) getAccount(r *http.Request) *User {
+	cookie, err := r.Cookie("account")
+	if err != nil {
+		return nil
+	}
+
+	sessionData, err := s.db.Get(ctx, accountSessionKey(cookie.Value)).Result()
+	if err != nil {
+		return nil
+	}
+
+	var accountSession AccountSession
+	if err := json.Unmarshal([]byte(sessionData), &accountSession); err != nil {
+		return nil
+	}
+
+	return s.getUser(accountSession.UserID)
+}
+
+func (s *Server) getUser(userID string) *User {
+	userData, err := s.db.Get(ctx, userKey(userID)).Result()
+	if err != nil {
+		return nil
+	}
+
+	var user User
+	if err := json.Unmarshal([]byte(userData), &user); err != nil {
+		return nil
+	}
+
+	return &user
+}
+
+/*
+recordRoundHistory adds (or refreshes) a round in the user's history. History lives in a Redis hash keyed by round ID,
+so re-joining the same round just overwrites the entry instead of duplicating it. Submissions already recorded are kept.
+*/
+func (s *Server) recordRoundHistory(userID string, round *Round, wasHost bool) {
+	entry := &RoundHistoryEntry{
+		RoundID:     round.ID,
+		JoinCode:    round.JoinCode,
+		RoundName:   round.Name,
+		Mode:        round.Mode,
+		WasHost:     wasHost,
+		JoinedAt:    time.Now(),
+		Submissions: []*HistorySubmission{},
+	}
+
+	if existing := s.getHistoryEntry(userID, round.ID); existing != nil {
+		entry.JoinedAt = existing.JoinedAt
+		entry.Submissions = existing.Submissions
+		entry.WasHost = existing.WasHost || wasHost
+	}
+
+	s.saveHistoryEntry(userID, entry)
+}
+
+/*
+recordSubmissionHistory copies the uploaded file into the user's library and appends it to their history for this
+round. Past maxLibraryCopiesPerRound the oldest copies (and their fingerprints) are deleted.
+*/
+func (s *Server) recordSubmissionHistory(userID string, round *Round, submission *Submission) {
+	entry := s.getHistoryEntry(userID, round.ID)
+	if entry == nil {
+		// Shouldn't happen since we record on join, but an upload is still worth keeping
+		s.recordRoundHistory(userID, round, round.HostID == submission.ParticipantID)
+		entry = s.getHistoryEntry(userID, round.ID)
+		if entry == nil {
+			return
+		}
+	}
+
+	src := filepath.Join(s.cfg.UploadDir, round.ID, submission.Filename)
+	dstDir := filepath.Join(s.libraryDir(userID), round.ID)
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		log.Printf("Failed to create library directory %s: %v", dstDir, err)
+		return
+	}
+	if err := copyFile(src, filepath.Join(dstDir, submission.Filename)); err != nil {
+		log.Printf("Failed to copy submission %s into library: %v", submission.Filename, err)
+		return
+	}
+
+	entry.Submissions = append(entry.Submissions, &HistorySubmission{
+		Filename:     submission.Filename,
+		OriginalName: submission.OriginalName,
+		UploadedAt:   submission.UploadedAt,
+		ContentHash:  submission.ContentHash,
+	})
+	if extra := len(entry.Submissions) - maxLibraryCopiesPerRound; extra > 0 {
+		for _, old := range entry.Submissions[:extra] {
+			os.Remove(filepath.Join(dstDir, old.Filename))
+			os.Remove(filepath.Join(dstDir, printName(old.Filename)))
+		}
+		entry.Submissions = entry.Submissions[extra:]
+	}
+	s.saveHistoryEntry(userID, entry)
+}
+
+func (s *Server) getHistoryEntry(userID string, roundID string) *RoundHistoryEntry {
+	entryData, err := s.db.HGet(ctx, userHistoryKey(userID), roundID).Result()
+	if err != nil {
+		return nil
+	}
+
+	var entry RoundHistoryEntry
+	if err := json.Unmarshal([]byte(entryData), &entry); err != nil {
+		return nil
+	}
+
+	return &entry
+}
+
+func (s *Server) saveHistoryEntry(userID string, entry *RoundHistoryEntry) {
+	entryData, _ := json.Marshal(entry)
+	if err := s.db.HSet(ctx, userHistoryKey(userID), entry.RoundID, entryData).Err(); err != nil {
+		log.Printf("Failed to save round history for user %s: %v", userID, err)
+	}
+}
+
+// Helper function for copying a file on disk; tries a hard link first since that's free when both paths are on the same disk
+func copyFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Printf("Failed to close source file in copyFile; error: %v", err)
+		}
+	}()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
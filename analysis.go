@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log" // For Logging errors and info messages
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Audio analysis
+
+Every WAV or FLAC upload (the host's sample and each remix) gets its tempo and key estimated by a background job
+once it's saved (see jobs.go), so the lobby can show "92 BPM · A minor" next to it; its loudness is measured at the
+same time (see loudness.go). Nothing waits on this: the upload answers straight away, and the result is written onto
+the round when it's ready (Round.SampleAnalysis or Submission.Analysis), where the page and the info API pick it up.
+Formats we can't decode are simply left without one.
+
+Both estimates work on a mono mix resampled down to around 11 kHz, which keeps everything the beat and the harmony
+live in while making the FFTs four times cheaper:
+
+  - Tempo: an onset envelope (how much the spectrum jumps from one short frame to the next) is autocorrelated, and
+    the strongest repeat between 50 and 200 BPM wins, nudged towards 120 so we don't report half or double time.
+  - Key: the spectrum is folded into a 12-note chroma profile and compared against the Krumhansl-Kessler major and
+    minor key profiles in all 12 transpositions; the best correlation wins.
+*/
+
+const (
+	analysisSampleRate = 11025
+	minKeyConfidence   = 0.4 // below this the chroma doesn't look like any key, e.g. a drum loop
+)
+
+// AudioAnalysis is what we worked out about an uploaded file
+type AudioAnalysis struct {
+	Duration      float64   `json:"duration"` // seconds
+	SampleRate    int       `json:"sampleRate"`
+	Channels      int       `json:"channels"`
+	BPM           float64   `json:"bpm,omitempty"`           // 0 when there's no steady beat to find
+	Key           string    `json:"key,omitempty"`           // e.g. "A minor"; empty when nothing tonal stood out
+	KeyConfidence float64   `json:"keyConfidence,omitempty"` // correlation with the key profile, up to 1
+	Loudness      *Loudness `json:"loudness,omitempty"`      // nil for silence (see loudness.go)
+	AnalyzedAt    time.Time `json:"analyzedAt"`
+}
+
+func analyzeAudio(audio *pcmAudio) *AudioAnalysis {
+	analysis := &AudioAnalysis{
+		Duration:   math.Round(audio.duration()*10) / 10,
+		SampleRate: audio.SampleRate,
+		Channels:   len(audio.Channels),
+		AnalyzedAt: time.Now(),
+	}
+
+	signal, rate := downsample(audio.mono(), audio.SampleRate, analysisSampleRate)
+	analysis.BPM = estimateBPM(signal, rate)
+	key, confidence := estimateKey(signal, rate)
+	if confidence >= minKeyConfidence {
+		analysis.Key = key
+		analysis.KeyConfidence = math.Round(confidence*100) / 100
+	}
+	analysis.Loudness = measureLoudness(audio)
+	return analysis
+}
+
+// downsample averages blocks of samples to get near the target rate; returns the signal and its actual rate
+func downsample(signal []float32, sampleRate int, target int) ([]float64, float64) {
+	factor := max(1, sampleRate/target)
+	out := make([]float64, len(signal)/factor)
+	for i := range out {
+		var sum float64
+		for _, sample := range signal[i*factor : (i+1)*factor] {
+			sum += float64(sample)
+		}
+		out[i] = sum / float64(factor)
+	}
+	return out, float64(sampleRate) / float64(factor)
+}
+
+// fft is an in-place radix-2 FFT; len(x) has to be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+func hannWindow(n int) []float64 {
+	window := make([]float64, n)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return window
+}
+
+/*
+spectrogram slices the signal into windowed frames and returns each frame's magnitude spectrum (bins 0 to size/2).
+size has to be a power of two.
+*/
+func spectrogram(signal []float64, size int, hop int) [][]float64 {
+	if len(signal) < size {
+		return nil
+	}
+	window := hannWindow(size)
+	buf := make([]complex128, size)
+	frames := make([][]float64, 0, (len(signal)-size)/hop+1)
+	for start := 0; start+size <= len(signal); start += hop {
+		for i := range buf {
+			buf[i] = complex(signal[start+i]*window[i], 0)
+		}
+		fft(buf)
+		magnitudes := make([]float64, size/2+1)
+		for i := range magnitudes {
+			magnitudes[i] = cmplx.Abs(buf[i])
+		}
+		frames = append(frames, magnitudes)
+	}
+	return frames
+}
+
+// estimateBPM returns the tempo to one decimal place, or 0 if the audio is too short or has no beat to speak of
+func estimateBPM(signal []float64, rate float64) float64 {
+	const size, hop = 512, 128
+	frames := spectrogram(signal, size, hop)
+	framesPerSecond := rate / hop
+	if float64(len(frames)) < 6*framesPerSecond {
+		return 0 // under about six seconds there aren't enough beats to go on
+	}
+
+	// Onset strength: how much louder each bin got since the last frame, on a log scale so quiet hits still count
+	onsets := make([]float64, len(frames))
+	for i := 1; i < len(frames); i++ {
+		var flux float64
+		for bin := range frames[i] {
+			if rise := math.Log1p(100*frames[i][bin]) - math.Log1p(100*frames[i-1][bin]); rise > 0 {
+				flux += rise
+			}
+		}
+		onsets[i] = flux
+	}
+
+	// Take away the local average (about half a second) so only the peaks are left
+	half := int(framesPerSecond / 4)
+	peaks := make([]float64, len(onsets))
+	for i := range onsets {
+		lo, hi := max(0, i-half), min(len(onsets), i+half+1)
+		var sum float64
+		for _, value := range onsets[lo:hi] {
+			sum += value
+		}
+		peaks[i] = max(0, onsets[i]-sum/float64(hi-lo))
+	}
+
+	// Autocorrelate over the lags that make sense as a beat, weighting each by how likely its tempo is. The shortest
+	// is kept to 2 or more, since the peak fit below looks either side of the best one
+	minLag := max(2, int(math.Floor(framesPerSecond*60/200)))
+	maxLag := int(math.Ceil(framesPerSecond * 60 / 50))
+	correlation := make([]float64, maxLag+2)
+	for lag := minLag - 1; lag <= maxLag+1 && lag < len(peaks); lag++ {
+		var sum float64
+		for i := lag; i < len(peaks); i++ {
+			sum += peaks[i] * peaks[i-lag]
+		}
+		correlation[lag] = sum / float64(len(peaks)-lag)
+	}
+
+	bestLag, bestScore := 0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		bpm := 60 * framesPerSecond / float64(lag)
+		prior := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120), 2)) // one octave either side of 120
+		if score := correlation[lag] * prior; score > bestScore {
+			bestLag, bestScore = lag, score
+		}
+	}
+	if bestLag == 0 {
+		return 0
+	}
+
+	// The true period is rarely a whole number of frames; fit a parabola through the peak and its neighbours
+	lag := float64(bestLag)
+	left, center, right := correlation[bestLag-1], correlation[bestLag], correlation[bestLag+1]
+	if denominator := left - 2*center + right; denominator < 0 {
+		lag += 0.5 * (left - right) / denominator
+	}
+	return math.Round(600*framesPerSecond/lag) / 10
+}
+
+// Krumhansl-Kessler key profiles, starting from the tonic
+var (
+	majorProfile = []float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = []float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// estimateKey returns the best matching key (named as in keyNames) and how well it matched
+func estimateKey(signal []float64, rate float64) (string, float64) {
+	const size, hop = 4096, 2048
+	frames := spectrogram(signal, size, hop)
+	if len(frames) == 0 {
+		return "", 0
+	}
+
+	// Which pitch class each bin belongs to, for the bins from about A1 to B6; -1 for the rest
+	pitchClass := make([]int, size/2+1)
+	for bin := range pitchClass {
+		frequency := float64(bin) * rate / size
+		pitchClass[bin] = -1
+		if frequency >= 55 && frequency <= 2000 {
+			midi := int(math.Round(69 + 12*math.Log2(frequency/440)))
+			pitchClass[bin] = midi % 12
+		}
+	}
+
+	chroma := make([]float64, 12)
+	for _, magnitudes := range frames {
+		for bin, magnitude := range magnitudes {
+			if pitchClass[bin] >= 0 {
+				chroma[pitchClass[bin]] += magnitude
+			}
+		}
+	}
+
+	bestKey, bestCorrelation := "", -1.0
+	for tonic := range 12 {
+		for _, mode := range []struct {
+			name    string
+			profile []float64
+		}{{"major", majorProfile}, {"minor", minorProfile}} {
+			rotated := make([]float64, 12)
+			for i := range rotated {
+				rotated[i] = mode.profile[(i-tonic+12)%12]
+			}
+			if r := pearson(chroma, rotated); r > bestCorrelation {
+				bestKey, bestCorrelation = keyNames[tonic]+" "+mode.name, r
+			}
+		}
+	}
+	return bestKey, bestCorrelation
+}
+
+func pearson(a, b []float64) float64 {
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= float64(len(a))
+	meanB /= float64(len(b))
+
+	var covariance, varianceA, varianceB float64
+	for i := range a {
+		covariance += (a[i] - meanA) * (b[i] - meanB)
+		varianceA += (a[i] - meanA) * (a[i] - meanA)
+		varianceB += (b[i] - meanB) * (b[i] - meanB)
+	}
+	if varianceA == 0 || varianceB == 0 {
+		return 0 // silence, or every note equally loud
+	}
+	return covariance / math.Sqrt(varianceA*varianceB)
+}
+
+/*
+processUpload is the background job for a just-saved upload (see jobs.go): it works out the tempo, key and loudness,
+makes the preview (see preview.go) and, with LevelMatch, the level-matched listening copy. It fingerprints the file
+(see fingerprint.go), and checks entries against the sample in sample rounds and for copies of other entries (see
+duplicates.go). Then it writes it all onto the round.
+The file is looked up by name when the results come back, so if it was replaced in the meantime the stale results
+are dropped along with the files made for them.
+*/
+func (s *Server) processUpload(job uploadJob) error {
+	dir := filepath.Join(s.cfg.UploadDir, job.RoundID)
+	audio, err := decodeAudioFile(filepath.Join(dir, job.Filename))
+	if err != nil && !errors.Is(err, errUnsupportedAudio) {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) && !errors.Is(err, fs.ErrNotExist) {
+			return err // couldn't read it this time; worth another go
+		}
+		return permanentJobError{err} // a broken file stays broken
+	}
+
+	// audio is nil for MP3 and friends: nothing to analyze, though an external encoder can still make a preview
+	results := uploadResults{}
+	var hashes []printHash
+	if audio != nil {
+		results.analysis = analyzeAudio(audio)
+		if job.LevelMatch && results.analysis.Loudness != nil {
+			results.listeningGain = listeningGain(results.analysis.Loudness)
+			results.listeningCopy = listeningCopyName(job.Filename)
+			if err := writeWAV16(filepath.Join(dir, results.listeningCopy), audio, results.listeningGain); err != nil {
+				results.removeFiles(dir)
+				return err
+			}
+		}
+
+		hashes = fingerprint(audio)
+		results.print = printName(job.Filename)
+		if err := writePrint(filepath.Join(dir, results.print), hashes); err != nil {
+			results.removeFiles(dir)
+			return err
+		}
+	}
+
+	// Entries are checked against the sample and for copies; hashes is nil when we couldn't decode it
+	if !job.Sample {
+		if job.CheckUsage && hashes != nil {
+			if results.sampleMatch, err = s.checkSampleUsage(job, hashes); err != nil {
+				results.removeFiles(dir)
+				return err
+			}
+		}
+		if results.duplicates, err = s.findDuplicates(job, hashes); err != nil {
+			results.removeFiles(dir)
+			return err
+		}
+	}
+
+	// The players fall back to the original without one, so a preview that fails isn't worth losing the rest over
+	results.preview, err = s.makePreview(dir, job.Filename, audio, results.listeningGain)
+	if err != nil {
+		log.Printf("Failed to make a preview of %s in round %s: %v", job.Filename, job.Code, err)
+	}
+
+	attached, err := s.attachResults(job.Code, job.Filename, results)
+	if err != nil || !attached {
+		results.removeFiles(dir) // nobody will play them
+		return err
+	}
+	if results.analysis != nil {
+		log.Printf("Analyzed %s in round %s: %.1f BPM, %q", job.Filename, job.Code, results.analysis.BPM, results.analysis.Key)
+	}
+	return nil
+}
+
+// uploadResults is what a job worked out about an upload, and the files it made alongside it; any of them can be missing
+type uploadResults struct {
+	analysis      *AudioAnalysis // nil for formats we can't decode
+	listeningCopy string
+	listeningGain float64
+	preview       string
+	print         string             // the file's fingerprint
+	sampleMatch   *SampleMatch       // an entry's score against the sample
+	duplicates    []DuplicateWarning // other entries it looks like a copy of
+}
+
+func (r uploadResults) removeFiles(dir string) {
+	for _, name := range []string{r.listeningCopy, r.preview, r.print} {
+		if name != "" {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+/*
+attachResults stores the job's results on whatever in the round uses the file (the sample, a submission, or both)
+and marks its job done. Returns false when nothing uses it any more.
+*/
+func (s *Server) attachResults(code string, filename string, results uploadResults) (bool, error) {
+	done := &JobStatus{State: JobDone, UpdatedAt: time.Now()}
+	return s.updateUpload(code, filename, func(round *Round, submission *Submission) {
+		if submission == nil {
+			round.SampleAnalysis, round.SamplePreview, round.SampleJob = results.analysis, results.preview, done
+			if results.print != "" {
+				round.SamplePrint = results.print
+			}
+			return
+		}
+		submission.Analysis, submission.Preview, submission.Job = results.analysis, results.preview, done
+		submission.ListeningCopy, submission.ListeningGain = results.listeningCopy, results.listeningGain
+		submission.Print, submission.SampleMatch = results.print, results.sampleMatch
+		round.recordDuplicates(submission, results.duplicates)
+	})
+}
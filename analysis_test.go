@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// tone is mono audio: the sum of sine waves at the given frequencies, plus a decaying thump on every beat if bpm > 0
+func tone(rate int, seconds float64, bpm float64, frequencies ...float64) *pcmAudio {
+	samples := make([]float32, int(float64(rate)*seconds))
+	for i := range samples {
+		t := float64(i) / float64(rate)
+		var value float64
+		for _, frequency := range frequencies {
+			value += 0.1 * math.Sin(2*math.Pi*frequency*t)
+		}
+		if bpm > 0 {
+			since := math.Mod(t, 60/bpm)
+			value += 0.6 * math.Exp(-since*40) * math.Sin(2*math.Pi*60*since)
+		}
+		samples[i] = float32(value)
+	}
+	return &pcmAudio{SampleRate: rate, Channels: [][]float32{samples}}
+}
+
+func TestEstimateBPM(t *testing.T) {
+	for _, bpm := range []float64{90, 120, 140} {
+		audio := tone(44100, 20, bpm, 220)
+		signal, rate := downsample(audio.mono(), audio.SampleRate, analysisSampleRate)
+		if got := estimateBPM(signal, rate); math.Abs(got-bpm) > 1 {
+			t.Errorf("%v BPM came out as %v", bpm, got)
+		}
+	}
+
+	// Too short to say, and no beat at all
+	short := tone(44100, 3, 120)
+	if signal, rate := downsample(short.mono(), short.SampleRate, analysisSampleRate); estimateBPM(signal, rate) != 0 {
+		t.Error("found a tempo in three seconds of audio")
+	}
+	silence := make([]float64, 11025*20)
+	if got := estimateBPM(silence, 11025); got != 0 {
+		t.Errorf("found %v BPM in silence", got)
+	}
+}
+
+func TestEstimateBPMLowRates(t *testing.T) {
+	// The decoders refuse rates this low, but the tempo search mustn't fall over if something gets through
+	random := rand.New(rand.NewSource(1))
+	for _, rate := range []float64{100, 300, 425, 1000} {
+		signal := make([]float64, int(rate*40))
+		for i := range signal {
+			signal[i] = random.Float64()*2 - 1
+		}
+		estimateBPM(signal, rate)
+	}
+}
+
+func TestEstimateKey(t *testing.T) {
+	tests := []struct {
+		notes []float64
+		want  string
+	}{
+		{[]float64{220, 261.63, 329.63}, "A minor"},         // A C E
+		{[]float64{261.63, 329.63, 392}, "C major"},         // C E G
+		{[]float64{293.66, 369.99, 440, 587.33}, "D major"}, // D F# A D
+	}
+	for _, test := range tests {
+		audio := tone(44100, 10, 0, test.notes...)
+		signal, rate := downsample(audio.mono(), audio.SampleRate, analysisSampleRate)
+		key, confidence := estimateKey(signal, rate)
+		if key != test.want || confidence < minKeyConfidence {
+			t.Errorf("%v came out as %s (%.2f), want %s", test.notes, key, confidence, test.want)
+		}
+	}
+}
+
+func TestMeasureLoudness(t *testing.T) {
+	// A 1 kHz sine at -20 dBFS on both channels reads -20 LUFS (K-weighting is flat there, and two channels add 3 dB
+	// that the sine's RMS takes away) with a true peak of -20 dBTP
+	for _, rate := range []int{44100, 48000} {
+		audio := tone(rate, 10, 0, 1000)
+		audio.Channels = append(audio.Channels, audio.Channels[0])
+		loudness := measureLoudness(audio)
+		if loudness == nil {
+			t.Fatalf("%d Hz: no loudness", rate)
+		}
+		if math.Abs(loudness.Integrated+20) > 0.2 || math.Abs(loudness.TruePeak+20) > 0.2 {
+			t.Errorf("%d Hz: got %.2f LUFS and %.2f dBTP, want -20 and -20", rate, loudness.Integrated, loudness.TruePeak)
+		}
+	}
+
+	silence := &pcmAudio{SampleRate: 48000, Channels: [][]float32{make([]float32, 48000*5)}}
+	if loudness := measureLoudness(silence); loudness != nil {
+		t.Errorf("silence measured %+v", loudness)
+	}
+}
+
+func TestMatchSample(t *testing.T) {
+	sample := tone(44100, 8, 120, 220, 330, 495)
+	samplePrint := fingerprint(sample)
+	if len(samplePrint) == 0 {
+		t.Fatal("no fingerprint")
+	}
+
+	// The sample turned down and played in the middle of some other music
+	quieter := make([]float32, 0, 44100*16)
+	other := tone(44100, 4, 0, 150, 410).Channels[0]
+	quieter = append(quieter, other...)
+	for _, value := range sample.Channels[0] {
+		quieter = append(quieter, value*0.5)
+	}
+	quieter = append(quieter, other...)
+	entry := &pcmAudio{SampleRate: 44100, Channels: [][]float32{quieter}}
+	match := matchSample(samplePrint, fingerprint(entry))
+	if match == nil || match.Coverage < 0.4 || match.Coverage > 0.6 {
+		t.Errorf("sample in the middle of the entry matched %+v, want about half", match)
+	}
+
+	unrelated := tone(44100, 8, 95, 175, 262)
+	if match := matchSample(samplePrint, fingerprint(unrelated)); match == nil || !match.Flagged {
+		t.Errorf("unrelated entry matched %+v", match)
+	}
+}
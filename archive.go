@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log" // For Logging errors and info messages
+	"os"  // For OS interface
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+The archive is where closed rounds go to outlive Redis. Two pieces:
+
+  - an embedded bbolt database (a single file, no server to run) holding one JSON ArchivedRound per join code
+  - a blob store: a folder of audio files named by the SHA-256 of their contents, so the same file archived twice
+    (e.g. a sample reused across rounds) is only stored once
+
+Every time a round is closed, archiveRound snapshots it into both. Once the live round expires from Redis,
+/round/{code} falls back to a read-only view of the snapshot (see handlers_archive.go).
+*/
+
+var archiveRoundsBucket = []byte("rounds")
+
+// ArchivedRound is a closed round frozen in time. Secrets (password, invites) and who-voted-for-whom are left out.
+type ArchivedRound struct {
+	Round      Round             `json:"round"`
+	Results    []Placement       `json:"results"`
+	Blobs      map[string]string `json:"blobs"` // stored filename (as in Submission.Filename / SampleFileID) -> blob key
+	ArchivedAt time.Time         `json:"archivedAt"`
+}
+
+type Archive struct {
+	db    *bolt.DB
+	blobs *BlobStore
+}
+
+// BlobStore keeps files on disk under the hash of their contents, two levels deep (ab/abcdef...) to keep folders small
+type BlobStore struct {
+	dir string
+}
+
+func openArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		return nil, err
+	}
+
+	// The timeout stops us hanging forever if another copy of the server already has the file open
+	db, err := bolt.Open(filepath.Join(dir, "archive.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening archive database: %w", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(archiveRoundsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Archive{db: db, blobs: &BlobStore{dir: filepath.Join(dir, "blobs")}}, nil
+}
+
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+// save writes (or overwrites, if the round was reopened and closed again) the archived round
+func (a *Archive) save(archived *ArchivedRound) error {
+	data, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(archiveRoundsBucket).Put([]byte(archived.Round.JoinCode), data)
+	})
+}
+
+// get returns the archived round, or nil if there isn't one for this code
+func (a *Archive) get(code string) (*ArchivedRound, error) {
+	var archived *ArchivedRound
+	err := a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(archiveRoundsBucket).Get([]byte(code))
+		if data == nil {
+			return nil
+		}
+		archived = &ArchivedRound{}
+		return json.Unmarshal(data, archived)
+	})
+	return archived, err
+}
+
+// has reports whether a code is taken by an archived round, so new rounds don't reuse it and hijack its link
+func (a *Archive) has(code string) bool {
+	found := false
+	a.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(archiveRoundsBucket).Get([]byte(code)) != nil
+		return nil
+	})
+	return found
+}
+
+// put copies a file into the store and returns its key. Hashing happens while copying, so the file is only read once.
+func (b *BlobStore) put(srcPath string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(b.dir, "incoming-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op once it's been renamed into place
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), src); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	dst := b.path(key)
+	if _, err := os.Stat(dst); err == nil {
+		return key, nil // already have these exact bytes
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// path is where a blob lives on disk
+func (b *BlobStore) path(key string) string {
+	return filepath.Join(b.dir, key[:2], key)
+}
+
+// archiveInBackground starts archiveRound, counted in s.archiving so shutdown waits for it to finish
+func (s *Server) archiveInBackground(round Round) {
+	s.archiving.Add(1)
+	go func() {
+		defer s.archiving.Done()
+		s.archiveRound(round)
+	}()
+}
+
+/*
+archiveRound snapshots a closed round into the archive. It's run in its own goroutine when the round closes (see
+archiveInBackground) so the host isn't left waiting on file copies; failures are only logged, since the live round
+is still there for now.
+*/
+func (s *Server) archiveRound(round Round) {
+	archived := &ArchivedRound{
+		Results:    round.results(),
+		Blobs:      make(map[string]string),
+		ArchivedAt: time.Now(),
+	}
+
+	files := make([]string, 0, len(round.Submissions)+1)
+	if round.SampleFileID != "" {
+		files = append(files, round.SampleFileID)
+	}
+	for _, submission := range round.Submissions {
+		files = append(files, submission.Filename)
+	}
+	for _, layer := range round.Layers {
+		files = append(files, layer.Filename) // usually a submission too, unless its owner has left
+	}
+	for _, filename := range files {
+		if _, done := archived.Blobs[filename]; done {
+			continue
+		}
+		key, err := s.archive.blobs.put(filepath.Join(s.cfg.UploadDir, round.ID, filename))
+		if err != nil {
+			log.Printf("Failed to archive file %s from round %s: %v", filename, round.JoinCode, err)
+			continue
+		}
+		archived.Blobs[filename] = key
+	}
+
+	round.PasswordHash = ""
+	round.Invites = nil
+	round.Votes = nil
+	round.MatchVotes = nil // the bracket keeps the counts
+	round.Spectators = nil
+	archived.Round = round
+
+	if err := s.archive.save(archived); err != nil {
+		log.Printf("Failed to archive round %s: %v", round.JoinCode, err)
+		return
+	}
+	log.Printf("Archived round %s (%d files)", round.JoinCode, len(archived.Blobs))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+/*
+Decoding uploads to PCM
+
+The analysis features (tempo, key and so on, see analysis.go) work on raw samples, so uploads have to be decoded
+first. Only the lossless formats are handled, in plain Go with no codecs to install: WAV here, FLAC in flac.go.
+Everything else (MP3, M4A, OGG, AAC) comes back as errUnsupportedAudio and is simply left unanalyzed.
+
+Decoded audio is kept as float32 per channel in the range -1..1, whatever the bit depth of the file was. So a long
+upload can't eat all the memory on the server, decoding stops at decodeLimit: maxDecodeSeconds of audio, and never
+more than maxDecodeSamples across all the channels. FLAC can squeeze a lot of silence into very few bytes, so it's
+also held to maxSamplesPerByte of the file. Sample rates outside minSampleRate..maxSampleRate and more than
+maxChannels channels are refused: nothing real is recorded that way, and the analysis assumes it isn't.
+*/
+
+const (
+	maxDecodeSeconds  = 20 * 60
+	maxDecodeSamples  = 2 * 48000 * maxDecodeSeconds // 20 minutes of 48 kHz stereo, about 460 MB as float32
+	maxSamplesPerByte = 16                           // far more than even a quiet FLAC packs in
+	minSampleRate     = 8000
+	maxSampleRate     = 768000
+	maxChannels       = 8 // as many as FLAC can hold
+)
+
+// decodeLimit is the most samples per channel to decode from a file of inputBytes bytes
+func decodeLimit(sampleRate int, channels int, inputBytes int) int {
+	budget := min(maxDecodeSamples, inputBytes*maxSamplesPerByte)
+	return min(maxDecodeSeconds*sampleRate, budget/channels)
+}
+
+var errUnsupportedAudio = errors.New("unsupported audio format")
+
+// pcmAudio is decoded audio, one slice of samples per channel
+type pcmAudio struct {
+	SampleRate int
+	Channels   [][]float32
+}
+
+// frames is how many samples each channel has
+func (a *pcmAudio) frames() int {
+	if len(a.Channels) == 0 {
+		return 0
+	}
+	return len(a.Channels[0])
+}
+
+// duration is the length in seconds
+func (a *pcmAudio) duration() float64 {
+	if a.SampleRate == 0 {
+		return 0
+	}
+	return float64(a.frames()) / float64(a.SampleRate)
+}
+
+// mono mixes every channel down to one
+func (a *pcmAudio) mono() []float32 {
+	if len(a.Channels) == 1 {
+		return a.Channels[0]
+	}
+	mixed := make([]float32, a.frames())
+	scale := 1 / float32(len(a.Channels))
+	for _, channel := range a.Channels {
+		for i, sample := range channel {
+			mixed[i] += sample * scale
+		}
+	}
+	return mixed
+}
+
+// decodeAudioFile reads a WAV or FLAC file, telling them apart by their header rather than the extension
+func decodeAudioFile(path string) (*pcmAudio, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = skipID3(data)
+
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return decodeWAV(data)
+	case len(data) >= 4 && string(data[0:4]) == "fLaC":
+		return decodeFLAC(data)
+	}
+	return nil, errUnsupportedAudio
+}
+
+// skipID3 steps over an ID3v2 tag at the start of the file; some taggers put one in front of FLACs
+func skipID3(data []byte) []byte {
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		return data
+	}
+	// The size is "syncsafe": four bytes of seven bits each, not counting the 10-byte header
+	size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+	if data[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	if 10+size > len(data) {
+		return data
+	}
+	return data[10+size:]
+}
+
+// WAV format codes, from the fmt chunk
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// decodeWAV handles integer PCM (8, 16, 24 and 32 bit) and 32/64-bit float, including WAVE_FORMAT_EXTENSIBLE files
+func decodeWAV(data []byte) (*pcmAudio, error) {
+	var (
+		format, channels, bitsPerSample int
+		sampleRate                      int
+		samples                         []byte
+		haveFormat                      bool
+	)
+
+	// After the 12-byte RIFF header the file is a list of chunks: 4-byte ID, 4-byte size, then the data (padded to even)
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body) // a truncated file; take what's there
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, fmt.Errorf("wav: fmt chunk too short")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if format == wavFormatExtensible && len(body) >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:26])) // the first two bytes of the subformat GUID
+			}
+			haveFormat = true
+		case "data":
+			samples = body
+		}
+		pos += 8 + size + size%2
+	}
+
+	if !haveFormat || samples == nil {
+		return nil, fmt.Errorf("wav: missing fmt or data chunk")
+	}
+	if channels < 1 || channels > maxChannels || sampleRate < minSampleRate || sampleRate > maxSampleRate {
+		return nil, fmt.Errorf("wav: bad format (%d channels at %d Hz)", channels, sampleRate)
+	}
+
+	bytesPerSample := (bitsPerSample + 7) / 8
+	var read func(b []byte) float32
+	switch {
+	case format == wavFormatPCM && bytesPerSample == 1:
+		read = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 } // 8-bit WAV is unsigned
+	case format == wavFormatPCM && bytesPerSample == 2:
+		read = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == wavFormatPCM && bytesPerSample == 3:
+		read = func(b []byte) float32 {
+			return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == wavFormatPCM && bytesPerSample == 4:
+		read = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == wavFormatFloat && bytesPerSample == 4:
+		read = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+	case format == wavFormatFloat && bytesPerSample == 8:
+		read = func(b []byte) float32 { return float32(math.Float64frombits(binary.LittleEndian.Uint64(b))) }
+	default:
+		return nil, fmt.Errorf("%w: wav format %d at %d bits", errUnsupportedAudio, format, bitsPerSample)
+	}
+
+	frameSize := bytesPerSample * channels
+	frames := min(len(samples)/frameSize, decodeLimit(sampleRate, channels, len(data)))
+	audio := &pcmAudio{SampleRate: sampleRate, Channels: make([][]float32, channels)}
+	for c := range audio.Channels {
+		audio.Channels[c] = make([]float32, frames)
+	}
+	for i := 0; i < frames; i++ {
+		frame := samples[i*frameSize:]
+		for c := 0; c < channels; c++ {
+			audio.Channels[c][i] = read(frame[c*bytesPerSample:])
+		}
+	}
+	return audio, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// wavFile builds a WAV with one fmt chunk and one data chunk; size is the data chunk's size as written in its header
+func wavFile(format int, channels int, rate int, bits int, data []byte, size int) []byte {
+	le := binary.LittleEndian
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	out = append(out, "WAVEfmt "...)
+	out = le.AppendUint32(out, 16)
+	out = le.AppendUint16(out, uint16(format))
+	out = le.AppendUint16(out, uint16(channels))
+	out = le.AppendUint32(out, uint32(rate))
+	out = le.AppendUint32(out, uint32(rate*channels*bits/8))
+	out = le.AppendUint16(out, uint16(channels*bits/8))
+	out = le.AppendUint16(out, uint16(bits))
+	out = append(out, "data"...)
+	out = le.AppendUint32(out, uint32(size))
+	out = append(out, data...)
+	le.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+func TestDecodeWAV(t *testing.T) {
+	le := binary.LittleEndian
+	var pcm16 []byte
+	for _, sample := range []int16{0, 16384, -32768, 32767} { // two stereo frames
+		pcm16 = le.AppendUint16(pcm16, uint16(sample))
+	}
+	var float32s []byte
+	for _, sample := range []float32{0.5, -0.25} {
+		float32s = le.AppendUint32(float32s, math.Float32bits(sample))
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+		want [][]float32
+	}{
+		{"16-bit stereo", wavFile(wavFormatPCM, 2, 44100, 16, pcm16, len(pcm16)),
+			[][]float32{{0, -1}, {0.5, 32767.0 / 32768}}},
+		{"24-bit mono", wavFile(wavFormatPCM, 1, 48000, 24, []byte{0, 0, 0x40, 0, 0, 0xc0}, 6),
+			[][]float32{{0.5, -0.5}}},
+		{"8-bit mono", wavFile(wavFormatPCM, 1, 8000, 8, []byte{128, 192, 0}, 3),
+			[][]float32{{0, 0.5, -1}}},
+		{"float mono", wavFile(wavFormatFloat, 1, 44100, 32, float32s, len(float32s)),
+			[][]float32{{0.5, -0.25}}},
+		{"truncated data chunk", wavFile(wavFormatPCM, 2, 44100, 16, pcm16[:6], len(pcm16)),
+			[][]float32{{0}, {0.5}}},
+	}
+	for _, test := range tests {
+		audio, err := decodeWAV(test.file)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(audio.Channels) != len(test.want) {
+			t.Errorf("%s: got %d channels, want %d", test.name, len(audio.Channels), len(test.want))
+			continue
+		}
+		for c, want := range test.want {
+			if got := audio.Channels[c]; !equalSamples(got, want) {
+				t.Errorf("%s: channel %d is %v, want %v", test.name, c, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeWAVRejectsBadFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"no channels", wavFile(wavFormatPCM, 0, 44100, 16, make([]byte, 4), 4)},
+		{"300 Hz", wavFile(wavFormatPCM, 1, 300, 16, make([]byte, 300*2*40), 300*2*40)},
+		{"absurd sample rate", wavFile(wavFormatPCM, 1, 1<<30, 16, make([]byte, 4), 4)},
+		{"nine channels", wavFile(wavFormatPCM, 9, 44100, 16, make([]byte, 18), 18)},
+		{"no data chunk", wavFile(wavFormatPCM, 1, 44100, 16, nil, 0)[:36]},
+	}
+	for _, test := range tests {
+		if _, err := decodeWAV(test.file); err == nil {
+			t.Errorf("%s: decoded without an error", test.name)
+		}
+	}
+}
+
+// flacWriter writes the bit-packed parts of a FLAC stream, most significant bit first
+type flacWriter struct {
+	data []byte
+	bits int
+}
+
+func (w *flacWriter) write(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if value>>i&1 != 0 {
+			w.data[len(w.data)-1] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+func (w *flacWriter) writeSigned(value int64, n int) {
+	w.write(uint64(value)&(1<<n-1), n)
+}
+
+func (w *flacWriter) align() {
+	for w.bits%8 != 0 {
+		w.write(0, 1)
+	}
+}
+
+// streamInfo starts a stream with just a STREAMINFO block; a totalSamples of 0 means unknown
+func (w *flacWriter) streamInfo(rate int, channels int, bits int, totalSamples uint64) {
+	w.write(uint64('f')<<24|uint64('L')<<16|uint64('a')<<8|uint64('C'), 32)
+	w.write(1, 1)   // last metadata block
+	w.write(0, 7)   // STREAMINFO
+	w.write(34, 24) // length
+	w.write(4096, 16)
+	w.write(4096, 16)
+	w.write(0, 24)
+	w.write(0, 24)
+	w.write(uint64(rate), 20)
+	w.write(uint64(channels-1), 3)
+	w.write(uint64(bits-1), 5)
+	w.write(totalSamples, 36)
+	w.write(0, 64) // MD5
+	w.write(0, 64)
+}
+
+// frameHeader starts a frame of blockSize samples, given in the header's 8-bit field
+func (w *flacWriter) frameHeader(number int, blockSize int, channelAssignment int) {
+	w.write(0x3ffe, 14)
+	w.write(0, 2)
+	w.write(6, 4) // block size in an 8-bit field after the frame number
+	w.write(0, 4) // sample rate from STREAMINFO
+	w.write(uint64(channelAssignment), 4)
+	w.write(0, 3) // bits per sample from STREAMINFO
+	w.write(0, 1)
+	w.write(uint64(number), 8)
+	w.write(uint64(blockSize-1), 8)
+	w.write(0, 8) // CRC-8, which the decoder doesn't check
+}
+
+func (w *flacWriter) frameFooter() {
+	w.align()
+	w.write(0, 16) // CRC-16
+}
+
+// subframeHeader writes a subframe's type byte, with wasted bits if there are any
+func (w *flacWriter) subframeHeader(subframeType int, wasted int) {
+	w.write(0, 1)
+	w.write(uint64(subframeType), 6)
+	if wasted == 0 {
+		w.write(0, 1)
+		return
+	}
+	w.write(1, 1)
+	w.write(0, wasted-1)
+	w.write(1, 1)
+}
+
+// escapedResidual writes a residual as a single unencoded partition of 8-bit numbers
+func (w *flacWriter) escapedResidual(residual []int64) {
+	w.write(0, 2)  // 4-bit Rice parameters
+	w.write(0, 4)  // one partition
+	w.write(15, 4) // escape
+	w.write(8, 5)
+	for _, value := range residual {
+		w.writeSigned(value, 8)
+	}
+}
+
+func TestDecodeFLAC(t *testing.T) {
+	w := &flacWriter{}
+	w.streamInfo(44100, 2, 16, 0)
+
+	// Frame 0: left verbatim, right a fixed order-2 predictor (a straight line, so every residual is 0)
+	w.frameHeader(0, 4, 1)
+	w.subframeHeader(1, 0)
+	for _, sample := range []int64{100, -200, 300, -32768} {
+		w.writeSigned(sample, 16)
+	}
+	w.subframeHeader(8+2, 0)
+	w.writeSigned(10, 16)
+	w.writeSigned(20, 16)
+	w.escapedResidual([]int64{0, 0})
+	w.frameFooter()
+
+	// Frame 1: mid/side, both constant, with a wasted bit on the mid channel
+	w.frameHeader(1, 2, flacMidSide)
+	w.subframeHeader(0, 1)
+	w.writeSigned(50, 15) // mid 100 once the wasted bit is put back
+	w.subframeHeader(0, 0)
+	w.writeSigned(20, 17) // side
+	w.frameFooter()
+
+	audio, err := decodeFLAC(w.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.SampleRate != 44100 || len(audio.Channels) != 2 {
+		t.Fatalf("got %d channels at %d Hz", len(audio.Channels), audio.SampleRate)
+	}
+	scale := float32(1) / (1 << 15)
+	want := [][]float32{
+		{100 * scale, -200 * scale, 300 * scale, -1, 110 * scale, 110 * scale},
+		{10 * scale, 20 * scale, 30 * scale, 40 * scale, 90 * scale, 90 * scale},
+	}
+	for c := range want {
+		if !equalSamples(audio.Channels[c], want[c]) {
+			t.Errorf("channel %d is %v, want %v", c, audio.Channels[c], want[c])
+		}
+	}
+}
+
+func TestDecodeFLACRejectsBadStreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *flacWriter)
+	}{
+		{"300 Hz", func(w *flacWriter) {
+			w.streamInfo(300, 1, 16, 0)
+			w.frameHeader(0, 1, 0)
+			w.subframeHeader(0, 0)
+			w.writeSigned(0, 16)
+			w.frameFooter()
+		}},
+		{"predictor longer than the block", func(w *flacWriter) {
+			w.streamInfo(44100, 1, 16, 0)
+			w.frameHeader(0, 1, 0)
+			w.subframeHeader(8+4, 0)
+			w.writeSigned(0, 16)
+			w.frameFooter()
+		}},
+		{"LPC longer than the block", func(w *flacWriter) {
+			w.streamInfo(44100, 1, 16, 0)
+			w.frameHeader(0, 2, 0)
+			w.subframeHeader(32+7, 0)
+			w.writeSigned(0, 16)
+			w.frameFooter()
+		}},
+		{"every bit wasted", func(w *flacWriter) {
+			w.streamInfo(44100, 1, 16, 0)
+			w.frameHeader(0, 1, 0)
+			w.subframeHeader(0, 16)
+			w.frameFooter()
+		}},
+		{"truncated frame", func(w *flacWriter) {
+			w.streamInfo(44100, 1, 16, 0)
+			w.frameHeader(0, 64, 0)
+			w.subframeHeader(1, 0)
+			w.writeSigned(0, 16)
+		}},
+		{"frame with the wrong number of channels", func(w *flacWriter) {
+			w.streamInfo(44100, 1, 16, 0)
+			w.frameHeader(0, 1, 1)
+			w.subframeHeader(0, 0)
+			w.writeSigned(0, 16)
+			w.subframeHeader(0, 0)
+			w.writeSigned(0, 16)
+			w.frameFooter()
+		}},
+	}
+	for _, test := range tests {
+		w := &flacWriter{}
+		test.write(w)
+		if _, err := decodeFLAC(w.data); err == nil {
+			t.Errorf("%s: decoded without an error", test.name)
+		}
+	}
+}
+
+func TestDecodeFLACMemoryLimits(t *testing.T) {
+	// A header claiming hours of 8-channel audio at the highest rate mustn't allocate anything up front
+	w := &flacWriter{}
+	w.streamInfo(maxSampleRate, 8, 16, 1<<36-1)
+	w.frameHeader(0, 1, 7)
+	for range 8 {
+		w.subframeHeader(0, 0)
+		w.writeSigned(0, 16)
+	}
+	w.frameFooter()
+	audio, err := decodeFLAC(w.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.frames() != 1 || cap(audio.Channels[0]) > 16 {
+		t.Errorf("decoded %d frames into room for %d", audio.frames(), cap(audio.Channels[0]))
+	}
+
+	// Constant subframes pack a lot of samples into a few bytes; the output is held to maxSamplesPerByte of the file
+	w = &flacWriter{}
+	w.streamInfo(44100, 1, 16, 0)
+	for frame := range 200 {
+		w.frameHeader(frame, 256, 0)
+		w.subframeHeader(0, 0)
+		w.writeSigned(1000, 16)
+		w.frameFooter()
+	}
+	audio, err = decodeFLAC(w.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := len(w.data) * maxSamplesPerByte; audio.frames() == 0 || audio.frames() > limit {
+		t.Errorf("decoded %d samples from %d bytes, want at most %d", audio.frames(), len(w.data), limit)
+	}
+}
+
+func equalSamples(got []float32, want []float32) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(float64(got[i]-want[i])) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+/*
+Config holds every knob the server has. It's filled in layers, each one overriding the last:
+
+ 1. defaultConfig() below, which matches how the server always behaved before it was configurable
+ 2. a JSON config file, if one is given with -config (or PARTITIONLY_CONFIG)
+ 3. environment variables (PORT, REDIS_URL and REDIS_PASSWORD still work, plus the PARTITIONLY_* ones in applyEnv)
+ 4. command line flags, but only the ones actually passed
+
+Then validate() checks the result once at startup, so a typo in the config stops the server right away instead of
+surfacing as a weird error on the first upload.
+*/
+type Config struct {
+	ListenAddr string `json:"listenAddr"` // e.g. ":8080"
+
+	UploadDir  string `json:"uploadDir"`  // round uploads, one folder per round ID
+	LibraryDir string `json:"libraryDir"` // account holders' copies of their submissions, one folder per user ID
+	ArchiveDir string `json:"archiveDir"` // archive database + blob store for closed rounds (see archive.go)
+
+	RoundTTL          Duration `json:"roundTTL"`          // how long a round lasts when the host doesn't pick (sessions expire with the round)
+	MaxRoundLifetime  Duration `json:"maxRoundLifetime"`  // the longest a host can make a round last, extensions included
+	AccountSessionTTL Duration `json:"accountSessionTTL"` // "account" cookie + Redis account session
+
+	MaxUploadMB int64 `json:"maxUploadMB"`
+	JobWorkers  int   `json:"jobWorkers"` // how many uploads are processed at once in the background (see jobs.go)
+
+	// ffmpeg (or a path to it) to make previews with; empty uses the built-in WAV/FLAC downsampler (see preview.go)
+	PreviewEncoder string `json:"previewEncoder"`
+
+	Cookies    CookieConfig     `json:"cookies"`
+	Redis      RedisConfig      `json:"redis"`
+	TLS        TLSConfig        `json:"tls"`
+	RateLimits RateLimitsConfig `json:"rateLimits"`
+}
+
+type CookieConfig struct {
+	// Secure cookies are only sent over HTTPS. Turned on automatically when TLS is configured, but needs to be
+	// set by hand when a reverse proxy does the HTTPS part for us.
+	Secure bool `json:"secure"`
+}
+
+type RedisConfig struct {
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`       // Redis DB number; a namespace, so several deployments can share one Redis
+	Protocol int    `json:"protocol"` // 2 for RESP2, 3 for RESP3
+}
+
+// TLSConfig turns on HTTPS when both files are set
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type RateLimitsConfig struct {
+	Join    RateLimit `json:"join"`
+	Create  RateLimit `json:"create"`
+	Upload  RateLimit `json:"upload"`
+	Account RateLimit `json:"account"`
+}
+
+/*
+Duration is a time.Duration that reads and writes as a string like "24h" or "90m" in the JSON file, instead of a
+raw number of nanoseconds nobody could read.
+*/
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"24h\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:        ":8080",
+		UploadDir:         "temp/uploads",
+		LibraryDir:        "temp/library",
+		ArchiveDir:        "data/archive",
+		RoundTTL:          Duration{24 * time.Hour},
+		MaxRoundLifetime:  Duration{30 * 24 * time.Hour},
+		AccountSessionTTL: Duration{30 * 24 * time.Hour},
+		MaxUploadMB:       32,
+		JobWorkers:        2,
+		Redis: RedisConfig{
+			Addr:     "localhost:6379",
+			Protocol: 3,
+		},
+		RateLimits: RateLimitsConfig{
+			Join:    joinRateLimit,
+			Create:  createRateLimit,
+			Upload:  uploadRateLimit,
+			Account: accountRateLimit,
+		},
+	}
+}
+
+// loadConfig builds the Config from defaults, file, environment and flags (args is usually os.Args[1:])
+func loadConfig(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("partitionly", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("PARTITIONLY_CONFIG"), "path to a JSON config file")
+	listenAddr := flags.String("addr", "", "address to listen on, e.g. :8080")
+	uploadDir := flags.String("upload-dir", "", "where round uploads are stored")
+	libraryDir := flags.String("library-dir", "", "where account holders' submission copies are stored")
+	archiveDir := flags.String("archive-dir", "", "where closed rounds are archived")
+	roundTTL := flags.Duration("round-ttl", 0, "how long rounds last unless the host picks, e.g. 24h")
+	maxRoundLifetime := flags.Duration("max-round-lifetime", 0, "the longest a host can make a round last")
+	accountSessionTTL := flags.Duration("account-session-ttl", 0, "how long account logins last")
+	maxUploadMB := flags.Int64("max-upload-mb", 0, "largest upload accepted, in megabytes")
+	jobWorkers := flags.Int("job-workers", 0, "how many uploads to process at once in the background")
+	previewEncoder := flags.String("preview-encoder", "", "ffmpeg to make previews with, e.g. ffmpeg or /usr/bin/ffmpeg")
+	secureCookies := flags.Bool("secure-cookies", false, "only send cookies over HTTPS")
+	redisAddr := flags.String("redis-addr", "", "Redis host:port")
+	redisPassword := flags.String("redis-password", "", "Redis password")
+	redisDB := flags.Int("redis-db", 0, "Redis database number")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file; serves HTTPS when set with -tls-key")
+	tlsKey := flags.String("tls-key", "", "TLS private key file")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+
+	if *configPath != "" {
+		file, err := os.Open(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		// DisallowUnknownFields so a misspelled key is an error instead of being quietly ignored
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	// Visit only walks the flags that were actually passed, so unset flags don't clobber the file or env
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.ListenAddr = *listenAddr
+		case "upload-dir":
+			cfg.UploadDir = *uploadDir
+		case "library-dir":
+			cfg.LibraryDir = *libraryDir
+		case "archive-dir":
+			cfg.ArchiveDir = *archiveDir
+		case "round-ttl":
+			cfg.RoundTTL.Duration = *roundTTL
+		case "max-round-lifetime":
+			cfg.MaxRoundLifetime.Duration = *maxRoundLifetime
+		case "account-session-ttl":
+			cfg.AccountSessionTTL.Duration = *accountSessionTTL
+		case "max-upload-mb":
+			cfg.MaxUploadMB = *maxUploadMB
+		case "job-workers":
+			cfg.JobWorkers = *jobWorkers
+		case "preview-encoder":
+			cfg.PreviewEncoder = *previewEncoder
+		case "secure-cookies":
+			cfg.Cookies.Secure = *secureCookies
+		case "redis-addr":
+			cfg.Redis.Addr = *redisAddr
+		case "redis-password":
+			cfg.Redis.Password = *redisPassword
+		case "redis-db":
+			cfg.Redis.DB = *redisDB
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		}
+	})
+
+	// The names are fixed so each route group keeps its own Redis buckets whatever the file says
+	cfg.RateLimits.Join.Name = joinRateLimit.Name
+	cfg.RateLimits.Create.Name = createRateLimit.Name
+	cfg.RateLimits.Upload.Name = uploadRateLimit.Name
+	cfg.RateLimits.Account.Name = accountRateLimit.Name
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv reads the environment variables; PORT, REDIS_URL and REDIS_PASSWORD are kept from before there was a Config
+func (c *Config) applyEnv() error {
+	if port := os.Getenv("PORT"); port != "" {
+		c.ListenAddr = ":" + port
+	}
+	if addr := os.Getenv("REDIS_URL"); addr != "" {
+		c.Redis.Addr = addr
+	}
+	if password := os.Getenv("REDIS_PASSWORD"); password != "" {
+		c.Redis.Password = password
+	}
+
+	stringVars := map[string]*string{
+		"PARTITIONLY_ADDR":            &c.ListenAddr,
+		"PARTITIONLY_UPLOAD_DIR":      &c.UploadDir,
+		"PARTITIONLY_LIBRARY_DIR":     &c.LibraryDir,
+		"PARTITIONLY_ARCHIVE_DIR":     &c.ArchiveDir,
+		"PARTITIONLY_PREVIEW_ENCODER": &c.PreviewEncoder,
+		"PARTITIONLY_TLS_CERT":        &c.TLS.CertFile,
+		"PARTITIONLY_TLS_KEY":         &c.TLS.KeyFile,
+	}
+	for name, field := range stringVars {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	durations := map[string]*Duration{
+		"PARTITIONLY_ROUND_TTL":           &c.RoundTTL,
+		"PARTITIONLY_MAX_ROUND_LIFETIME":  &c.MaxRoundLifetime,
+		"PARTITIONLY_ACCOUNT_SESSION_TTL": &c.AccountSessionTTL,
+	}
+	for name, field := range durations {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.Duration = parsed
+		}
+	}
+
+	if value := os.Getenv("PARTITIONLY_MAX_UPLOAD_MB"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("PARTITIONLY_MAX_UPLOAD_MB: %w", err)
+		}
+		c.MaxUploadMB = parsed
+	}
+	if value := os.Getenv("PARTITIONLY_JOB_WORKERS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("PARTITIONLY_JOB_WORKERS: %w", err)
+		}
+		c.JobWorkers = parsed
+	}
+	if value := os.Getenv("PARTITIONLY_REDIS_DB"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("PARTITIONLY_REDIS_DB: %w", err)
+		}
+		c.Redis.DB = parsed
+	}
+	if value := os.Getenv("PARTITIONLY_SECURE_COOKIES"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("PARTITIONLY_SECURE_COOKIES: %w", err)
+		}
+		c.Cookies.Secure = parsed
+	}
+
+	return nil
+}
+
+// validate collects every problem at once so fixing a config file doesn't take one restart per mistake
+func (c *Config) validate() error {
+	var problems []error
+
+	if c.ListenAddr == "" {
+		problems = append(problems, errors.New("listenAddr is required"))
+	}
+	if c.UploadDir == "" {
+		problems = append(problems, errors.New("uploadDir is required"))
+	}
+	if c.LibraryDir == "" {
+		problems = append(problems, errors.New("libraryDir is required"))
+	}
+	if c.ArchiveDir == "" {
+		problems = append(problems, errors.New("archiveDir is required"))
+	}
+
+	ttls := []struct {
+		name string
+		ttl  Duration
+	}{
+		{"roundTTL", c.RoundTTL},
+		{"accountSessionTTL", c.AccountSessionTTL},
+	}
+	for _, t := range ttls {
+		if t.ttl.Duration < time.Minute {
+			problems = append(problems, fmt.Errorf("%s must be at least 1m (got %s)", t.name, t.ttl))
+		}
+	}
+
+	if c.MaxRoundLifetime.Duration < minRoundLifetime {
+		problems = append(problems, fmt.Errorf("maxRoundLifetime must be at least %s", minRoundLifetime))
+	} else if c.RoundTTL.Duration < minRoundLifetime || c.RoundTTL.Duration > c.MaxRoundLifetime.Duration {
+		problems = append(problems, fmt.Errorf("roundTTL must be between %s and maxRoundLifetime (%s)", minRoundLifetime, c.MaxRoundLifetime))
+	}
+
+	if c.MaxUploadMB < 1 || c.MaxUploadMB > 2048 {
+		problems = append(problems, fmt.Errorf("maxUploadMB must be between 1 and 2048 (got %d)", c.MaxUploadMB))
+	}
+	if c.JobWorkers < 1 || c.JobWorkers > 64 {
+		problems = append(problems, fmt.Errorf("jobWorkers must be between 1 and 64 (got %d)", c.JobWorkers))
+	}
+	if c.PreviewEncoder != "" {
+		if _, err := exec.LookPath(c.PreviewEncoder); err != nil {
+			problems = append(problems, fmt.Errorf("previewEncoder: %w", err))
+		}
+	}
+
+	if c.Redis.Addr == "" {
+		problems = append(problems, errors.New("redis.addr is required"))
+	}
+	if c.Redis.DB < 0 {
+		problems = append(problems, fmt.Errorf("redis.db can't be negative (got %d)", c.Redis.DB))
+	}
+	if c.Redis.Protocol != 2 && c.Redis.Protocol != 3 {
+		problems = append(problems, fmt.Errorf("redis.protocol must be 2 or 3 (got %d)", c.Redis.Protocol))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, errors.New("tls.certFile and tls.keyFile must be set together"))
+	}
+	for _, path := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Errorf("tls file: %w", err))
+		}
+	}
+
+	for _, limit := range []RateLimit{c.RateLimits.Join, c.RateLimits.Create, c.RateLimits.Upload, c.RateLimits.Account} {
+		if limit.Burst < 1 || limit.Every.Duration <= 0 {
+			problems = append(problems, fmt.Errorf("rateLimits.%s needs a burst of at least 1 and a positive interval", limit.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// tlsEnabled reports whether we serve HTTPS ourselves
+func (c *Config) tlsEnabled() bool {
+	return c.TLS.CertFile != "" && c.TLS.KeyFile != ""
+}
+
+// secureCookies is whether cookies get the Secure flag; always on when we're serving HTTPS ourselves
+func (c *Config) secureCookies() bool {
+	return c.Cookies.Secure || c.tlsEnabled()
+}
+
+// maxUploadBytes is MaxUploadMB in bytes, for ParseMultipartForm and http.MaxBytesReader
+func (c *Config) maxUploadBytes() int64 {
+	return c.MaxUploadMB << 20
+}
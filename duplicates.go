@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log" // For Logging errors and info messages
+	"math"
+	"path/filepath"
+	"sort"
+)
+
+/*
+Duplicate entries
+
+Nothing stopped two players uploading the same file, or someone handing in a copy of another entry with the volume
+nudged. So when an entry's background job runs (see jobs.go) it's compared with:
+
+  - every other entry in the round, and
+  - the same player's entries from their earlier rounds, if they're logged in (guests can't be recognised from one
+    round to the next). Their library keeps a fingerprint of each entry for this.
+
+Two checks are made. Exact copies have the same SHA-256 of the file's bytes, taken while the upload is saved. Similar
+entries are different files with the same audio, found with the fingerprints from fingerprint.go. Similarity is how
+much of one entry lines up with the other, in whichever direction is higher, so a copy of just the first half still
+counts. It's flagged from duplicateSimilarity up. In sample rounds the sample's own hashes are left out first, since
+everyone's meant to be using it. Telephone entries are remixes of the one before and build-up layers are heard on top
+of each other, so in those modes only exact copies are checked within the round.
+
+Warnings go on both entries, and only the hosts see them: on the participant list, and above the close button, so
+they can listen before the results go out.
+*/
+
+const (
+	duplicateSimilarity = 0.75
+	maxEarlierPrints    = 40 // earlier entries a new one is compared with; the newest ones
+)
+
+type DuplicateKind string
+
+const (
+	DuplicateExact   DuplicateKind = "exact"   // byte for byte the same file
+	DuplicateSimilar DuplicateKind = "similar" // a different file with the same audio: re-encoded, turned up, trimmed...
+)
+
+// DuplicateWarning says an entry looks like a copy of another one
+type DuplicateWarning struct {
+	Kind          DuplicateKind `json:"kind"`
+	ParticipantID string        `json:"participantId,omitempty"` // another entry in this round, or...
+	EarlierRound  string        `json:"earlierRound,omitempty"`  // ...the join code of one of the player's earlier rounds
+	Similarity    float64       `json:"similarity"`              // 1 for exact copies
+	Label         string        `json:"label"`                   // e.g. "Same file as Sam's entry", for the page
+}
+
+// Percent is the similarity as a whole percentage, for the templates
+func (w DuplicateWarning) Percent() int {
+	return int(math.Round(w.Similarity * 100))
+}
+
+// hashSet is the set of hashes in a fingerprint
+func hashSet(hashes []printHash) map[uint32]bool {
+	set := make(map[uint32]bool, len(hashes))
+	for _, h := range hashes {
+		set[h.Hash] = true
+	}
+	return set
+}
+
+// printSimilarity is how much two fingerprints line up, leaving out the ignored hashes: the higher of the two coverages
+func printSimilarity(a []printHash, b []printHash, ignore map[uint32]bool) float64 {
+	keep := func(hashes []printHash) []printHash {
+		if ignore == nil {
+			return hashes
+		}
+		kept := make([]printHash, 0, len(hashes))
+		for _, h := range hashes {
+			if !ignore[h.Hash] {
+				kept = append(kept, h)
+			}
+		}
+		return kept
+	}
+	a, b = keep(a), keep(b)
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	return max(matchSample(a, b).Coverage, matchSample(b, a).Coverage)
+}
+
+/*
+compareEntry checks an entry against one other file: the same bytes, or failing that the same audio. printPath is
+the other file's fingerprint and may not exist; the kind is empty when they're not copies.
+*/
+func compareEntry(contentHash string, entryPrint []printHash, otherHash string, printPath string,
+	ignore map[uint32]bool) (DuplicateKind, float64) {
+	if contentHash != "" && contentHash == otherHash {
+		return DuplicateExact, 1
+	}
+	if entryPrint == nil || printPath == "" {
+		return "", 0
+	}
+	other, err := readPrint(printPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read fingerprint %s: %v", printPath, err)
+		}
+		return "", 0
+	}
+	similarity := printSimilarity(entryPrint, other, ignore)
+	if similarity < duplicateSimilarity {
+		return "", 0
+	}
+	return DuplicateSimilar, math.Round(similarity*100) / 100
+}
+
+// duplicateLabel is how a warning reads on the page; whose is "Sam's entry" or "their entry in Friday Flip"
+func duplicateLabel(kind DuplicateKind, similarity float64, whose string) string {
+	if kind == DuplicateExact {
+		return "Same file as " + whose
+	}
+	return fmt.Sprintf("Sounds like %s (%.0f%%)", whose, similarity*100)
+}
+
+/*
+findDuplicates compares an entry with the rest of the round and the player's earlier rounds. entryPrint is nil for
+files we can't decode, which can then only be caught as exact copies. It also files the entry's fingerprint in the
+player's library, for their later rounds to be checked against.
+*/
+func (s *Server) findDuplicates(job uploadJob, entryPrint []printHash) ([]DuplicateWarning, error) {
+	round, err := s.getRound(job.Code)
+	if err != nil || round == nil {
+		return nil, err
+	}
+	var entry *Submission
+	for _, submission := range round.Submissions {
+		if submission.Filename == job.Filename {
+			entry = submission
+			break
+		}
+	}
+	if entry == nil {
+		return nil, nil // replaced already
+	}
+
+	// Everyone in a sample round is meant to be using the same audio, so that part doesn't count towards a match
+	var ignore map[uint32]bool
+	if round.Mode.usesSample() && round.SamplePrint != "" {
+		if sample, err := readPrint(filepath.Join(s.cfg.UploadDir, round.ID, round.SamplePrint)); err == nil {
+			ignore = hashSet(sample)
+		}
+	}
+
+	var warnings []DuplicateWarning
+	fuzzy := entryPrint != nil && round.Mode != ModeTelephone && round.Mode != ModeBuildUp
+	for id, other := range round.Submissions {
+		if id == entry.ParticipantID {
+			continue
+		}
+		printPath := ""
+		if fuzzy && other.Print != "" {
+			printPath = filepath.Join(s.cfg.UploadDir, round.ID, other.Print)
+		}
+		kind, similarity := compareEntry(entry.ContentHash, entryPrint, other.ContentHash, printPath, ignore)
+		if kind == "" {
+			continue
+		}
+		warnings = append(warnings, DuplicateWarning{
+			Kind:          kind,
+			ParticipantID: id,
+			Similarity:    similarity,
+			Label:         duplicateLabel(kind, similarity, round.displayName(id)+"'s entry"),
+		})
+	}
+
+	if participant := round.Participants[entry.ParticipantID]; participant != nil && participant.UserID != "" {
+		warnings = append(warnings, s.findEarlierDuplicates(participant.UserID, round, entry, entryPrint, ignore)...)
+		if entryPrint != nil {
+			// The library copy was made when the upload came in; no folder means it wasn't, and there's nothing to pair with
+			libraryPrint := filepath.Join(s.libraryDir(participant.UserID), round.ID, printName(entry.Filename))
+			if err := writePrint(libraryPrint, entryPrint); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Failed to save fingerprint of %s into library: %v", entry.Filename, err)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// findEarlierDuplicates checks an entry against the player's entries in their other rounds, newest first
+func (s *Server) findEarlierDuplicates(userID string, round *Round, entry *Submission, entryPrint []printHash,
+	ignore map[uint32]bool) []DuplicateWarning {
+	historyData, err := s.db.HGetAll(ctx, userHistoryKey(userID)).Result()
+	if err != nil {
+		log.Printf("Failed to load history of %s for duplicate checks: %v", userID, err)
+		return nil
+	}
+
+	type earlierEntry struct {
+		history    *RoundHistoryEntry
+		submission *HistorySubmission
+	}
+	var earlier []earlierEntry
+	for roundID, data := range historyData {
+		if roundID == round.ID {
+			continue
+		}
+		var history RoundHistoryEntry
+		if err := json.Unmarshal([]byte(data), &history); err != nil {
+			continue
+		}
+		for _, submission := range history.Submissions {
+			earlier = append(earlier, earlierEntry{&history, submission})
+		}
+	}
+	sort.Slice(earlier, func(i, j int) bool {
+		return earlier[i].submission.UploadedAt.After(earlier[j].submission.UploadedAt)
+	})
+
+	// One warning per earlier round is plenty, even if they uploaded a few versions there
+	var warnings []DuplicateWarning
+	warned := make(map[string]bool)
+	for i, e := range earlier {
+		if warned[e.history.RoundID] {
+			continue
+		}
+		printPath := ""
+		if i < maxEarlierPrints {
+			printPath = filepath.Join(s.libraryDir(userID), e.history.RoundID, printName(e.submission.Filename))
+		}
+		kind, similarity := compareEntry(entry.ContentHash, entryPrint, e.submission.ContentHash, printPath, ignore)
+		if kind == "" {
+			continue
+		}
+		warned[e.history.RoundID] = true
+		name := e.history.RoundName
+		if name == "" {
+			name = e.history.JoinCode
+		}
+		warnings = append(warnings, DuplicateWarning{
+			Kind:         kind,
+			EarlierRound: e.history.JoinCode,
+			Similarity:   similarity,
+			Label:        duplicateLabel(kind, similarity, "their entry in "+name),
+		})
+	}
+	return warnings
+}
+
+// displayName is a participant's name, or a stand-in for someone who's left
+func (r *Round) displayName(participantID string) string {
+	if participant := r.Participants[participantID]; participant != nil {
+		return participant.DisplayName
+	}
+	return "someone who left"
+}
+
+/*
+recordDuplicates puts an entry's warnings on it, and the other side of each one on the entry it matched, so both
+show up whichever the host looks at. Entries that went while the job was running are skipped.
+*/
+func (r *Round) recordDuplicates(entry *Submission, warnings []DuplicateWarning) {
+	entry.Duplicates = nil
+	for _, warning := range warnings {
+		if warning.ParticipantID == "" {
+			entry.Duplicates = append(entry.Duplicates, warning)
+			continue
+		}
+		other := r.Submissions[warning.ParticipantID]
+		if other == nil {
+			continue
+		}
+		entry.Duplicates = append(entry.Duplicates, warning)
+		reverse := DuplicateWarning{
+			Kind:          warning.Kind,
+			ParticipantID: entry.ParticipantID,
+			Similarity:    warning.Similarity,
+			Label:         duplicateLabel(warning.Kind, warning.Similarity, r.displayName(entry.ParticipantID)+"'s entry"),
+		}
+		other.Duplicates = append(withoutDuplicatesOf(other.Duplicates, entry.ParticipantID), reverse)
+	}
+}
+
+// forgetDuplicatesOf drops the warnings that point at a participant's entry, once it's been replaced or removed
+func (r *Round) forgetDuplicatesOf(participantID string) {
+	for _, submission := range r.Submissions {
+		submission.Duplicates = withoutDuplicatesOf(submission.Duplicates, participantID)
+	}
+}
+
+func withoutDuplicatesOf(warnings []DuplicateWarning, participantID string) []DuplicateWarning {
+	var kept []DuplicateWarning
+	for _, warning := range warnings {
+		if warning.ParticipantID != participantID {
+			kept = append(kept, warning)
+		}
+	}
+	return kept
+}
+
+// duplicatePair is one entry's warning, for the list above the hosts' close button
+type duplicatePair struct {
+	Entry   string // whose entry
+	Warning DuplicateWarning
+}
+
+// duplicatePairs lists the warnings in the round, each pair of entries in it once
+func (r *Round) duplicatePairs() []duplicatePair {
+	ids := make([]string, 0, len(r.Submissions))
+	for id := range r.Submissions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var pairs []duplicatePair
+	for _, id := range ids {
+		for _, warning := range r.Submissions[id].Duplicates {
+			if warning.ParticipantID != "" && warning.ParticipantID < id {
+				continue // listed already, from the other side
+			}
+			pairs = append(pairs, duplicatePair{Entry: r.displayName(id), Warning: warning})
+		}
+	}
+	return pairs
+}
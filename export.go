@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log" // For Logging errors and info messages
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Export formats and scopes
+
+The export used to be one ZIP of everything. Two query parameters on the export routes (live and archived) change
+that. format is "zip" (the default) or "tar.gz", for people whose tools like tarballs better. scope is what goes in:
+
+  - all (the default): the sample and every entry, as before.
+  - mine: just the files the person asking uploaded. Any participant can export their own files, even when the host
+    hasn't allowed downloads.
+  - winner: the sample and the winning entry (entries, on a tie) once the round is closed; in a tournament, the
+    champion's.
+  - chain: a telephone round in chain order, the starting file first and then each remix of the one before it.
+
+Whatever the scope, files keep the names and tags they'd have in the full export (chain exports are numbered along
+the chain instead), and the manifest (see manifest.go) lists just what's in that export.
+*/
+
+type exportFormat string
+
+const (
+	exportZip   exportFormat = "zip"
+	exportTarGz exportFormat = "tar.gz"
+)
+
+type exportScope string
+
+const (
+	scopeAll    exportScope = "all"
+	scopeMine   exportScope = "mine"
+	scopeWinner exportScope = "winner"
+	scopeChain  exportScope = "chain"
+)
+
+// exportOptions is what the export's query parameters asked for
+type exportOptions struct {
+	Format exportFormat
+	Scope  exportScope
+}
+
+var (
+	errBadExportFormat = errors.New("Unknown export format; use zip or tar.gz")
+	errBadExportScope  = errors.New("Unknown export scope; use all, mine, winner or chain")
+	errNoWinnerYet     = errors.New("There's no winner until the round is closed and someone has voted")
+	errNotTelephone    = errors.New("Only telephone rounds have a chain to export")
+)
+
+// parseExportOptions reads ?format= and ?scope=, both optional
+func parseExportOptions(query url.Values) (exportOptions, error) {
+	options := exportOptions{Format: exportZip, Scope: scopeAll}
+	if format := query.Get("format"); format != "" {
+		options.Format = exportFormat(strings.ToLower(format))
+		if options.Format == "tgz" {
+			options.Format = exportTarGz
+		}
+		if options.Format != exportZip && options.Format != exportTarGz {
+			return options, errBadExportFormat
+		}
+	}
+	if scope := query.Get("scope"); scope != "" {
+		options.Scope = exportScope(strings.ToLower(scope))
+		switch options.Scope {
+		case scopeAll, scopeMine, scopeWinner, scopeChain:
+		default:
+			return options, errBadExportScope
+		}
+	}
+	return options, nil
+}
+
+// filename is what the download is called, e.g. "Friday Flip_winner_20240607_210000_export.tar.gz"
+func (o exportOptions) filename(round *Round) string {
+	name := round.Name
+	if o.Scope != scopeAll {
+		name += "_" + string(o.Scope)
+	}
+	return fmt.Sprintf("%s_%s_export.%s", name, time.Now().Format("20060102_150405"), o.Format)
+}
+
+func (f exportFormat) contentType() string {
+	if f == exportTarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+/*
+scopedExportFiles picks the files for an export. participantID is who's asking, for "mine". A scope that doesn't fit
+the round (no winner yet, not a telephone round) is an error to show them; nothing of theirs to export is just an
+empty list.
+*/
+func scopedExportFiles(round *Round, scope exportScope, participantID string) ([]exportFile, error) {
+	switch scope {
+	case scopeMine:
+		var mine []exportFile
+		for _, file := range exportFiles(round) {
+			if file.ParticipantID != "" && file.ParticipantID == participantID {
+				mine = append(mine, file)
+			}
+		}
+		return mine, nil
+
+	case scopeWinner:
+		winners := round.winnerIDs()
+		if len(winners) == 0 {
+			return nil, errNoWinnerYet
+		}
+		var files []exportFile
+		for _, file := range exportFiles(round) {
+			if file.Kind == "sample" || (file.Kind == "submission" && winners[file.ParticipantID]) {
+				files = append(files, file)
+			}
+		}
+		return files, nil
+
+	case scopeChain:
+		if round.Mode != ModeTelephone {
+			return nil, errNotTelephone
+		}
+		return chainExportFiles(round), nil
+	}
+	return exportFiles(round), nil
+}
+
+// winnerIDs is who won: the tournament's champion, or whoever came first in the vote (several, on a tie)
+func (r *Round) winnerIDs() map[string]bool {
+	if r.Bracket != nil {
+		if r.Bracket.ChampionID == "" {
+			return nil
+		}
+		return map[string]bool{r.Bracket.ChampionID: true}
+	}
+	if r.State != StateClosed {
+		return nil
+	}
+	winners := make(map[string]bool)
+	for _, placement := range r.results() {
+		if placement.Place == 1 && placement.Votes > 0 {
+			winners[placement.ParticipantID] = true
+		}
+	}
+	return winners
+}
+
+/*
+telephoneChain is the entries of a telephone round in the order they were passed along: starting from the file the
+round started with, each entry is followed by the one it was passed to. Anything not on the chain (it was broken by
+someone leaving, say) comes after, oldest first, so nothing is left out.
+*/
+func (r *Round) telephoneChain() []*Submission {
+	var chain []*Submission
+	seen := make(map[string]bool)
+	follow := func(submission *Submission) {
+		for submission != nil && !seen[submission.ParticipantID] {
+			seen[submission.ParticipantID] = true
+			chain = append(chain, submission)
+			submission = r.Submissions[submission.AssignedToID]
+		}
+	}
+
+	for _, submission := range r.Submissions {
+		if submission.Filename == r.SampleFileID {
+			follow(submission)
+		}
+	}
+	var rest []*Submission
+	for _, submission := range r.Submissions {
+		if !seen[submission.ParticipantID] {
+			rest = append(rest, submission)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].UploadedAt.Before(rest[j].UploadedAt) })
+	for _, submission := range rest {
+		follow(submission)
+	}
+	return chain
+}
+
+// chainExportFiles lists a telephone round's entries along the chain, numbered and tagged in that order
+func chainExportFiles(round *Round) []exportFile {
+	chain := round.telephoneChain()
+	files := make([]exportFile, 0, len(chain))
+	for i, submission := range chain {
+		name := round.displayName(submission.ParticipantID)
+		files = append(files, exportFile{
+			Kind:          "submission",
+			Filename:      submission.Filename,
+			Path:          fmt.Sprintf("%02d_%s_%s", i+1, entryNamePart(name), entryNamePart(submission.OriginalName)),
+			ParticipantID: submission.ParticipantID,
+			Submission:    submission,
+			Tags: &trackTags{
+				Title:   strings.TrimSuffix(submission.OriginalName, filepath.Ext(submission.OriginalName)),
+				Artist:  name,
+				Album:   round.Name,
+				Track:   i + 1,
+				Tracks:  len(chain),
+				Comment: exportComment(round),
+			},
+		})
+	}
+	return files
+}
+
+// exportWriter is an export being written, as a ZIP or a tar.gz
+type exportWriter interface {
+	// addFile adds a stored file under name; with tags, the copy gets them written in (see tags.go)
+	addFile(filePath string, name string, tags *trackTags) error
+	addText(name string, text string) error
+	close() error
+}
+
+func newExportWriter(format exportFormat, dst io.Writer) exportWriter {
+	if format == exportTarGz {
+		gz := gzip.NewWriter(dst)
+		return &tarExport{gz: gz, tw: tar.NewWriter(gz)}
+	}
+	return &zipExport{zw: zip.NewWriter(dst)}
+}
+
+type zipExport struct {
+	zw *zip.Writer
+}
+
+func (e *zipExport) addFile(filePath string, name string, tags *trackTags) error {
+	return addFileToZip(e.zw, filePath, name, tags)
+}
+
+func (e *zipExport) addText(name string, text string) error {
+	writer, err := e.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(text))
+	return err
+}
+
+func (e *zipExport) close() error {
+	return e.zw.Close()
+}
+
+// tarExport writes a gzipped tarball. Tar wants each file's size up front, so tagged files are stamped in memory first
+type tarExport struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (e *tarExport) addFile(filePath string, name string, tags *trackTags) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if tags == nil {
+		if err := e.tw.WriteHeader(tarHeader(name, info.Size(), info.ModTime())); err != nil {
+			return err
+		}
+		_, err = io.Copy(e.tw, file)
+		return err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if stamped, err := stampTags(data, *tags); err == nil {
+		data = stamped
+	} else if !errors.Is(err, errUnsupportedAudio) {
+		log.Printf("Failed to tag %s, exporting it untagged: %v", name, err)
+	}
+	if err := e.tw.WriteHeader(tarHeader(name, int64(len(data)), info.ModTime())); err != nil {
+		return err
+	}
+	_, err = e.tw.Write(data)
+	return err
+}
+
+func (e *tarExport) addText(name string, text string) error {
+	if err := e.tw.WriteHeader(tarHeader(name, int64(len(text)), time.Now())); err != nil {
+		return err
+	}
+	_, err := e.tw.Write([]byte(text))
+	return err
+}
+
+func (e *tarExport) close() error {
+	if err := e.tw.Close(); err != nil {
+		return err
+	}
+	return e.gz.Close()
+}
+
+// tarHeader is a plain file entry; PAX so names with accents or emoji survive
+func tarHeader(name string, size int64, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Sample usage
+
+The rule in sample rounds is that everyone flips the host's sample, and this is how we check it. It's the same trick
+song-recognition apps use:
+
+  - Fingerprint: the audio is resampled to printSampleRate and turned into a spectrogram, and the loudest points in
+    it (peaks that beat everything around them in time and frequency) are kept. Each peak is paired with a few of
+    the peaks just after it, and every pair becomes a hash of (frequency 1, frequency 2, frames between them) plus the
+    time of the first one. Hashes like that survive drums on top, EQ and a fair bit of noise.
+  - Match: every hash an entry shares with the sample votes for an offset (entry time minus sample time). A part of
+    the sample played straight piles lots of votes onto one offset, while hashes shared by chance scatter. Only
+    offsets with at least minAlignedHashes votes count, so a loop chopped up and placed all over the track still
+    counts at each spot it's used.
+
+The score is coverage: the share of the entry's seconds where the sample lines up. Entries under sampleMatchFlag get
+flagged for the host. It's a hint, not a verdict: a sample that's been pitched or stretched a lot won't line up, so
+the host listens before kicking anyone.
+
+Every upload's fingerprint is saved next to it when its background job runs (see jobs.go); each entry's job then
+compares against the sample's. Entries' fingerprints are also used to spot copies (see duplicates.go). Only what we can decode (WAV and FLAC) gets checked.
+*/
+
+const (
+	printSampleRate   = 11025
+	printFFTSize      = 1024
+	printHop          = 256 // about 23 ms per frame
+	printMinBin       = 8   // ~85 Hz; below that is mostly kick drum and rumble, which every track has
+	printMaxBin       = 400 // ~4.3 kHz
+	peakFreqSpan      = 12  // a peak has to be the loudest this many bins either side...
+	peakTimeSpan      = 6   // ...and this many frames either side
+	peaksPerSecond    = 30  // keep only the strongest, so quiet passages don't drown in noise peaks
+	printFanOut       = 5   // peaks each anchor is paired with
+	printMaxDelta     = 63  // frames; fits in 6 bits
+	minAlignedHashes  = 5
+	sampleMatchFlag   = 0.05 // under 5% of the entry lining up with the sample gets flagged
+	printBytesPerHash = 8
+)
+
+// printHash is one pair of peaks: the hash of the pair, and the frame the first peak is in
+type printHash struct {
+	Hash uint32
+	Time uint32
+}
+
+// SampleMatch is how much of an entry lines up with the round's sample
+type SampleMatch struct {
+	Coverage float64 `json:"coverage"` // share of the entry's seconds where the sample lines up, 0 to 1
+	Matches  int     `json:"matches"`  // hashes that lined up
+	Flagged  bool    `json:"flagged"`  // under sampleMatchFlag; worth a listen
+}
+
+// Percent is the coverage as a whole percentage, for the templates
+func (m *SampleMatch) Percent() int {
+	return int(math.Round(m.Coverage * 100))
+}
+
+// spectralPeak is one of the points kept from the spectrogram
+type spectralPeak struct {
+	frame, bin int
+	strength   float64
+}
+
+// fingerprint returns the hashes of the audio, in time order
+func fingerprint(audio *pcmAudio) []printHash {
+	signal := resample(audio.mono(), audio.SampleRate, printSampleRate)
+	frames := spectrogram(signal, printFFTSize, printHop)
+	if len(frames) == 0 {
+		return nil
+	}
+
+	// Log magnitudes, so the loud bits don't hide everything else
+	for _, frame := range frames {
+		for bin := range frame {
+			frame[bin] = math.Log1p(frame[bin] * 1000)
+		}
+	}
+
+	// A peak is the maximum of its neighbourhood; the max filter is done in two passes (frequency, then time)
+	bins := printMaxBin - printMinBin
+	alongFreq := make([][]float64, len(frames))
+	for t, frame := range frames {
+		alongFreq[t] = make([]float64, bins)
+		for b := range bins {
+			lo, hi := max(printMinBin, printMinBin+b-peakFreqSpan), min(printMaxBin, printMinBin+b+peakFreqSpan+1)
+			best := 0.0
+			for _, value := range frame[lo:hi] {
+				best = max(best, value)
+			}
+			alongFreq[t][b] = best
+		}
+	}
+	framesPerSecond := printSampleRate / printHop
+	var peaks []spectralPeak
+	for second := 0; second*framesPerSecond < len(frames); second++ {
+		var candidates []spectralPeak
+		for t := second * framesPerSecond; t < min(len(frames), (second+1)*framesPerSecond); t++ {
+			for b := range bins {
+				value := frames[t][printMinBin+b]
+				if value == 0 || value < alongFreq[t][b] {
+					continue
+				}
+				isPeak := true
+				for u := max(0, t-peakTimeSpan); u < min(len(frames), t+peakTimeSpan+1) && isPeak; u++ {
+					isPeak = alongFreq[u][b] <= value
+				}
+				if isPeak {
+					candidates = append(candidates, spectralPeak{frame: t, bin: printMinBin + b, strength: value})
+				}
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].strength > candidates[j].strength })
+		peaks = append(peaks, candidates[:min(len(candidates), peaksPerSecond)]...)
+	}
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].frame != peaks[j].frame {
+			return peaks[i].frame < peaks[j].frame
+		}
+		return peaks[i].bin < peaks[j].bin
+	})
+
+	// Pair each peak with the next few after it: 9 bits per frequency, 6 for the gap
+	var hashes []printHash
+	for i, anchor := range peaks {
+		paired := 0
+		for _, target := range peaks[i+1:] {
+			delta := target.frame - anchor.frame
+			if delta > printMaxDelta || paired == printFanOut {
+				break
+			}
+			if delta == 0 {
+				continue
+			}
+			hash := uint32(anchor.bin&0x1ff)<<15 | uint32(target.bin&0x1ff)<<6 | uint32(delta)
+			hashes = append(hashes, printHash{Hash: hash, Time: uint32(anchor.frame)})
+			paired++
+		}
+	}
+	return hashes
+}
+
+/*
+resample brings the signal to exactly the target rate, so files recorded at 44.1 and 48 kHz line up bin for bin and
+frame for frame: first down by a whole factor (averaging, which doubles as the low pass), then linearly the rest of
+the way.
+*/
+func resample(signal []float32, sampleRate int, target int) []float64 {
+	reduced, rate := downsample(signal, sampleRate, target)
+	if rate == float64(target) || len(reduced) < 2 {
+		return reduced
+	}
+	step := rate / float64(target)
+	out := make([]float64, int(float64(len(reduced)-1)/step)+1)
+	for i := range out {
+		position := float64(i) * step
+		index := int(position)
+		if index+1 >= len(reduced) {
+			out[i] = reduced[len(reduced)-1]
+			continue
+		}
+		fraction := position - float64(index)
+		out[i] = reduced[index]*(1-fraction) + reduced[index+1]*fraction
+	}
+	return out
+}
+
+// matchSample scores an entry's fingerprint against the sample's
+func matchSample(sample []printHash, entry []printHash) *SampleMatch {
+	if len(entry) == 0 {
+		return nil
+	}
+	sampleTimes := make(map[uint32][]uint32, len(sample))
+	for _, h := range sample {
+		sampleTimes[h.Hash] = append(sampleTimes[h.Hash], h.Time)
+	}
+
+	// Every shared hash votes for an offset; remember which entry frames voted where
+	votes := make(map[int64][]uint32)
+	for _, h := range entry {
+		for _, sampleTime := range sampleTimes[h.Hash] {
+			offset := int64(h.Time) - int64(sampleTime)
+			votes[offset] = append(votes[offset], h.Time)
+		}
+	}
+
+	framesPerSecond := uint32(printSampleRate / printHop)
+	covered := make(map[uint32]bool)
+	matches := 0
+	for _, times := range votes {
+		if len(times) < minAlignedHashes {
+			continue
+		}
+		matches += len(times)
+		for _, t := range times {
+			covered[t/framesPerSecond] = true
+		}
+	}
+
+	seconds := entry[len(entry)-1].Time/framesPerSecond + 1
+	coverage := math.Round(float64(len(covered))/float64(seconds)*100) / 100
+	return &SampleMatch{
+		Coverage: min(coverage, 1),
+		Matches:  matches,
+		Flagged:  coverage < sampleMatchFlag,
+	}
+}
+
+/*
+checkSampleUsage scores an entry against the round's sample, or returns nil when there's no sample fingerprint to
+compare with (the sample isn't WAV or FLAC, say). If the sample's own job hasn't finished yet, it errors so the entry's
+job is retried a bit later, unless that was the last try anyway.
+*/
+func (s *Server) checkSampleUsage(job uploadJob, entry []printHash) (*SampleMatch, error) {
+	round, err := s.getRound(job.Code)
+	if err != nil || round == nil {
+		return nil, err
+	}
+	if round.SamplePrint == "" {
+		sampleJob := round.SampleJob
+		stillGoing := sampleJob != nil && (sampleJob.State == JobPending || sampleJob.State == JobProcessing)
+		if stillGoing && job.Attempt+1 < maxJobAttempts {
+			return nil, errSampleNotReady
+		}
+		return nil, nil
+	}
+
+	sample, err := readPrint(filepath.Join(s.cfg.UploadDir, job.RoundID, round.SamplePrint))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return matchSample(sample, entry), nil
+}
+
+// printName is where a file's fingerprint goes, next to it
+func printName(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "_print.bin"
+}
+
+// writePrint saves a fingerprint as little-endian (hash, time) pairs
+func writePrint(path string, hashes []printHash) error {
+	data := make([]byte, 0, len(hashes)*printBytesPerHash)
+	for _, h := range hashes {
+		data = binary.LittleEndian.AppendUint32(data, h.Hash)
+		data = binary.LittleEndian.AppendUint32(data, h.Time)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readPrint(path string) ([]printHash, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%printBytesPerHash != 0 {
+		return nil, fmt.Errorf("fingerprint %s: %w", filepath.Base(path), errBadPrint)
+	}
+	hashes := make([]printHash, len(data)/printBytesPerHash)
+	for i := range hashes {
+		hashes[i].Hash = binary.LittleEndian.Uint32(data[i*8:])
+		hashes[i].Time = binary.LittleEndian.Uint32(data[i*8+4:])
+	}
+	return hashes, nil
+}
+
+var (
+	errBadPrint       = errors.New("truncated file")
+	errSampleNotReady = errors.New("waiting for the sample to be fingerprinted")
+)
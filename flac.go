@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+A small FLAC decoder
+
+Just enough of the format (https://xiph.org/flac/format.html) to get samples out for analysis: the STREAMINFO block,
+then frame after frame of constant, verbatim, fixed-predictor and LPC subframes with Rice-coded residuals, and the
+three stereo decorrelation modes. The checksums aren't verified; a corrupt frame just ends the decode early, and
+whatever decoded before it is still analyzed.
+*/
+
+var errFLACEnd = errors.New("flac: end of data")
+
+// bitReader reads big-endian bit fields, which is how everything in a FLAC frame is packed
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (br *bitReader) readBits(n int) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if br.pos+n > len(br.data)*8 {
+		return 0, errFLACEnd
+	}
+	var value uint64
+	for n > 0 {
+		bitInByte := br.pos % 8
+		take := min(8-bitInByte, n)
+		b := uint64(br.data[br.pos/8]) >> (8 - bitInByte - take) & (1<<take - 1)
+		value = value<<take | b
+		br.pos += take
+		n -= take
+	}
+	return value, nil
+}
+
+// readSigned reads an n-bit two's complement number
+func (br *bitReader) readSigned(n int) (int64, error) {
+	value, err := br.readBits(n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return int64(value<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts zero bits up to the next one bit
+func (br *bitReader) readUnary() (int, error) {
+	count := 0
+	for {
+		if br.pos >= len(br.data)*8 {
+			return 0, errFLACEnd
+		}
+		if br.data[br.pos/8]&(0x80>>(br.pos%8)) != 0 {
+			br.pos++
+			return count, nil
+		}
+		br.pos++
+		count++
+	}
+}
+
+func (br *bitReader) alignToByte() {
+	br.pos = (br.pos + 7) &^ 7
+}
+
+// flacStreamInfo is what the decoder needs from the STREAMINFO metadata block
+type flacStreamInfo struct {
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  uint64 // 0 when the encoder didn't know
+}
+
+func decodeFLAC(data []byte) (*pcmAudio, error) {
+	pos := 4 // past "fLaC"
+	var info *flacStreamInfo
+
+	// Metadata blocks: a 1-bit "last block" flag, a 7-bit type and a 24-bit length, then the block
+	for {
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("flac: truncated metadata")
+		}
+		last := data[pos]&0x80 != 0
+		blockType := data[pos] & 0x7f
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+length > len(data) {
+			return nil, fmt.Errorf("flac: truncated metadata")
+		}
+		if blockType == 0 && length >= 18 {
+			block := data[pos : pos+length]
+			packed := binary.BigEndian.Uint64(block[10:18])
+			info = &flacStreamInfo{
+				sampleRate:    int(packed >> 44),
+				channels:      int(packed>>41&0x7) + 1,
+				bitsPerSample: int(packed>>36&0x1f) + 1,
+				totalSamples:  packed & (1<<36 - 1),
+			}
+		}
+		pos += length
+		if last {
+			break
+		}
+	}
+	if info == nil || info.sampleRate == 0 {
+		return nil, fmt.Errorf("flac: no STREAMINFO")
+	}
+	if info.sampleRate < minSampleRate || info.sampleRate > maxSampleRate {
+		return nil, fmt.Errorf("flac: unsupported sample rate %d Hz", info.sampleRate)
+	}
+	if info.channels > maxChannels {
+		return nil, fmt.Errorf("flac: unsupported channel count %d", info.channels)
+	}
+
+	// STREAMINFO's total is only the encoder's word, so nothing is sized from it; the channels grow frame by frame
+	audio := &pcmAudio{SampleRate: info.sampleRate, Channels: make([][]float32, info.channels)}
+	br := &bitReader{data: data, pos: pos * 8}
+	limit := decodeLimit(info.sampleRate, info.channels, len(data))
+	for audio.frames() < limit {
+		samples, bitsPerSample, err := decodeFLACFrame(br, info)
+		if err == nil && samples != nil && len(samples) != len(audio.Channels) {
+			err = fmt.Errorf("flac: frame has %d channels, stream has %d", len(samples), len(audio.Channels))
+		}
+		if err != nil {
+			if audio.frames() == 0 {
+				return nil, err
+			}
+			break // trailing junk or a damaged frame; keep what decoded
+		}
+		if samples == nil {
+			break
+		}
+		scale := 1 / float32(int64(1)<<(bitsPerSample-1))
+		for c, channel := range samples {
+			for _, sample := range channel {
+				audio.Channels[c] = append(audio.Channels[c], float32(sample)*scale)
+			}
+		}
+	}
+
+	for c := range audio.Channels {
+		if len(audio.Channels[c]) > limit {
+			audio.Channels[c] = audio.Channels[c][:limit]
+		}
+	}
+	return audio, nil
+}
+
+// Channel assignments above 7 are the stereo decorrelation modes
+const (
+	flacLeftSide  = 8
+	flacSideRight = 9
+	flacMidSide   = 10
+)
+
+/*
+decodeFLACFrame decodes the frame at the reader's position and leaves the reader at the start of the next one.
+Returns nil samples at the end of the stream.
+*/
+func decodeFLACFrame(br *bitReader, info *flacStreamInfo) ([][]int32, int, error) {
+	br.alignToByte()
+	if br.pos/8+2 > len(br.data) {
+		return nil, 0, nil
+	}
+
+	// Frame header
+	sync, _ := br.readBits(14)
+	if sync != 0x3ffe {
+		return nil, 0, fmt.Errorf("flac: lost frame sync")
+	}
+	br.readBits(2) // reserved bit and blocking strategy
+	blockSizeCode, _ := br.readBits(4)
+	sampleRateCode, _ := br.readBits(4)
+	channelAssignment, _ := br.readBits(4)
+	sampleSizeCode, _ := br.readBits(3)
+	if _, err := br.readBits(1); err != nil {
+		return nil, 0, err
+	}
+
+	// The frame (or sample) number is UTF-8 style: the leading ones of the first byte say how many bytes follow
+	first, err := br.readBits(8)
+	if err != nil {
+		return nil, 0, err
+	}
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		if mask != 0x80 {
+			br.readBits(8)
+		}
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6:
+		v, _ := br.readBits(8)
+		blockSize = int(v) + 1
+	case blockSizeCode == 7:
+		v, _ := br.readBits(16)
+		blockSize = int(v) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return nil, 0, fmt.Errorf("flac: reserved block size")
+	}
+
+	// The sample rate here can only restate STREAMINFO's, so the extra bytes are just skipped
+	switch sampleRateCode {
+	case 12:
+		br.readBits(8)
+	case 13, 14:
+		br.readBits(16)
+	case 15:
+		return nil, 0, fmt.Errorf("flac: invalid sample rate")
+	}
+
+	bitsPerSample := info.bitsPerSample
+	switch sampleSizeCode {
+	case 1:
+		bitsPerSample = 8
+	case 2:
+		bitsPerSample = 12
+	case 4:
+		bitsPerSample = 16
+	case 5:
+		bitsPerSample = 20
+	case 6:
+		bitsPerSample = 24
+	case 7:
+		bitsPerSample = 32
+	}
+
+	if _, err := br.readBits(8); err != nil { // header CRC-8
+		return nil, 0, err
+	}
+
+	channels := int(channelAssignment) + 1
+	if channelAssignment >= flacLeftSide {
+		if channelAssignment > flacMidSide {
+			return nil, 0, fmt.Errorf("flac: reserved channel assignment")
+		}
+		channels = 2
+	}
+
+	samples := make([][]int32, channels)
+	for c := range samples {
+		// The side channel carries one extra bit
+		subframeBits := bitsPerSample
+		if (channelAssignment == flacLeftSide || channelAssignment == flacMidSide) && c == 1 ||
+			channelAssignment == flacSideRight && c == 0 {
+			subframeBits++
+		}
+		samples[c], err = decodeFLACSubframe(br, blockSize, subframeBits)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Frame footer: pad to a byte, then CRC-16
+	br.alignToByte()
+	if _, err := br.readBits(16); err != nil {
+		return nil, 0, err
+	}
+
+	switch channelAssignment {
+	case flacLeftSide:
+		for i := range samples[1] {
+			samples[1][i] = samples[0][i] - samples[1][i]
+		}
+	case flacSideRight:
+		for i := range samples[0] {
+			samples[0][i] += samples[1][i]
+		}
+	case flacMidSide:
+		for i := range samples[0] {
+			mid, side := samples[0][i]<<1|samples[1][i]&1, samples[1][i]
+			samples[0][i] = (mid + side) >> 1
+			samples[1][i] = (mid - side) >> 1
+		}
+	}
+	return samples, bitsPerSample, nil
+}
+
+// fixedCoefficients are the fixed predictors of orders 0 to 4
+var fixedCoefficients = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+func decodeFLACSubframe(br *bitReader, blockSize int, bitsPerSample int) ([]int32, error) {
+	header, err := br.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	subframeType := int(header >> 1 & 0x3f)
+
+	// "Wasted bits": every sample had this many zero bits at the bottom, which the encoder shaved off
+	wasted := 0
+	if header&1 != 0 {
+		zeros, err := br.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wasted = zeros + 1
+		bitsPerSample -= wasted
+		if bitsPerSample <= 0 {
+			return nil, fmt.Errorf("flac: more wasted bits than bits")
+		}
+	}
+
+	samples := make([]int32, blockSize)
+	switch {
+	case subframeType == 0: // constant
+		value, err := br.readSigned(bitsPerSample)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = int32(value)
+		}
+
+	case subframeType == 1: // verbatim
+		for i := range samples {
+			value, err := br.readSigned(bitsPerSample)
+			if err != nil {
+				return nil, err
+			}
+			samples[i] = int32(value)
+		}
+
+	case subframeType >= 8 && subframeType <= 12: // fixed predictor
+		order := subframeType - 8
+		if order > blockSize {
+			return nil, fmt.Errorf("flac: predictor order %d is longer than the block", order)
+		}
+		if err := readWarmup(br, samples[:order], bitsPerSample); err != nil {
+			return nil, err
+		}
+		if err := decodeFLACResidual(br, samples, order); err != nil {
+			return nil, err
+		}
+		predict(samples, order, fixedCoefficients[order], 0)
+
+	case subframeType >= 32: // LPC
+		order := subframeType - 31
+		if order > blockSize {
+			return nil, fmt.Errorf("flac: predictor order %d is longer than the block", order)
+		}
+		if err := readWarmup(br, samples[:order], bitsPerSample); err != nil {
+			return nil, err
+		}
+		precision, _ := br.readBits(4)
+		if precision == 15 {
+			return nil, fmt.Errorf("flac: invalid LPC precision")
+		}
+		shift, err := br.readSigned(5)
+		if err != nil {
+			return nil, err
+		}
+		if shift < 0 {
+			return nil, fmt.Errorf("flac: negative LPC shift")
+		}
+		coefficients := make([]int64, order)
+		for i := range coefficients {
+			if coefficients[i], err = br.readSigned(int(precision) + 1); err != nil {
+				return nil, err
+			}
+		}
+		if err := decodeFLACResidual(br, samples, order); err != nil {
+			return nil, err
+		}
+		predict(samples, order, coefficients, int(shift))
+
+	default:
+		return nil, fmt.Errorf("flac: reserved subframe type %d", subframeType)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return samples, nil
+}
+
+// readWarmup reads the unpredicted samples a predictor starts from
+func readWarmup(br *bitReader, warmup []int32, bitsPerSample int) error {
+	for i := range warmup {
+		value, err := br.readSigned(bitsPerSample)
+		if err != nil {
+			return err
+		}
+		warmup[i] = int32(value)
+	}
+	return nil
+}
+
+// predict turns the residuals after the warm-up into samples, in place
+func predict(samples []int32, order int, coefficients []int64, shift int) {
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, coefficient := range coefficients {
+			sum += coefficient * int64(samples[i-j-1])
+		}
+		samples[i] += int32(sum >> shift)
+	}
+}
+
+// decodeFLACResidual reads the Rice-coded residuals into samples[order:]
+func decodeFLACResidual(br *bitReader, samples []int32, order int) error {
+	method, err := br.readBits(2)
+	if err != nil {
+		return err
+	}
+	paramBits, escape := 4, uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	} else if method > 1 {
+		return fmt.Errorf("flac: reserved residual coding")
+	}
+
+	partitionOrder, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	perPartition := len(samples) >> partitionOrder
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		count := perPartition
+		if p == 0 {
+			count -= order // the warm-up samples come out of the first partition
+		}
+		if count < 0 || i+count > len(samples) {
+			return fmt.Errorf("flac: bad residual partition")
+		}
+
+		param, err := br.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+		if param == escape {
+			// Unencoded partition: a 5-bit width, then plain signed numbers
+			width, err := br.readBits(5)
+			if err != nil {
+				return err
+			}
+			for end := i + count; i < end; i++ {
+				value, err := br.readSigned(int(width))
+				if err != nil {
+					return err
+				}
+				samples[i] = int32(value)
+			}
+			continue
+		}
+
+		for end := i + count; i < end; i++ {
+			quotient, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			remainder, err := br.readBits(int(param))
+			if err != nil {
+				return err
+			}
+			folded := uint64(quotient)<<param | remainder
+			samples[i] = int32(folded>>1) ^ -int32(folded&1) // zigzag back to signed
+		}
+	}
+	return nil
+}
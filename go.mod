@@ -5,8 +5,11 @@ go 1.24.4
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/redis/go-redis/v9 v9.16.0
+	go.etcd.io/bbolt v1.4.3
 )
 
+require golang.org/x/sys v0.29.0 // indirect
+
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
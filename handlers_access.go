@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// generateInviteToken is like generateJoinCode but longer, since invites are meant to be unguessable rather than typed in
+func generateInviteToken() string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to randomize bytes with error: %v", err)
+	}
+	for i := range b {
+		b[i] = charset[b[i]%byte(len(charset))]
+	}
+	return string(b)
+}
+
+/*
+checkRoundAccess decides whether a NEW person may get into the round. Invite-only rounds need an unused invite
+(the password is ignored, since the invite already identifies them); otherwise a password is needed if one is set,
+though an unused invite gets them in without it (a round run back with invites can keep its old password).
+Returns the invite to mark as used (if any) and an error message for the client when access is denied.
+*/
+func checkRoundAccess(round *Round, password string, inviteToken string) (*Invite, string) {
+	invite, exists := round.Invites[strings.TrimSpace(inviteToken)]
+	if exists && invite.UsedAt == nil {
+		return invite, ""
+	}
+	if round.InviteOnly {
+		if !exists {
+			return nil, "This round is invite-only. Ask the host for an invite link"
+		}
+		return nil, "That invite has already been used"
+	}
+
+	if round.PasswordHash != "" && !checkPassword(round.PasswordHash, password) {
+		if password == "" {
+			return nil, "This round needs a password"
+		}
+		return nil, "Wrong round password"
+	}
+
+	return nil, ""
+}
+
+// protected reports whether the round is closed to strangers: it has a password or is invite-only
+func (r *Round) protected() bool {
+	return r.PasswordHash != "" || r.InviteOnly
+}
+
+// hasMember reports whether the session belongs to someone in the round, as a participant or a spectator
+func (r *Round) hasMember(session *Session) bool {
+	if session == nil {
+		return false
+	}
+	if session.Spectator {
+		return r.Spectators[session.ParticipantID] != nil
+	}
+	return r.Participants[session.ParticipantID] != nil
+}
+
+/*
+canSeeRound is whether a session gets to look at the round (its page, its info, its files) rather than just join
+it. Open rounds are visible to anyone with the code. Protected ones are only for the people in them; anyone else,
+scripts included, joins first, which is where the password is checked (and rate limited).
+*/
+func (r *Round) canSeeRound(session *Session) bool {
+	return !r.protected() || r.hasMember(session)
+}
+
+// handleUpdateAccess sets or clears the round password and switches invite-only on or off
+func (s *Server) handleUpdateAccess(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	// Pointers so a request can change one setting without touching the other; an empty password clears it
+	var req struct {
+		Password   *string `json:"password"`
+		InviteOnly *bool   `json:"inviteOnly"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can change who can join",
+		})
+		return
+	}
+
+	if req.Password != nil {
+		if *req.Password == "" {
+			round.PasswordHash = ""
+		} else {
+			passwordHash, err := hashPassword(*req.Password)
+			if err != nil {
+				http.Error(w, "Failed to set password", http.StatusInternalServerError)
+				return
+			}
+			round.PasswordHash = passwordHash
+		}
+	}
+	if req.InviteOnly != nil {
+		round.InviteOnly = *req.InviteOnly
+	}
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Round %s access updated: password=%t inviteOnly=%t", code, round.PasswordHash != "", round.InviteOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"hasPassword": round.PasswordHash != "",
+		"inviteOnly":  round.InviteOnly,
+		"message":     "Access settings updated",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleUpdateAccess; err: %v", err)
+	}
+}
+
+// handleCreateInvite generates a new single-use invite token, optionally labelled with who it's for
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can create invites",
+		})
+		return
+	}
+
+	invite := &Invite{
+		Token:     generateInviteToken(),
+		Label:     strings.TrimSpace(req.Label),
+		CreatedAt: time.Now(),
+	}
+	if round.Invites == nil {
+		round.Invites = make(map[string]*Invite)
+	}
+	round.Invites[invite.Token] = invite
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"invite":  invite,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleCreateInvite; err: %v", err)
+	}
+}
+
+// handleListInvites shows the host every invite, outstanding ones first
+func (s *Server) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	// Tokens are as good as a seat in the round, so only the host gets to see them
+	if session.ParticipantID != round.HostID {
+		http.Error(w, "Only the host can see invites", http.StatusForbidden)
+		return
+	}
+
+	invites := make([]*Invite, 0, len(round.Invites))
+	outstanding := 0
+	for _, invite := range round.Invites {
+		invites = append(invites, invite)
+		if invite.UsedAt == nil {
+			outstanding++
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		if (invites[i].UsedAt == nil) != (invites[j].UsedAt == nil) {
+			return invites[i].UsedAt == nil
+		}
+		return invites[i].CreatedAt.Before(invites[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"invites":     invites,
+		"outstanding": outstanding,
+		"used":        len(invites) - outstanding,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleListInvites; err: %v", err)
+	}
+}
+
+// handleRevokeInvite deletes an invite that hasn't been used yet
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+	token := vars["token"]
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can revoke invites",
+		})
+		return
+	}
+
+	invite, exists := round.Invites[token]
+	if !exists || invite.UsedAt != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only unused invites can be revoked",
+		})
+		return
+	}
+	delete(round.Invites, token)
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Invite revoked",
+	})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"io"
+	"log"      // For Logging errors and info messages
+	"net/http" // For HTTP server and client funcionality
+	"os"       // For OS interface
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Letters, numbers, underscores and dashes only; keeps usernames URL and display safe
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]{3,30}$`)
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if !validUsername.MatchString(req.Username) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Username must be 3-30 letters, numbers, underscores or dashes",
+		})
+		return
+	}
+	if len(req.Password) < 8 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Password must be at least 8 characters",
+		})
+		return
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+
+	user := &User{
+		ID:           uuid.New().String(),
+		Username:     req.Username,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now(),
+	}
+
+	// SetNX only sets the key if it doesn't exist yet, so two people can't race for the same username
+	claimed, err := s.db.SetNX(ctx, usernameKey(req.Username), user.ID, 0).Result()
+	if err != nil {
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "That username is taken",
+		})
+		return
+	}
+
+	// A TTL of 0 means no expiration; accounts are the one thing that should stick around
+	userData, _ := json.Marshal(user)
+	if err := s.db.Set(ctx, userKey(user.ID), userData, 0).Err(); err != nil {
+		s.db.Del(ctx, usernameKey(req.Username)) // Give the username back
+		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.startAccountSession(w, user); err != nil {
+		log.Printf("Failed to create account session: %v", err)
+	}
+
+	log.Printf("Account registered: %s (%s)", user.Username, user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"username": user.Username,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleRegister; err: %v", err)
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Guesses at one account are limited wherever they come from, on top of the per-IP limit on the route
+	username := strings.ToLower(strings.TrimSpace(req.Username))
+	limit := s.cfg.RateLimits.Account
+	if allowed, retryAfter, err := s.take(limit, rateLimitKey(limit.Name, "username", username)); err != nil {
+		log.Printf("Rate limiter unavailable, allowing login: %v", err)
+	} else if !allowed {
+		tooManyRequests(w, r, limit, retryAfter)
+		return
+	}
+
+	// Same message for unknown user and wrong password so the form can't be used to discover usernames
+	var user *User
+	userID, err := s.db.Get(ctx, usernameKey(username)).Result()
+	if err == nil {
+		user = s.getUser(userID)
+	} else if err != redis.Nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	if user == nil || !checkPassword(user.PasswordHash, req.Password) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid username or password",
+		})
+		return
+	}
+
+	if err := s.startAccountSession(w, user); err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"username": user.Username,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleLogin; err: %v", err)
+	}
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("account"); err == nil {
+		s.db.Del(ctx, accountSessionKey(cookie.Value))
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "account",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1, // Delete cookie
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.cfg.secureCookies(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handleAccountInfo returns the logged-in user along with every round they hosted or joined, newest first
+func (s *Server) handleAccountInfo(w http.ResponseWriter, r *http.Request) {
+	user := s.getAccount(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	historyData, err := s.db.HGetAll(ctx, userHistoryKey(user.ID)).Result()
+	if err != nil {
+		http.Error(w, "Failed to get round history", http.StatusInternalServerError)
+		return
+	}
+
+	history := make([]*RoundHistoryEntry, 0, len(historyData))
+	for _, entryData := range historyData {
+		var entry RoundHistoryEntry
+		if err := json.Unmarshal([]byte(entryData), &entry); err != nil {
+			log.Printf("Skipping unreadable history entry for user %s: %v", user.ID, err)
+			continue
+		}
+		history = append(history, &entry)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].JoinedAt.After(history[j].JoinedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        user.ID,
+		"username":  user.Username,
+		"createdAt": user.CreatedAt,
+		"history":   history,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleAccountInfo; err: %v", err)
+	}
+}
+
+// handleAccountDownload serves one of the user's own past submissions out of their library
+func (s *Server) handleAccountDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roundID := vars["roundId"]
+	requestedFilename := vars["filename"]
+
+	user := s.getAccount(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Only serve files the history says belong to this user; this also keeps "../" style names out of the path
+	entry := s.getHistoryEntry(user.ID, roundID)
+	if entry == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	var match *HistorySubmission
+	for _, submission := range entry.Submissions {
+		if submission.Filename == requestedFilename {
+			match = submission
+			break
+		}
+	}
+	if match == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	filePath := filepath.Join(s.libraryDir(user.ID), roundID, match.Filename)
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Printf("Failed to open library file %s: %v", filePath, err)
+		http.Error(w, "File not found on server", http.StatusNotFound)
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close file in handleAccountDownload; error: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", match.OriginalName))
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Failed to send library file: %v", err)
+	}
+}
+
+// startAccountSession stores a new account session in Redis and hands the browser the cookie for it
+func (s *Server) startAccountSession(w http.ResponseWriter, user *User) error {
+	token := uuid.New().String()
+	accountSession := &AccountSession{
+		Token:     token,
+		UserID:    user.ID,
+		CreatedAt: time.Now(),
+	}
+
+	sessionData, _ := json.Marshal(accountSession)
+	if err := s.db.Set(ctx, accountSessionKey(token), sessionData, s.cfg.AccountSessionTTL.Duration).Err(); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "account",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.cfg.AccountSessionTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.cfg.secureCookies(),
+	})
+	return nil
+}
@@ -18,10 +18,19 @@ import (
 func (s *Server) handleCreateRound(w http.ResponseWriter, r *http.Request) {
 	// Anonymous/lambda struct
 	var req struct {
-		Name               string    `json:"name"`
-		Mode               RoundMode `json:"mode"`
-		HostName           string    `json:"hostName"`
-		AllowGuestDownload bool      `json:"allowGuestDownload"`
+		Name                      string    `json:"name"`
+		Mode                      RoundMode `json:"mode"`
+		HostName                  string    `json:"hostName"`
+		AllowGuestDownload        bool      `json:"allowGuestDownload"`
+		Password                  string    `json:"password"` // optional
+		InviteOnly                bool      `json:"inviteOnly"`
+		LifetimeHours             int       `json:"lifetimeHours"`    // optional; 0 means the server default
+		LeagueCode                string    `json:"leagueCode"`       // optional; see league.go
+		TimeLimitMinutes          int       `json:"timeLimitMinutes"` // sprint mode only; 0 means an hour
+		GraceMinutes              int       `json:"graceMinutes"`     // sprint mode only
+		Constraints               []string  `json:"constraints"`      // optional constraint roulette pool; see roulette.go
+		ConstraintsPerParticipant bool      `json:"constraintsPerParticipant"`
+		NormalizeListening        bool      `json:"normalizeListening"` // level-matched playback; see loudness.go
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -29,42 +38,154 @@ func (s *Server) handleCreateRound(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	settings := RoundSettings{
+		Name:                      req.Name,
+		Mode:                      req.Mode,
+		AllowGuestDownload:        req.AllowGuestDownload,
+		InviteOnly:                req.InviteOnly,
+		LifetimeHours:             req.LifetimeHours,
+		LeagueCode:                strings.ToUpper(strings.TrimSpace(req.LeagueCode)),
+		TimeLimitMinutes:          req.TimeLimitMinutes,
+		GraceMinutes:              req.GraceMinutes,
+		ConstraintsPerParticipant: req.ConstraintsPerParticipant,
+		NormalizeListening:        req.NormalizeListening,
+	}
+	constraints, errMsg := checkConstraintPool(req.Constraints)
+	if errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return
+	}
+	settings.Constraints = constraints
+	if req.Password != "" {
+		passwordHash, err := hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, "Failed to create round", http.StatusInternalServerError)
+			return
+		}
+		settings.PasswordHash = passwordHash
+	}
+
+	round := s.startRound(w, r, settings, req.HostName)
+	if round == nil {
+		return
+	}
+
+	// Return Response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"code":     round.JoinCode,
+		"roundId":  round.ID,
+		"hostName": req.HostName,
+	}); err != nil {
+		log.Printf("Failed to encode return json response for round creation handler; err: %v", err)
+	}
+}
+
+/*
+startRound creates a new round from the given settings with the requester as its host: it picks a free join code,
+saves the round, gives the host a session (cookie included) and makes the upload folder. Creating from scratch,
+from a template, and cloning a finished round all end up here (see handlers_templates.go).
+
+Returns nil when something went wrong, in which case the error response has already been written.
+*/
+func (s *Server) startRound(w http.ResponseWriter, r *http.Request, settings RoundSettings, hostName string) *Round {
+	lifetime, err := s.parseLifetimeHours(settings.LifetimeHours)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid round length: " + err.Error(),
+		})
+		return nil
+	}
+
+	if errMsg := checkSprintSettings(&settings); errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return nil
+	}
+
 	var joinCode string
 	for {
 		joinCode = generateJoinCode()
 		exists, _ := s.db.Exists(ctx, roundKey(joinCode)).Result() // another command and result
-		if exists == 0 {
+		// Archived rounds keep their code forever so old links keep pointing at the right round
+		if exists == 0 && !s.archive.has(joinCode) {
 			break
 		}
 	}
 
+	// Accounts are optional; guests just get an empty UserID
+	account := s.getAccount(r)
+
+	// League rounds need an account the league knows, otherwise anyone could add rounds to someone else's season
+	if settings.LeagueCode != "" {
+		league, err := s.getLeague(settings.LeagueCode)
+		if err != nil {
+			http.Error(w, "Failed to get league", http.StatusInternalServerError)
+			return nil
+		}
+		if league == nil || !league.canHost(account) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "You can't add rounds to that league",
+			})
+			return nil
+		}
+	}
+
 	hostID := uuid.New().String() // just a fun sidenote, UUIDs are like a standard of ID generation (defined by RFC)
 	host := &Participant{         // sidenote: This is Go's distinctive type of initialization features.
 		ID:          hostID,
-		DisplayName: req.HostName,
+		DisplayName: hostName,
+		Role:        RoleHost,
 		IsHost:      true,
 		JoinedAt:    time.Now(),
 	}
+	if account != nil {
+		host.UserID = account.ID
+	}
 
 	// Creating the actual round
 	round := &Round{
 		ID:                 uuid.New().String(),
-		Name:               req.Name,
-		Mode:               req.Mode,
+		Name:               settings.Name,
+		Mode:               settings.Mode,
 		JoinCode:           joinCode,
 		State:              StateWaiting,
 		HostID:             hostID,
 		Participants:       map[string]*Participant{hostID: host},
 		Submissions:        make(map[string]*Submission),
-		AllowGuestDownload: req.AllowGuestDownload,
+		AllowGuestDownload: settings.AllowGuestDownload,
 		CreatedAt:          time.Now(),
+		InviteOnly:         settings.InviteOnly,
+		SpectatorsCanVote:  settings.SpectatorsCanVote,
+		NormalizeListening: settings.NormalizeListening,
+		PasswordHash:       settings.PasswordHash,
+		ExpiresAt:          time.Now().Add(lifetime),
+		LeagueCode:         settings.LeagueCode,
+		TimeLimitMinutes:   settings.TimeLimitMinutes,
+		GraceMinutes:       settings.GraceMinutes,
+		Roulette:           newRoulette(settings),
 	}
 
-	// Storing the round in Redis with a 24-hour expiration timer
-	roundData, _ := json.Marshal(round) // Gives back that json byte encoded representation
-	if err := s.db.Set(ctx, roundKey(joinCode), roundData, 24*time.Hour).Err(); err != nil {
+	// Storing the round in Redis; it expires at ExpiresAt (see lifetime.go)
+	if err := s.saveRound(round); err != nil {
 		http.Error(w, "Failed to create round", http.StatusInternalServerError)
-		return
+		return nil
+	}
+
+	if account != nil {
+		s.recordRoundHistory(account.ID, round, true)
 	}
 
 	// Create session
@@ -76,37 +197,23 @@ func (s *Server) handleCreateRound(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:     time.Now(),
 	}
 
-	sessionData, _ := json.Marshal(session)
-	if err := s.db.Set(ctx, sessionKey(sessionToken), sessionData, 24*time.Hour).Err(); err != nil {
+	// The session lives exactly as long as the round (see lifetime.go)
+	if err := s.saveSession(session, round); err != nil {
 		log.Printf("Failed to create session: %v", err)
 	}
+	s.trackSession(round, hostID, sessionToken)
+	s.recordFingerprints(round, hostID, clientFingerprints(r, s.ensureDevice(w, r)))
 
 	// Create upload directory for this round
-	if err := os.MkdirAll(filepath.Join("temp/uploads", round.ID), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(s.cfg.UploadDir, round.ID), 0755); err != nil {
 		// Shouldn't happen because we have this folder already created, but error checks are good
-		log.Printf("Failed to create upload directory for temp/uploads with err: %v", err)
+		log.Printf("Failed to create upload directory for round with err: %v", err)
 	}
 
 	// Setting session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sessionToken,
-		Path:     "/",
-		MaxAge:   86400,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	s.setSessionCookie(w, sessionToken, round)
 
-	// Return Response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":  true,
-		"code":     joinCode,
-		"roundId":  round.ID,
-		"hostName": req.HostName,
-	}); err != nil {
-		log.Printf("Failed to encode return json response for round creation handler; err: %v", err)
-	}
+	return round
 }
 
 func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
@@ -114,6 +221,8 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 	var req struct { // Anonymous class for request
 		Code        string `json:"code"`
 		DisplayName string `json:"displayName"`
+		Password    string `json:"password"` // only needed for password protected rounds
+		Invite      string `json:"invite"`   // only needed for invite-only rounds
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -168,8 +277,22 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Banned devices get the same answer whether or not the lobby is open
+	fingerprints := clientFingerprints(r, s.ensureDevice(w, r))
+	if s.isBanned(req.Code, fingerprints) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You have been banned from this round",
+		}); err != nil {
+			log.Printf("Failed to encode json for banned participant; err: %v", err)
+		}
+		return
+	}
+
 	// Check if user already has a session for this round
 	existingSession := s.getSession(r)
+	account := s.getAccount(r)
 	var participantID string
 	if existingSession != nil && existingSession.RoundCode == req.Code {
 		// User is already in this round
@@ -182,14 +305,57 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 			participant.DisplayName = req.DisplayName
 		}
 	} else {
+		// Once a tournament's bracket is drawn nobody new can get a place in it; they can still spectate
+		if round.Bracket != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "The bracket for this tournament is already set. You can still watch",
+			}); err != nil {
+				log.Printf("Failed to encode json for drawn bracket; err: %v", err)
+			}
+			return
+		}
+
+		// A locked lobby still lets existing participants back in (above), just nobody new
+		if round.Locked {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "The host has locked this lobby",
+			}); err != nil {
+				log.Printf("Failed to encode json for locked lobby; err: %v", err)
+			}
+			return
+		}
+
+		// New people need the password or an invite if the host set one up
+		invite, accessError := checkRoundAccess(&round, req.Password, req.Invite)
+		if accessError != "" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":       false,
+				"error":         accessError,
+				"needsPassword": round.PasswordHash != "" && !round.InviteOnly,
+				"needsInvite":   round.InviteOnly,
+			}); err != nil {
+				log.Printf("Failed to encode json for round access check; err: %v", err)
+			}
+			return
+		}
+
 		// Create a new participant since the session doesn't exists and they don't exist for their own session or the round code is different
 		participantID = uuid.New().String()
 		participant := &Participant{
 			ID:          participantID,
 			DisplayName: req.DisplayName,
+			Role:        RoleParticipant,
 			IsHost:      false,
 			JoinedAt:    time.Now(),
 		}
+		if account != nil {
+			participant.UserID = account.ID
+		}
 
 		// Initialize map if nil (shouldn't happen but safety first)
 		if round.Participants == nil {
@@ -198,15 +364,29 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 
 		// Add the participant to the round
 		round.Participants[participantID] = participant
+
+		// Joining a roulette round after the deal still gets you a rule
+		round.dealConstraintTo(participant)
+
+		// Burn the invite so it can't be passed along
+		if invite != nil {
+			usedAt := time.Now()
+			invite.UsedAt = &usedAt
+			invite.UsedByID = participantID
+			invite.UsedByName = req.DisplayName
+		}
 	}
 
 	// Save updated round back to Redis
-	updatedRoundData, _ := json.Marshal(round)
-	if err := s.db.Set(ctx, roundKey(req.Code), updatedRoundData, 24*time.Hour).Err(); err != nil {
+	if err := s.saveRound(&round); err != nil {
 		http.Error(w, "Failed to update round", http.StatusInternalServerError)
 		return
 	}
 
+	if account != nil {
+		s.recordRoundHistory(account.ID, &round, false)
+	}
+
 	// Create or update session with new session data
 	sessionToken := uuid.New().String()
 	session := &Session{
@@ -216,24 +396,15 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:     time.Now(),
 	}
 
-	sessionData, _ := json.Marshal(session)
-	if err := s.db.Set(ctx, sessionKey(sessionToken), sessionData, 24*time.Hour).Err(); err != nil {
+	// The session lives exactly as long as the round (see lifetime.go)
+	if err := s.saveSession(session, &round); err != nil {
 		log.Printf("Failed to create session: %v", err)
 	}
+	s.trackSession(&round, participantID, sessionToken)
+	s.recordFingerprints(&round, participantID, fingerprints)
 
 	// Set session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sessionToken,
-		Path:     "/",
-		MaxAge:   86400, // 24 hours in seconds (writing this again)
-		HttpOnly: true,  // Can't be accessed by JavaScript (security)
-
-		// This is to prevent CSRF (cross-site request forgery) attacks.
-		// Limits cookies to be delivered by links clicked on other websites and also by refreshing
-		// Usually there's also a "Secure:" flag too, but now there's not because it's usually when SameSite=None
-		SameSite: http.SameSiteLaxMode,
-	})
+	s.setSessionCookie(w, sessionToken, &round)
 
 	// Return success response; parts like this are for the frontend
 	w.Header().Set("Content-Type", "application/json")
@@ -249,6 +420,139 @@ func (s *Server) handleJoinRound(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+handleSpectateRound is the join path for people who only want to follow along. Spectators get a session like
+everyone else, but they're kept in Round.Spectators, so they never show up in the participant list, can't upload,
+and only vote if the host allows it. Unlike joining, you can start spectating at any point in the round.
+*/
+func (s *Server) handleSpectateRound(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code        string `json:"code"`
+		DisplayName string `json:"displayName"`
+		Password    string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid Request", http.StatusBadRequest)
+		return
+	}
+
+	req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+	if req.Code == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Code is required",
+		})
+		return
+	}
+	if strings.TrimSpace(req.DisplayName) == "" {
+		req.DisplayName = "Spectator" // A name is optional for spectators since nobody sees the list
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(req.Code)).Result()
+	if err == redis.Nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid join code",
+		})
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	fingerprints := clientFingerprints(r, s.ensureDevice(w, r))
+	if s.isBanned(req.Code, fingerprints) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You have been banned from this round",
+		})
+		return
+	}
+
+	// Private rounds stay private: spectators need the password, and invites are only for people who'll take part
+	if round.InviteOnly {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "This round is invite-only and can't be spectated",
+		})
+		return
+	}
+	if _, accessError := checkRoundAccess(&round, req.Password, ""); accessError != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       false,
+			"error":         accessError,
+			"needsPassword": true,
+		})
+		return
+	}
+
+	// Reuse the spectator entry if this browser is already following the round
+	existingSession := s.getSession(r)
+	var spectatorID string
+	if existingSession != nil && existingSession.Spectator && existingSession.RoundCode == req.Code {
+		spectatorID = existingSession.ParticipantID
+	} else {
+		spectatorID = uuid.New().String()
+	}
+
+	if round.Spectators == nil {
+		round.Spectators = make(map[string]*Participant)
+	}
+	round.Spectators[spectatorID] = &Participant{
+		ID:          spectatorID,
+		DisplayName: req.DisplayName,
+		Role:        RoleSpectator,
+		JoinedAt:    time.Now(),
+	}
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	sessionToken := uuid.New().String()
+	session := &Session{
+		Token:         sessionToken,
+		ParticipantID: spectatorID,
+		RoundCode:     req.Code,
+		CreatedAt:     time.Now(),
+		Spectator:     true,
+	}
+
+	// The session lives exactly as long as the round (see lifetime.go)
+	if err := s.saveSession(session, &round); err != nil {
+		log.Printf("Failed to create session: %v", err)
+	}
+	s.trackSession(&round, spectatorID, sessionToken)
+	s.recordFingerprints(&round, spectatorID, fingerprints)
+
+	s.setSessionCookie(w, sessionToken, &round)
+
+	log.Printf("Spectator %s is following round %s", req.DisplayName, req.Code)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"code":      req.Code,
+		"roundId":   round.ID,
+		"spectator": true,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleSpectateRound; err: %v", err)
+	}
+}
+
 func (s *Server) handleUpdateState(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	code := vars["code"]
@@ -264,7 +568,7 @@ func (s *Server) handleUpdateState(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate the state transition
-	if req.State != StateWaiting && req.State != StateActive && req.State != StateClosed {
+	if req.State != StateWaiting && req.State != StateActive && req.State != StateVoting && req.State != StateClosed {
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -297,44 +601,264 @@ func (s *Server) handleUpdateState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user is the host
-	if session.ParticipantID != round.HostID {
+	// Check if user is the host (or a co-host)
+	if !round.canManage(session.ParticipantID) {
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Only the host can change the round state",
+			"error":   "Only the host or a co-host can change the round state",
 		}); err != nil {
 			log.Printf("Failed to encode json for checking if user is host; err: %v", err)
 		}
 		return
 	}
 
+	// Tournaments seed their bracket when the first stage starts and move on to the next stage when one closes
+	if round.Mode == ModeTournament {
+		errMsg, err := s.tournamentStateChange(&round, req.State)
+		if err != nil {
+			log.Printf("Failed to advance tournament round %s: %v", code, err)
+			http.Error(w, "Failed to start the next stage", http.StatusInternalServerError)
+			return
+		}
+		if errMsg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   errMsg,
+			})
+			return
+		}
+	}
+
+	// Sprints start the clock (and reveal the sample) the first time they go active
+	if round.Mode == ModeSprint {
+		if errMsg := sprintStateChange(&round, req.State); errMsg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   errMsg,
+			})
+			return
+		}
+	}
+
+	// Constraint roulette deals its rules the first time the round starts
+	if req.State == StateActive {
+		round.dealConstraints()
+	}
+
 	// Updating the state
 	oldState := round.State
 	round.State = req.State
 
 	// Saving new updated round back to Redis
-	updatedRoundData, _ := json.Marshal(round)
-	if err := s.db.Set(ctx, roundKey(code), updatedRoundData, 24*time.Hour).Err(); err != nil {
+	if err := s.saveRound(&round); err != nil {
 		http.Error(w, "Failed to update round", http.StatusInternalServerError)
 		return
 	}
 
 	// Printing state change to log
-	log.Printf("Round %s state changed from %s to %s by host %s", code, oldState, req.State, session.ParticipantID)
+	log.Printf("Round %s state changed from %s to %s by %s", code, oldState, req.State, session.ParticipantID)
+
+	// Closing snapshots the round into the archive so results and files survive the round expiring (see archive.go)
+	if req.State == StateClosed {
+		s.archiveInBackground(round)
+		if round.LeagueCode != "" {
+			s.recordLeagueRound(&round)
+		}
+	}
 
 	// Returning success response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"success":  true,
 		"oldState": oldState,
 		"newState": req.State,
 		"message":  fmt.Sprintf("Round state updated to %s", req.State),
-	}); err != nil {
+	}
+	if round.Bracket != nil && round.Bracket.NextCode != "" {
+		response["nextCode"] = round.Bracket.NextCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Failed to encode json for returning success response for handleUpdateState; err: %v", err)
 	}
 }
 
+// handleUpdateSettings changes round settings that can be flipped at any point; fields left out of the request stay as they are
+func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	// Pointers so we can tell "not sent" apart from "false"
+	var req struct {
+		SpectatorsCanVote *bool `json:"spectatorsCanVote"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can change round settings",
+		})
+		return
+	}
+
+	if req.SpectatorsCanVote != nil {
+		round.SpectatorsCanVote = *req.SpectatorsCanVote
+
+		// Turning it off takes back any spectator votes already cast
+		if !round.SpectatorsCanVote {
+			for voterID := range round.Votes {
+				if _, isSpectator := round.Spectators[voterID]; isSpectator {
+					delete(round.Votes, voterID)
+				}
+			}
+		}
+	}
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":           true,
+		"spectatorsCanVote": round.SpectatorsCanVote,
+		"message":           "Settings updated",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleUpdateSettings; err: %v", err)
+	}
+}
+
+/*
+handleExtendRound pushes the round's expiry back by the requested number of hours. The round can't end more than
+MaxRoundLifetime (from the config) after it was created, however many times it's extended, so a round can be kept
+going but not parked forever.
+*/
+func (s *Server) handleExtendRound(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Hours int `json:"hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can extend the round",
+		})
+		return
+	}
+
+	extension, err := s.parseLifetimeHours(req.Hours)
+	if err != nil || req.Hours == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Pick how long to extend the round by",
+		})
+		return
+	}
+
+	// Old rounds without an ExpiresAt have been living on the default TTL, counted from their last save
+	if round.ExpiresAt.IsZero() {
+		round.ExpiresAt = time.Now().Add(s.cfg.RoundTTL.Duration)
+	}
+
+	created := round.CreatedAt
+	if created.IsZero() {
+		created = time.Now()
+	}
+	latest := created.Add(s.cfg.MaxRoundLifetime.Duration)
+	if !round.ExpiresAt.Before(latest.Add(-time.Minute)) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "This round is already set to last as long as it can",
+		})
+		return
+	}
+
+	round.ExpiresAt = round.ExpiresAt.Add(extension)
+	if round.ExpiresAt.After(latest) {
+		round.ExpiresAt = latest
+	}
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+	s.syncRoundExpiry(&round)
+
+	// The host's own cookie can be refreshed right away; everyone else's is on their next page load
+	s.setSessionCookie(w, session.Token, &round)
+
+	log.Printf("Round %s extended until %s", code, round.ExpiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"expiresAt": round.ExpiresAt,
+		"message":   "Round extended",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleExtendRound; err: %v", err)
+	}
+}
+
 func (s *Server) handleRoundInfo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	code := vars["code"]
@@ -351,9 +875,22 @@ func (s *Server) handleRoundInfo(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to unmarshal roundData in handleUpdateState; err: %v", err)
 	}
 
-	// Returning as JSON
+	// A round with a password or invites is only for the people in it (see canSeeRound)
+	session := s.getSession(r)
+	if !round.canSeeRound(session) {
+		http.Error(w, "Join this round to see it", http.StatusForbidden)
+		return
+	}
+
+	// Sample usage scores and duplicate warnings are for the hosts to judge with, not for calling each other out
+	info := round.info()
+	if session == nil || !round.canManage(session.ParticipantID) {
+		info.hideHostChecks()
+	}
+
+	// Returning as JSON; info() swaps the private ballot for counts (and results once closed)
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(round); err != nil {
+	if err := json.NewEncoder(w).Encode(info); err != nil {
 		log.Printf("Failed to encode json for handleUpdateState; err: %v", err)
 	}
 }
@@ -383,6 +920,27 @@ func (s *Server) handleLeaveRound(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Spectators just stop following; nothing else in the round changes
+	if session.Spectator {
+		delete(round.Spectators, session.ParticipantID)
+		delete(round.Votes, session.ParticipantID)
+
+		if err := s.saveRound(&round); err != nil {
+			http.Error(w, "Failed to update round", http.StatusInternalServerError)
+			return
+		}
+		s.db.Del(ctx, sessionKey(session.Token))
+
+		s.clearSessionCookie(w)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "You stopped spectating this round",
+		})
+		return
+	}
+
 	// Check if user is a participant
 	participant, exists := round.Participants[session.ParticipantID]
 	if !exists {
@@ -400,27 +958,35 @@ func (s *Server) handleLeaveRound(w http.ResponseWriter, r *http.Request) {
 	// Remove participant from the round
 	delete(round.Participants, session.ParticipantID)
 
-	// Also remove their submission if they had one
+	// Also remove their submission if they had one, and any vote they cast.
+	// A build-up layer someone else has built on stays in the track (see layers.go)
 	if round.Submissions != nil {
 		delete(round.Submissions, session.ParticipantID)
+		round.forgetDuplicatesOf(session.ParticipantID)
 	}
+	round.dropLayer(session.ParticipantID)
+	delete(round.Votes, session.ParticipantID)
 
 	// If the leaving participant was the host, assign a new host
 	var newHostName string
 	if wasHost && len(round.Participants) > 0 {
-		// Find the participant who joined earliest to make them host
+		// Co-hosts get first dibs; otherwise the participant who joined earliest becomes host
 		var earliestJoin time.Time
 		var newHostID string
+		var newHostIsCoHost bool
 
 		for id, p := range round.Participants {
-			if newHostID == "" || p.JoinedAt.Before(earliestJoin) {
+			isCoHost := p.role() == RoleCoHost
+			if newHostID == "" || (isCoHost && !newHostIsCoHost) ||
+				(isCoHost == newHostIsCoHost && p.JoinedAt.Before(earliestJoin)) {
 				earliestJoin = p.JoinedAt
 				newHostID = id
+				newHostIsCoHost = isCoHost
 			}
 		}
 
 		if newHostID != "" {
-			round.Participants[newHostID].IsHost = true
+			round.Participants[newHostID].setRole(RoleHost)
 			round.HostID = newHostID
 			newHostName = round.Participants[newHostID].DisplayName
 			log.Printf("Host transferred from %s to %s in round %s",
@@ -432,8 +998,7 @@ func (s *Server) handleLeaveRound(w http.ResponseWriter, r *http.Request) {
 	// It will expire naturally via Redis TTL
 
 	// Save updated round to Redis
-	updatedRoundData, _ := json.Marshal(round)
-	if err := s.db.Set(ctx, roundKey(code), updatedRoundData, 24*time.Hour).Err(); err != nil {
+	if err := s.saveRound(&round); err != nil {
 		http.Error(w, "Failed to update round", http.StatusInternalServerError)
 		return
 	}
@@ -442,14 +1007,7 @@ func (s *Server) handleLeaveRound(w http.ResponseWriter, r *http.Request) {
 	s.db.Del(ctx, sessionKey(session.Token))
 
 	// Clear the session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1, // Delete cookie
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	s.clearSessionCookie(w)
 
 	log.Printf("Participant %s left round %s", leavingParticipantName, code)
 
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+	"path/filepath"
+	"sort"
+)
+
+/*
+Archived rounds are read-only, and by the time anyone's looking at one their round session is long gone, so
+permissions go by account instead: a participant who was logged into an account while in the round is recognised
+through Participant.UserID. Guests who never had an account get what the round allowed everyone, and nothing at all
+if the round had a password or was invite-only: archiving it shouldn't make it public.
+*/
+
+// archivedParticipant finds the participant the logged-in account was in this round, if any
+func (a *ArchivedRound) archivedParticipant(account *User) *Participant {
+	if account == nil {
+		return nil
+	}
+	for _, participant := range a.Round.Participants {
+		if participant.UserID == account.ID {
+			return participant
+		}
+	}
+	return nil
+}
+
+// protected is a round that had a password or was invite-only; its archive is only for the people who played in it
+func (a *ArchivedRound) protected() bool {
+	return a.Round.PasswordHash != "" || a.Round.InviteOnly
+}
+
+// canView is whether the account can see the archived round at all
+func (a *ArchivedRound) canView(account *User) bool {
+	return !a.protected() || a.archivedParticipant(account) != nil
+}
+
+// canDownloadEntries mirrors the live rules: files (the sample too) need a seat in the round, or AllowGuestDownload
+// on a round that wasn't protected
+func (a *ArchivedRound) canDownloadEntries(account *User) bool {
+	if a.archivedParticipant(account) != nil {
+		return true
+	}
+	return a.Round.AllowGuestDownload && !a.protected()
+}
+
+// canExport mirrors handleExport: the host always, other participants only when guest downloads were allowed
+func (a *ArchivedRound) canExport(account *User) bool {
+	participant := a.archivedParticipant(account)
+	if participant == nil {
+		return false
+	}
+	return participant.ID == a.Round.HostID || a.Round.AllowGuestDownload
+}
+
+// canClone is for "run it back" from the archive: only the host's account
+func (a *ArchivedRound) canClone(account *User) bool {
+	participant := a.archivedParticipant(account)
+	return participant != nil && participant.ID == a.Round.HostID
+}
+
+/*
+lookupArchive loads an archived round the account is allowed to see, writing the error response itself when there
+isn't one. A protected round looks the same as a missing one to outsiders.
+*/
+func (s *Server) lookupArchive(w http.ResponseWriter, code string, account *User) *ArchivedRound {
+	archived, err := s.archive.get(code)
+	if err != nil {
+		log.Printf("Failed to read archived round %s: %v", code, err)
+		http.Error(w, "Failed to get archived round", http.StatusInternalServerError)
+		return nil
+	}
+	if archived == nil || !archived.canView(account) {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return nil
+	}
+	return archived
+}
+
+// handleArchivedRoundView renders the read-only page; handleRoundView hands over to it once the live round is gone
+func (s *Server) handleArchivedRoundView(w http.ResponseWriter, r *http.Request, archived *ArchivedRound) {
+	account := s.getAccount(r)
+
+	type entry struct {
+		DisplayName  string
+		OriginalName string
+		Filename     string
+		Analysis     *AudioAnalysis
+	}
+	entries := make([]entry, 0, len(archived.Round.Submissions))
+	for participantID, submission := range archived.Round.Submissions {
+		owner, exists := archived.Round.Participants[participantID]
+		if !exists {
+			continue
+		}
+		entries = append(entries, entry{
+			DisplayName:  owner.DisplayName,
+			OriginalName: submission.OriginalName,
+			Filename:     submission.Filename,
+			Analysis:     submission.Analysis,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DisplayName < entries[j].DisplayName
+	})
+
+	participants := make([]*Participant, 0, len(archived.Round.Participants))
+	for _, participant := range archived.Round.Participants {
+		participants = append(participants, participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+
+	data := map[string]interface{}{
+		"Code":         archived.Round.JoinCode,
+		"Archived":     archived,
+		"Participants": participants,
+		"Entries":      entries,
+		"CanDownload":  archived.canDownloadEntries(account),
+		"CanExport":    archived.canExport(account),
+		"CanClone":     archived.canClone(account),
+		"League":       s.pageLeague(archived.Round.LeagueCode),
+		"Bracket":      archived.Round.Bracket.view(),
+		"Layers":       layersForPage(&archived.Round),
+		"Me":           archived.archivedParticipant(account),
+		"LoggedIn":     account != nil,
+		"HasSample":    archived.Blobs[archived.Round.SampleFileID] != "",
+		"CSRFToken":    s.ensureCSRFToken(w, r),
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "archive.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+	}
+}
+
+// handleArchiveInfo is the JSON version of the archived round
+func (s *Server) handleArchiveInfo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	account := s.getAccount(r)
+	archived := s.lookupArchive(w, vars["code"], account)
+	if archived == nil {
+		return
+	}
+
+	// The same view of the round as the live info API: no ballots, password, invites or roulette pool, and the
+	// sample and duplicate checks only for the hosts
+	info := archived.Round.info()
+	if me := archived.archivedParticipant(account); me == nil || !archived.Round.canManage(me.ID) {
+		info.hideHostChecks()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"round":      info,
+		"results":    archived.Results,
+		"archivedAt": archived.ArchivedAt,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleArchiveInfo; err: %v", err)
+	}
+}
+
+// handleArchiveDownload serves one archived file; "sample" works as a filename just like on the live round
+func (s *Server) handleArchiveDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requestedFilename := vars["filename"]
+
+	account := s.getAccount(r)
+	archived := s.lookupArchive(w, vars["code"], account)
+	if archived == nil {
+		return
+	}
+	round := &archived.Round
+	if !archived.canDownloadEntries(account) {
+		http.Error(w, "Log in with the account you used in this round to download files", http.StatusForbidden)
+		return
+	}
+
+	var fileToServe, originalName string
+	if requestedFilename == "sample" || (round.SampleFileID != "" && requestedFilename == round.SampleFileID) {
+		fileToServe = round.SampleFileID
+		originalName = "sample" + filepath.Ext(round.SampleFileID)
+	} else {
+		for _, submission := range round.Submissions {
+			if submission.Filename == requestedFilename {
+				fileToServe = submission.Filename
+				originalName = submission.OriginalName
+				break
+			}
+		}
+		// Build-up layers whose owner left aren't submissions any more, but they're still part of the track
+		for _, layer := range round.Layers {
+			if fileToServe == "" && layer.Filename == requestedFilename {
+				fileToServe = layer.Filename
+				originalName = layer.OriginalName
+			}
+		}
+	}
+
+	key := archived.Blobs[fileToServe]
+	if fileToServe == "" || key == "" {
+		http.Error(w, "File not found in the archive", http.StatusNotFound)
+		return
+	}
+
+	written, err := serveAudioFile(w, s.archive.blobs.path(key), originalName)
+	if err != nil {
+		return
+	}
+	log.Printf("Archived file downloaded: %s from round %s (%d bytes)", fileToServe, round.JoinCode, written)
+}
+
+// handleArchiveExport packs up the archived files, same layout and options as the live export
+func (s *Server) handleArchiveExport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	account := s.getAccount(r)
+	archived := s.lookupArchive(w, vars["code"], account)
+	if archived == nil {
+		return
+	}
+
+	options, err := parseExportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// As live: anyone who played can export their own files
+	participant := archived.archivedParticipant(account)
+	if !archived.canExport(account) && !(options.Scope == scopeMine && participant != nil) {
+		http.Error(w, "You don't have permission to export files", http.StatusForbidden)
+		return
+	}
+
+	participantID := ""
+	if participant != nil {
+		participantID = participant.ID
+	}
+	files, err := scopedExportFiles(&archived.Round, options.Scope, participantID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if len(archived.Blobs) == 0 || len(files) == 0 {
+		http.Error(w, "No files to export", http.StatusNotFound)
+		return
+	}
+
+	count, err := sendExport(w, &archived.Round, files, options, func(filename string) string {
+		key := archived.Blobs[filename]
+		if key == "" {
+			return "" // wasn't archived; addFileToZip fails on it and the rest still go in
+		}
+		return s.archive.blobs.path(key)
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("Exported %d archived files for round %s", count, archived.Round.JoinCode)
+}
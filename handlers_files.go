@@ -3,7 +3,10 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux" // Router for advanced URL Routing
 	"io"
@@ -14,11 +17,155 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
+// uploadRefused is why an entry can't go into the round, as shown to the player
+type uploadRefused string
+
+func (e uploadRefused) Error() string { return string(e) }
+
+/*
+uploadProblem is why the participant can't upload an entry right now, or "" if they can; late is whether a sprint's
+cutoff has passed but the upload still counts.
+*/
+func (r *Round) uploadProblem(participantID string, now time.Time) (late bool, errMsg string) {
+	participant, exists := r.Participants[participantID]
+	if !exists {
+		return false, "You are not a participant in this round"
+	}
+
+	// Judges are there to listen, not to compete
+	if participant.role() == RoleJudge {
+		return false, "Judges can't submit entries"
+	}
+
+	// Check if round is active (only allow uploads during active state)
+	if r.State != StateActive {
+		return false, "Uploads are only allowed when the round is active"
+	}
+
+	// Tournament stages are only for the players still in a match; byes sit the stage out
+	if r.Bracket != nil {
+		match := r.Bracket.matchFor(participantID)
+		if match == nil {
+			return false, "You're not playing in this stage"
+		} else if match.PlayerB == "" {
+			return false, "You have a bye this stage, so there's nothing to submit"
+		}
+	}
+
+	// Sample mode specific: check if sample exists for sample mode (tournaments use a sample too)
+	if r.Mode.usesSample() && r.SampleFileID == "" {
+		return false, "Waiting for host to upload sample file first"
+	}
+
+	// Sprints have a hard cutoff; inside the grace window the upload still counts but is flagged late
+	late, errMsg = r.uploadLateness(now)
+	if errMsg != "" {
+		return false, errMsg
+	}
+
+	// Build-up rounds go one layer at a time, in join order
+	if r.Mode == ModeBuildUp {
+		if _, errMsg := r.checkLayerTurn(participantID); errMsg != "" {
+			return false, errMsg
+		}
+	}
+	return late, ""
+}
+
+// sampleUploadProblem is why the participant can't upload the round's sample right now, or "" if they can
+func (r *Round) sampleUploadProblem(participantID string) string {
+	// MUST be the host or a co-host
+	if !r.canManage(participantID) {
+		return "Only the host or a co-host can upload the sample file"
+	}
+
+	// MUST be sample mode (or a tournament, where every stage has its own sample)
+	if !r.Mode.usesSample() {
+		return "Sample uploads are only for sample mode rounds"
+	}
+
+	// Sample can only be changed while in waiting state
+	// Once active state, the sample is locked in
+	if r.State != StateWaiting {
+		return "Sample can only be uploaded or changed before the round starts. Current state: " + string(r.State)
+	}
+	return ""
+}
+
+// addSubmission puts a new entry into the round in place of oldSubmission (nil if it's their first), as its mode needs
+func (r *Round) addSubmission(participant *Participant, submission *Submission, oldSubmission *Submission, credit string) {
+	isReplacement := oldSubmission != nil
+
+	// Initialize submisions map if nil
+	if r.Submissions == nil {
+		r.Submissions = make(map[string]*Submission)
+	}
+
+	switch r.Mode {
+	case ModeSample, ModeTournament, ModeSprint:
+		// In sample mode, everyone remixes the host's sample
+		// The sample itself is uploaded via handleUploadSample, not here
+		// This handler is just for remixes
+
+		// Nothing special needed here since uploadProblem already checked for the sample
+		// and everyone (including host) can upload their remix
+		log.Printf("Sample mode: %s uploaded their remix", participant.DisplayName)
+
+	case ModeTelephone:
+		// In telephone mode, it's a chain where each person gets the previous person's upload
+		// Ordered list of everyone who uploads (judges just listen, so the chain skips them)
+		participantIDs := r.telephoneLine()
+
+		// Find current participant's position
+		currentPos := -1
+		for i, id := range participantIDs {
+			if id == submission.ParticipantID {
+				currentPos = i
+				break
+			}
+		}
+
+		// Assign to next participant in chain
+		if currentPos != -1 && currentPos < len(participantIDs)-1 {
+			nextParticipantID := participantIDs[currentPos+1]
+			submission.AssignedToID = nextParticipantID
+
+			// If replacing, keep the same assignment
+			if isReplacement && oldSubmission.AssignedToID != "" {
+				submission.AssignedToID = oldSubmission.AssignedToID
+			}
+
+			log.Printf("Telephone mode: %s's upload assigned to %s",
+				participant.DisplayName, r.Participants[submission.AssignedToID].DisplayName)
+		}
+
+		// First person's upload becomes the starting point sample we start with that goes through the telephone line
+		if currentPos == 0 {
+			r.SampleFileID = submission.Filename
+			r.SampleAnalysis, r.SamplePreview, r.SamplePrint, r.SampleJob = nil, "", "", newJobStatus()
+			log.Printf("Telephone mode: Starting file set by %s", participant.DisplayName)
+		}
+
+	case ModeBuildUp:
+		// The upload goes on top of the stack (or replaces their top layer); "credit" says what they added
+		layer := r.addLayer(participant, submission, credit)
+		log.Printf("Build-up mode: %s added layer %d (%s)", participant.DisplayName, len(r.Layers), layer.Credit)
+	}
+
+	// Add/Update submission in round (happens for both modes)
+	if isReplacement {
+		submission.Replacements = oldSubmission.Replacements + 1
+		r.forgetDuplicatesOf(submission.ParticipantID) // the new file gets checked afresh
+	}
+	r.Submissions[submission.ParticipantID] = submission
+}
+
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	code := vars["code"]
@@ -47,56 +194,26 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	participant, exists := round.Participants[session.ParticipantID]
-	if !exists {
+	// Everything about the round that can stop an upload; checked again once the file is in, as it can take a while
+	if _, errMsg := round.uploadProblem(session.ParticipantID, time.Now()); errMsg != "" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "You are not a participant in this round",
+			"error":   errMsg,
 		})
 		return
 	}
 
-	// Check if round is active (only allow uploads during active state)
-	if round.State != StateActive {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Uploads are only allowed when the round is active",
-		})
-		return
-	}
-
-	// Sample mode specific: check if sample exists for sample mode
-	if round.Mode == ModeSample && round.SampleFileID == "" {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Waiting for host to upload sample file first",
-		})
-		return
-	}
-
-	// Check for existing submission; Allows overwrites to occur
-	var isReplacement bool
-	var oldSubmission *Submission
-	if round.Submissions != nil {
-		if existing, hasSubmitted := round.Submissions[session.ParticipantID]; hasSubmitted {
-			// User is replacing their submission
-			isReplacement = true
-			oldSubmission = existing
-			log.Printf("User %s (%s) is replacing their submission",
-				participant.DisplayName, session.ParticipantID)
-		}
-	}
-
 	// Below is like a classic file uploading pattern for this language
-	// Parse the multipart (from 32 MB max size)
-	// 32 << 20 is a bit shift operation where we shift 32 by 20 buts which is the same as multiplying by 2^n
+	// Parse the multipart (max size comes from the config, in MB)
+	// MaxUploadMB << 20 is a bit shift operation where we shift it by 20 buts which is the same as multiplying by 2^20
 	// likewise, 1 << 20 is 1 MB
-	err = r.ParseMultipartForm(32 << 20)
+	// ParseMultipartForm's number is only how much it keeps in memory, so MaxBytesReader is what actually caps the size
+	// (with an extra MB for the form fields and boundaries around the file)
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxUploadBytes()+1<<20)
+	err = r.ParseMultipartForm(s.cfg.maxUploadBytes())
 	if err != nil {
-		http.Error(w, "File too large (max 32MB)", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("File too large (max %dMB)", s.cfg.MaxUploadMB), http.StatusBadRequest)
 		return
 	}
 
@@ -138,7 +255,7 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		ext)
 
 	// Create the full file path
-	uploadDir := filepath.Join("temp/uploads", round.ID)
+	uploadDir := filepath.Join(s.cfg.UploadDir, round.ID)
 	if err := os.MkdirAll(uploadDir, 0755); err != nil { // Ensure directory exists
 		http.Error(w, "Error upon making filepath for upload directory", http.StatusInternalServerError)
 		return
@@ -158,82 +275,63 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Copy the uploaded file to destination
-	writtenBytes, err := io.Copy(dst, file)
+	// Copy the uploaded file to destination, hashing it on the way so exact copies can be spotted (see duplicates.go)
+	hasher := sha256.New()
+	writtenBytes, err := io.Copy(io.MultiWriter(dst, hasher), file)
 	if err != nil {
 		log.Printf("Failed to write file: %v", err)
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
-
-	// Create submission record
-	submission := &Submission{
-		ParticipantID: session.ParticipantID,
-		Filename:      safeFilename,
-		OriginalName:  handler.Filename,
-		UploadedAt:    time.Now(),
-	}
-
-	// Initialize submisions map if nil
-	if round.Submissions == nil {
-		round.Submissions = make(map[string]*Submission)
-	}
-
-	switch round.Mode {
-	case ModeSample:
-		// In sample mode, everyone remixes the host's sample
-		// The sample itself is uploaded via handleUploadSample, not here
-		// This handler is just for remixes
-
-		// Nothing special needed here since the sample check already happened above
-		// and everyone (including host) can upload their remix
-		log.Printf("Sample mode: %s uploaded their remix", participant.DisplayName)
-
-	case ModeTelephone:
-		// In telephone mode, it's a chain where each person gets the previous person's upload
-		// Create ordered list of ALL participants
-		participantIDs := make([]string, 0, len(round.Participants))
-		for id := range round.Participants {
-			participantIDs = append(participantIDs, id)
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+
+	// The upload may have taken minutes, so the round is loaded afresh and checked again before the entry goes in;
+	// saving the copy from before the upload would undo everything that happened to the round meanwhile
+	var (
+		participant   *Participant
+		late          bool
+		isReplacement bool
+		oldSubmission *Submission
+	)
+	var refused uploadRefused
+	updated, err := s.updateRound(code, func(round *Round) error {
+		var errMsg string
+		if late, errMsg = round.uploadProblem(session.ParticipantID, time.Now()); errMsg != "" {
+			return uploadRefused(errMsg)
 		}
-		sort.Strings(participantIDs) // Deterministic order
+		participant = round.Participants[session.ParticipantID]
 
-		// Find current participant's position
-		currentPos := -1
-		for i, id := range participantIDs {
-			if id == session.ParticipantID {
-				currentPos = i
-				break
-			}
-		}
-
-		// Assign to next participant in chain
-		if currentPos != -1 && currentPos < len(participantIDs)-1 {
-			nextParticipantID := participantIDs[currentPos+1]
-			submission.AssignedToID = nextParticipantID
-
-			// If replacing, keep the same assignment
-			if isReplacement && oldSubmission.AssignedToID != "" {
-				submission.AssignedToID = oldSubmission.AssignedToID
-			}
-
-			log.Printf("Telephone mode: %s's upload assigned to %s",
-				participant.DisplayName, round.Participants[submission.AssignedToID].DisplayName)
+		// Check for existing submission; Allows overwrites to occur
+		oldSubmission = round.Submissions[session.ParticipantID]
+		isReplacement = oldSubmission != nil
+		if isReplacement {
+			log.Printf("User %s (%s) is replacing their submission",
+				participant.DisplayName, session.ParticipantID)
 		}
 
-		// First person's upload becomes the starting point sample we start with that goes through the telephone line
-		if currentPos == 0 {
-			round.SampleFileID = safeFilename
-			log.Printf("Telephone mode: Starting file set by %s", participant.DisplayName)
+		// Create submission record
+		submission := &Submission{
+			ParticipantID: session.ParticipantID,
+			Filename:      safeFilename,
+			OriginalName:  handler.Filename,
+			UploadedAt:    time.Now(),
+			Late:          late,
+			ContentHash:   contentHash,
+			Job:           newJobStatus(), // queued once the round is saved
 		}
+		round.addSubmission(participant, submission, oldSubmission, r.FormValue("credit"))
+		return nil
+	})
+	if errors.As(err, &refused) {
+		os.Remove(fullPath)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   string(refused),
+		})
+		return
 	}
-
-	// Add/Update submission in round (happens for both modes) to be saved to Redis next
-	round.Submissions[session.ParticipantID] = submission
-
-	// Save updated round to Redis
-	updatedRoundData, _ := json.Marshal(round)
-	if err := s.db.Set(ctx, roundKey(code), updatedRoundData, 24*time.Hour).Err(); err != nil {
+	if err != nil || updated == nil {
 		// Try to clean up the uploaded file since we couldn't save to Redis
 		if err := os.Remove(fullPath); err != nil {
 			http.Error(w, "Failed to remove fullPath", http.StatusInternalServerError)
@@ -243,18 +341,37 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update round", http.StatusInternalServerError)
 		return
 	}
+	round = *updated
+	submission := round.Submissions[session.ParticipantID]
 
 	// DELETE OLD FILE if this was a replacement (AFTER Redis save succeeds)
 	if isReplacement && oldSubmission != nil {
-		oldPath := filepath.Join("temp/uploads", round.ID, oldSubmission.Filename)
+		oldPath := filepath.Join(s.cfg.UploadDir, round.ID, oldSubmission.Filename)
 		if err := os.Remove(oldPath); err != nil {
 			// Log but don't fail - old file cleanup is not critical
 			log.Printf("Warning: Could not delete old file %s: %v", oldPath, err)
 		} else {
 			log.Printf("Deleted old submission file: %s", oldSubmission.Filename)
 		}
+		for _, extra := range oldSubmission.extraFiles() {
+			os.Remove(filepath.Join(s.cfg.UploadDir, round.ID, extra))
+		}
+	}
+
+	// Account holders keep their own copy so they can grab it again after the round is gone
+	if participant.UserID != "" {
+		s.recordSubmissionHistory(participant.UserID, &round, submission)
 	}
 
+	// Tempo and key show up on the round once a job worker has worked them out
+	s.enqueueUpload(uploadJob{
+		Code:       code,
+		RoundID:    round.ID,
+		Filename:   safeFilename,
+		LevelMatch: round.NormalizeListening,
+		CheckUsage: round.Mode.usesSample(),
+	})
+
 	// Log successful upload
 	action := "uploaded"
 	if isReplacement {
@@ -271,17 +388,21 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		"size":          writtenBytes,
 		"uploadedBy":    participant.DisplayName,
 		"isReplacement": isReplacement,
+		"late":          late,
 		"message":       "", // initialize empty
 	}
 
 	// Confirm success
 	switch round.Mode {
-	case ModeSample:
+	case ModeSample, ModeTournament, ModeSprint:
 		if isReplacement {
 			responseData["message"] = "Your remix has been updated successfully!"
 		} else {
 			responseData["message"] = "Your remix has been uploaded successfully!"
 		}
+		if late {
+			responseData["message"] = "Made it in the grace window! Your remix is marked as late"
+		}
 
 	case ModeTelephone:
 		if submission.AssignedToID != "" {
@@ -300,6 +421,17 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 				responseData["message"] = "Your upload is the last in the telephone chain!"
 			}
 		}
+
+	case ModeBuildUp:
+		_, index := round.layerBy(session.ParticipantID)
+		responseData["layer"] = index + 1
+		if isReplacement {
+			responseData["message"] = fmt.Sprintf("Layer %d swapped for your new take", index+1)
+		} else if next := round.nextLayerBy(); next != nil {
+			responseData["message"] = fmt.Sprintf("Layer %d is down! %s is up next", index+1, next.DisplayName)
+		} else {
+			responseData["message"] = fmt.Sprintf("Layer %d is down, and that's everyone!", index+1)
+		}
 	}
 
 	// Return success response
@@ -332,50 +464,21 @@ func (s *Server) handleUploadSample(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// MUST be the host
-	if session.ParticipantID != round.HostID {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Only the host can upload the sample file",
-		})
-		return
-	}
-
-	// MUST be sample mode
-	if round.Mode != ModeSample {
+	// Checked again once the file is in, as the round may have started while it was uploading
+	if errMsg := round.sampleUploadProblem(session.ParticipantID); errMsg != "" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Sample uploads are only for sample mode rounds",
+			"error":   errMsg,
 		})
 		return
 	}
 
-	// Sample can only be changed while in waiting state
-	// Once active state, the sample is locked in
-	if round.State != StateWaiting {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "Sample can only be uploaded or changed before the round starts. Current state: " + string(round.State),
-		})
-		return
-	}
-
-	// Check if this is a replacement
-	var isReplacement bool
-	var oldSampleFile string
-	if round.SampleFileID != "" {
-		isReplacement = true
-		oldSampleFile = round.SampleFileID
-		log.Printf("Host is replacing the sample file (old: %s)", oldSampleFile)
-	}
-
 	// Parse multipart form
-	err = r.ParseMultipartForm(32 << 20)
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxUploadBytes()+1<<20)
+	err = r.ParseMultipartForm(s.cfg.maxUploadBytes())
 	if err != nil {
-		http.Error(w, "File too large (max 32MB)", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("File too large (max %dMB)", s.cfg.MaxUploadMB), http.StatusBadRequest)
 		return
 	}
 
@@ -417,7 +520,7 @@ func (s *Server) handleUploadSample(w http.ResponseWriter, r *http.Request) {
 		ext)
 
 	// Create file path
-	uploadDir := filepath.Join("temp/uploads", round.ID)
+	uploadDir := filepath.Join(s.cfg.UploadDir, round.ID)
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		http.Error(w, "Failed to create upload directory", http.StatusInternalServerError)
 		return
@@ -445,12 +548,37 @@ func (s *Server) handleUploadSample(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update round with sample file ID
-	round.SampleFileID = safeFilename
+	// Update a fresh copy of the round with sample file ID; the old sample's tempo and key no longer apply
+	var (
+		isReplacement   bool
+		oldSampleFile   string
+		oldSampleExtras []string
+		refused         uploadRefused
+	)
+	updated, err := s.updateRound(code, func(round *Round) error {
+		if errMsg := round.sampleUploadProblem(session.ParticipantID); errMsg != "" {
+			return uploadRefused(errMsg)
+		}
+		isReplacement = round.SampleFileID != ""
+		oldSampleFile, oldSampleExtras = round.SampleFileID, round.sampleExtraFiles()
+		if isReplacement {
+			log.Printf("Host is replacing the sample file (old: %s)", oldSampleFile)
+		}
 
-	// Save updated round to Redis
-	updatedRoundData, _ := json.Marshal(round)
-	if err := s.db.Set(ctx, roundKey(code), updatedRoundData, 24*time.Hour).Err(); err != nil {
+		round.SampleFileID = safeFilename
+		round.SampleAnalysis, round.SamplePreview, round.SamplePrint, round.SampleJob = nil, "", "", newJobStatus()
+		return nil
+	})
+	if errors.As(err, &refused) {
+		os.Remove(fullPath)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   string(refused),
+		})
+		return
+	}
+	if err != nil || updated == nil {
 		// Clean up file if Redis save failed
 		if err := os.Remove(fullPath); err != nil {
 			log.Printf("Failed to remove file path and or file; error: %v", err)
@@ -461,15 +589,20 @@ func (s *Server) handleUploadSample(w http.ResponseWriter, r *http.Request) {
 
 	// DELETE OLD SAMPLE FILE if this was a replacement (AFTER Redis save succeeds)
 	if isReplacement && oldSampleFile != "" {
-		oldPath := filepath.Join("temp/uploads", round.ID, oldSampleFile)
+		oldPath := filepath.Join(s.cfg.UploadDir, round.ID, oldSampleFile)
 		if err := os.Remove(oldPath); err != nil {
 			// Log but don't fail - old file cleanup is not critical
 			log.Printf("Warning: Could not delete old sample file %s: %v", oldPath, err)
 		} else {
 			log.Printf("Deleted old sample file: %s", oldSampleFile)
 		}
+		for _, extra := range oldSampleExtras {
+			os.Remove(filepath.Join(s.cfg.UploadDir, round.ID, extra))
+		}
 	}
 
+	s.enqueueUpload(uploadJob{Code: code, RoundID: round.ID, Filename: safeFilename, Sample: true})
+
 	// Log successful sample upload
 	action := "uploaded"
 	if isReplacement {
@@ -496,6 +629,15 @@ func (s *Server) handleUploadSample(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.serveRoundFile(w, r, false)
+}
+
+// handlePreview is handleDownload for the round page's players: same rules, but it sends the small preview when there is one
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	s.serveRoundFile(w, r, true)
+}
+
+func (s *Server) serveRoundFile(w http.ResponseWriter, r *http.Request, preview bool) {
 	vars := mux.Vars(r)
 	code := vars["code"]
 	requestedFilename := vars["filename"] // From URL: /round/{code}/download/{filename}
@@ -526,20 +668,39 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 
 	// Check if user is a participant
 	participant, isParticipant := round.Participants[session.ParticipantID]
-	if !isParticipant {
-		// Check if guest downloads are allowed
-		if !round.AllowGuestDownload {
+	spectator, isSpectator := round.Spectators[session.ParticipantID]
+	isSpectator = isSpectator && session.Spectator
+	downloaderName := "guest"
+	if isParticipant {
+		downloaderName = participant.DisplayName
+	} else if isSpectator {
+		// Spectators can always stream the sample, but entries stay private until uploads are closed
+		downloaderName = spectator.DisplayName + " (spectator)"
+		requestsSample := requestedFilename == "sample" || requestedFilename == round.SampleFileID
+		if !requestsSample && round.State != StateVoting && round.State != StateClosed {
+			http.Error(w, "Entries can be listened to once the round is closed", http.StatusForbidden)
+			return
+		}
+	} else {
+		// Check if guest downloads are allowed (never on a round with a password or invites, see canSeeRound)
+		if !round.AllowGuestDownload || !round.canSeeRound(session) {
 			http.Error(w, "You must be a participant to download files", http.StatusForbidden)
 			return
 		}
 	}
 
+	// A sprint's sample stays hidden from everyone but the hosts until the clock starts
+	if requestsSample := requestedFilename == "sample" || requestedFilename == round.SampleFileID; requestsSample && round.sampleHidden() && !round.canManage(session.ParticipantID) {
+		http.Error(w, "The sample is revealed when the host starts the clock", http.StatusForbidden)
+		return
+	}
+
 	// Determine which file the user should be able to download
 	var fileToServe string
 	var originalName string
 
 	switch round.Mode {
-	case ModeSample:
+	case ModeSample, ModeTournament, ModeSprint:
 		// In sample mode, participants download the sample (except the host who made it)
 		if requestedFilename == "sample" || requestedFilename == round.SampleFileID {
 			if round.SampleFileID == "" {
@@ -562,6 +723,25 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+	case ModeBuildUp:
+		// "stems" is every layer so far in one ZIP; single layers download by filename like any entry
+		if requestedFilename == "stems" && !preview {
+			count, err := sendStemsZip(w, &round, func(filename string) string {
+				return filepath.Join(s.cfg.UploadDir, round.ID, filename)
+			})
+			if err == nil {
+				log.Printf("Stems downloaded: %d layers by %s", count, downloaderName)
+			}
+			return
+		}
+		for _, layer := range round.Layers {
+			if layer.Filename == requestedFilename {
+				fileToServe = layer.Filename
+				originalName = layer.OriginalName
+				break
+			}
+		}
+
 	case ModeTelephone:
 		// In telephone mode, find the file assigned to this participant
 		if requestedFilename == "assigned" {
@@ -577,12 +757,7 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 			// Special case: First person gets the original sample if it exists
 			if fileToServe == "" && round.SampleFileID != "" {
 				// Check if this person is first in chain (after the starter)
-				participantIDs := make([]string, 0, len(round.Participants))
-				for id := range round.Participants {
-					participantIDs = append(participantIDs, id)
-				}
-				sort.Strings(participantIDs)
-
+				participantIDs := round.telephoneLine()
 				if len(participantIDs) > 1 && participantIDs[1] == session.ParticipantID {
 					fileToServe = round.SampleFileID
 					originalName = "starting_file.mp3"
@@ -605,73 +780,118 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build the file path
-	filePath := filepath.Join("temp/uploads", round.ID, fileToServe)
+	/*
+		Previews come first, then the level-matched copy (?listen=1, which previews get anyway since theirs is made
+		with the same gain), then the original. A file without a preview yet still plays, just bigger.
+	*/
+	swapped := false
+	if preview && fileToServe == round.SampleFileID && round.SamplePreview != "" {
+		fileToServe, originalName = round.SamplePreview, previewName(originalName, filepath.Ext(round.SamplePreview))
+		swapped = true
+	}
+	for _, submission := range round.Submissions {
+		if swapped || submission.Filename != fileToServe {
+			continue
+		}
+		if preview && submission.Preview != "" {
+			fileToServe, originalName = submission.Preview, previewName(originalName, filepath.Ext(submission.Preview))
+		} else if (preview || r.URL.Query().Get("listen") != "") && submission.ListeningCopy != "" {
+			fileToServe, originalName = submission.ListeningCopy, listeningCopyName(originalName)
+		}
+		break
+	}
 
-	// Open the file
-	file, err := os.Open(filePath)
+	// Build the file path and stream it
+	filePath := filepath.Join(s.cfg.UploadDir, round.ID, fileToServe)
+	written, err := serveAudioFile(w, filePath, originalName)
 	if err != nil {
-		log.Printf("Failed to open file %s: %v", filePath, err)
-		http.Error(w, "File not found on server", http.StatusNotFound)
 		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("Failed to close file in handleDownload; error: %v", err)
-		}
-	}()
 
-	fileInfo, err := file.Stat() // Getting file info for size
-	if err != nil {
-		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+	log.Printf("File downloaded: %s by %s (%d bytes)", fileToServe, downloaderName, written)
+
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	// Get session
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Detect content type based on file extension
-	ext := strings.ToLower(filepath.Ext(fileToServe))
-	contentTypes := map[string]string{
-		".mp3":  "audio/mpeg",
-		".wav":  "audio/wav",
-		".m4a":  "audio/mp4",
-		".flac": "audio/flac",
-		".ogg":  "audio/ogg",
-		".aac":  "audio/aac",
+	// Get round from Redis
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
 	}
 
-	contentType := contentTypes[ext]
-	if contentType == "" {
-		contentType = "application/octet-stream" // Fallback for unknown types
+	// Parse round data
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
 	}
 
-	// Set headers for file download
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", originalName))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	// ?format= and ?scope= pick the archive type and what goes in it (see export.go)
+	options, err := parseExportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Just a heads up (no pun intended), the headers need to be set before we write to the body with something like w.Write() [which io.Copy will do too]
-	// Stream the file to the response
-	written, err := io.Copy(w, file) // Copy from file to w (the response); no need to convert cause files are already in bytes; UTF-8 used for text (ofc, cause we gotta decipher later)
+	// Check if user can export
+	// Host can always export, participants can export if AllowGuestDownload is enabled (and their own files regardless)
+	isHost := session.ParticipantID == round.HostID
+	_, isParticipant := round.Participants[session.ParticipantID]
+
+	if !isHost && (!round.AllowGuestDownload || !isParticipant) && !(options.Scope == scopeMine && isParticipant) {
+		http.Error(w, "You don't have permission to export files", http.StatusForbidden)
+		return
+	}
+
+	files, err := scopedExportFiles(&round, options.Scope, session.ParticipantID)
 	if err != nil {
-		log.Printf("Failed to send file: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
+	files = round.withoutHiddenSample(files, session.ParticipantID) // a sprint's sample stays hidden until the clock starts
 
-	log.Printf("File downloaded: %s by %s (%d bytes)", fileToServe, participant.DisplayName, written)
+	// Check if there are any submissions to export; Can't export a submission if there are none lol
+	if len(files) == 0 {
+		http.Error(w, "No files to export", http.StatusNotFound)
+		return
+	}
 
+	// The stored files for a live round sit in its upload folder
+	count, err := sendExport(w, &round, files, options, func(filename string) string {
+		return filepath.Join(s.cfg.UploadDir, round.ID, filename)
+	})
+	if err != nil {
+		return
+	}
+
+	log.Printf("Exported %d files for round %s (%s, %s)", count, code, options.Scope, options.Format)
 }
 
-func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+// handleManifest serves the export's manifest on its own (see manifest.go), as JSON or with ?format=csv as CSV
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	code := vars["code"]
 
-	// Get session
 	session := s.getSession(r)
 	if session == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Get round from Redis
 	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
 	if err == redis.Nil {
 		http.Error(w, "Round not found", http.StatusNotFound)
@@ -681,40 +901,187 @@ func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse round data
 	var round Round
 	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
 		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
 		return
 	}
 
-	// Check if user can export
-	// Host can always export, participants can export if AllowGuestDownload is enabled
+	// Whoever can export can see what's in the export
 	isHost := session.ParticipantID == round.HostID
 	_, isParticipant := round.Participants[session.ParticipantID]
-
 	if !isHost && (!round.AllowGuestDownload || !isParticipant) {
 		http.Error(w, "You don't have permission to export files", http.StatusForbidden)
 		return
 	}
 
-	// Check if there are any submissions to export; Can't export a submission if there are none lol
-	if len(round.Submissions) == 0 && round.SampleFileID == "" {
-		http.Error(w, "No files to export", http.StatusNotFound)
+	files := round.withoutHiddenSample(exportFiles(&round), session.ParticipantID)
+	manifest := buildManifest(&round, files, func(filename string) string {
+		return filepath.Join(s.cfg.UploadDir, round.ID, filename)
+	})
+	if r.URL.Query().Get("format") == "csv" {
+		text, err := manifest.csv()
+		if err != nil {
+			http.Error(w, "Failed to build manifest", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_manifest.csv\"", round.Name))
+		w.Write([]byte(text))
 		return
 	}
 
-	// Create a zip file in memory
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+/*
+serveAudioFile streams a stored audio file to the browser as a download named downloadName. On failure it has
+already written the error response, so callers just return.
+*/
+func serveAudioFile(w http.ResponseWriter, filePath string, downloadName string) (int64, error) {
+	// Open the file
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Printf("Failed to open file %s: %v", filePath, err)
+		http.Error(w, "File not found on server", http.StatusNotFound)
+		return 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close file in serveAudioFile; error: %v", err)
+		}
+	}()
+
+	fileInfo, err := file.Stat() // Getting file info for size
+	if err != nil {
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return 0, err
+	}
+
+	// Set headers for file download; the content type comes from the name the user will see, since blob store
+	// paths (see archive.go) have no extension
+	w.Header().Set("Content-Type", audioContentType(downloadName))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", downloadName))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+
+	// Just a heads up (no pun intended), the headers need to be set before we write to the body with something like w.Write() [which io.Copy will do too]
+	// Stream the file to the response
+	written, err := io.Copy(w, file) // Copy from file to w (the response); no need to convert cause files are already in bytes; UTF-8 used for text (ofc, cause we gotta decipher later)
+	if err != nil {
+		log.Printf("Failed to send file: %v", err)
+		return written, err
+	}
+	return written, nil
+}
+
+// audioContentType detects content type based on file extension
+func audioContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	contentTypes := map[string]string{
+		".mp3":  "audio/mpeg",
+		".wav":  "audio/wav",
+		".m4a":  "audio/mp4",
+		".flac": "audio/flac",
+		".ogg":  "audio/ogg",
+		".aac":  "audio/aac",
+	}
+
+	contentType := contentTypes[ext]
+	if contentType == "" {
+		contentType = "application/octet-stream" // Fallback for unknown types
+	}
+	return contentType
+}
+
+/*
+sendExport packs the files (see exportFiles and scopedExportFiles) into a ZIP or tar.gz and sends it as a download,
+along with the extras: credits, roulette rules and the manifest. pathFor says where each stored file (by its
+Filename / SampleFileID) is on disk, which is how live rounds and archived rounds share this. Returns how many files
+made it in; on failure the error response has already been written.
+*/
+func sendExport(w http.ResponseWriter, round *Round, files []exportFile, options exportOptions,
+	pathFor func(filename string) string) (int, error) {
+	// Build the archive in memory
 	// For production with large files, you'd want to stream this or use temp files
 	buf := new(bytes.Buffer) // bytes.Buffer is a growable in-memory byte array; It implements both io.Writer and io.Reader
-	zipWriter := zip.NewWriter(buf)
+	out := newExportWriter(options.Format, buf)
+	count := addExportFiles(out, files, pathFor)
+
+	// Build-up rounds are one track, so the stems come with credits saying who added what
+	if round.Mode == ModeBuildUp && options.Scope == scopeAll {
+		addTextToExport(out, "layers/credits.txt", layerCredits(round))
+	}
+
+	// The roulette draw goes along so everyone remembers what they were up against
+	if round.Roulette != nil && !round.Roulette.DealtAt.IsZero() {
+		addTextToExport(out, "constraints.txt", constraintsText(round))
+	}
+
+	// And a record of who sent in what, and when (see manifest.go)
+	manifest := buildManifest(round, files, pathFor)
+	if manifestJSON, err := manifest.json(); err != nil {
+		log.Printf("Failed to build manifest for export: %v", err)
+	} else {
+		addTextToExport(out, "manifest.json", manifestJSON)
+	}
+	if manifestCSV, err := manifest.csv(); err != nil {
+		log.Printf("Failed to build manifest CSV for export: %v", err)
+	} else {
+		addTextToExport(out, "manifest.csv", manifestCSV)
+	}
+
+	// Closing the writer finishes off the archive
+	if err := out.close(); err != nil {
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		return 0, err
+	}
+
+	// Set headers for the download
+	w.Header().Set("Content-Type", options.Format.contentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", options.filename(round)))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+
+	// Send the archive
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Failed to send export: %v", err)
+		return count, err
+	}
+	return count, nil
+}
+
+// exportFile is one stored file as it goes into an export
+type exportFile struct {
+	Kind          string // "sample", "submission" or "layer"
+	Filename      string // the stored name, for pathFor
+	Path          string // its name inside the export
+	ParticipantID string // who made it; empty for the sample
+	Submission    *Submission
+	Layer         *Layer
+	Tags          *trackTags // written into the exported copy (see tags.go)
+}
+
+// exportFiles lists everything that goes into the round's export, in order: the sample, then the entries (or layers)
+func exportFiles(round *Round) []exportFile {
+	var files []exportFile
 
 	// Add sample file if it exists
 	if round.SampleFileID != "" {
-		filePath := filepath.Join("temp/uploads", round.ID, round.SampleFileID)
-		if err := addFileToZip(zipWriter, filePath, "00_sample_"+round.SampleFileID); err != nil {
-			log.Printf("Failed to add sample to zip: %v", err)
+		tags := &trackTags{Title: "Sample", Album: round.Name, Comment: exportComment(round)}
+		if host := round.Participants[round.HostID]; host != nil {
+			tags.Artist = host.DisplayName
 		}
+		files = append(files, exportFile{
+			Kind:     "sample",
+			Filename: round.SampleFileID,
+			Path:     "00_sample_" + round.SampleFileID,
+			Tags:     tags,
+		})
+	}
+
+	// Build-up rounds are one track, so the stems go in as layers in the order they were stacked
+	if round.Mode == ModeBuildUp {
+		return append(files, layerExportFiles(round, "layers/")...)
 	}
 
 	// Add all submissions and sort by participant name for consistent ordering
@@ -737,41 +1104,72 @@ func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
 		return sortedSubmissions[i].ParticipantName < sortedSubmissions[j].ParticipantName
 	})
 
-	// Add each submission to the zip
 	for i, info := range sortedSubmissions {
-		filePath := filepath.Join("temp/uploads", round.ID, info.Submission.Filename)
 		// Naming files with number prefix for order and participant name for some clarity naming convention
-		zipFilename := fmt.Sprintf("%02d_%s_%s", i+1, info.ParticipantName, info.Submission.OriginalName)
+		name := entryNamePart(info.ParticipantName) + "_" + entryNamePart(info.Submission.OriginalName)
+		files = append(files, exportFile{
+			Kind:          "submission",
+			Filename:      info.Submission.Filename,
+			Path:          fmt.Sprintf("%02d_%s", i+1, name),
+			ParticipantID: info.Submission.ParticipantID,
+			Submission:    info.Submission,
+			Tags: &trackTags{
+				Title:   strings.TrimSuffix(info.Submission.OriginalName, filepath.Ext(info.Submission.OriginalName)),
+				Artist:  info.ParticipantName,
+				Album:   round.Name,
+				Track:   i + 1,
+				Tracks:  len(sortedSubmissions),
+				Comment: exportComment(round),
+			},
+		})
+	}
+	return files
+}
 
-		if err := addFileToZip(zipWriter, filePath, zipFilename); err != nil {
-			log.Printf("Failed to add file to zip: %v", err)
+// addExportFiles adds each file under its export name. Returns how many made it in.
+func addExportFiles(out exportWriter, files []exportFile, pathFor func(filename string) string) int {
+	count := 0
+	for _, file := range files {
+		if err := out.addFile(pathFor(file.Filename), file.Path, file.Tags); err != nil {
+			log.Printf("Failed to add %s to export: %v", file.Path, err)
 			// We'll still continue with other files even if one fails
+			continue
 		}
+		count++
 	}
+	return count
+}
 
-	// Closing the zip writer
-	if err := zipWriter.Close(); err != nil {
-		http.Error(w, "Failed to create zip file", http.StatusInternalServerError)
-		return
+// addTextToExport adds a small generated file (credits, constraints, the manifest); failures are only logged
+func addTextToExport(out exportWriter, name string, text string) {
+	if err := out.addText(name, text); err != nil {
+		log.Printf("Failed to add %s to export: %v", name, err)
 	}
+}
 
-	// Set headers for zip download
-	zipFilename := fmt.Sprintf("%s_%s_export.zip", round.Name, time.Now().Format("20060102_150405"))
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", zipFilename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
-
-	// Send the zip file
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		log.Printf("Failed to send zip file: %v", err)
-		return
+/*
+entryNamePart makes free text (a display name, a layer credit) safe to use in a ZIP or tarball entry name. Slashes
+would make folders, and ".." could climb out of the folder it's extracted to, so neither survives; nor do control
+characters.
+*/
+func entryNamePart(text string) string {
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '-'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+	for strings.Contains(text, "..") {
+		text = strings.ReplaceAll(text, "..", ".")
 	}
-
-	log.Printf("Exported %d files for round %s by host", len(round.Submissions)+1, code) // may be one off because of the sample file for the export count
+	return text
 }
 
-// Helper function for adding a file to a zip
-func addFileToZip(zipWriter *zip.Writer, filePath string, zipPath string) error {
+// Helper function for adding a file to a zip; with tags, the copy in the zip gets them written in (see tags.go)
+func addFileToZip(zipWriter *zip.Writer, filePath string, zipPath string, tags *trackTags) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
@@ -806,6 +1204,23 @@ func addFileToZip(zipWriter *zip.Writer, filePath string, zipPath string) error
 		return err
 	}
 
+	// Tagging needs the whole file in hand; formats we don't tag (or files we can't) go in as they are
+	if tags != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		stamped, err := stampTags(data, *tags)
+		if err != nil {
+			if !errors.Is(err, errUnsupportedAudio) {
+				log.Printf("Failed to tag %s, exporting it untagged: %v", zipPath, err)
+			}
+			stamped = data
+		}
+		_, err = writer.Write(stamped)
+		return err
+	}
+
 	// Copy file content to zip
 	// Go handles the transferring and compressing of the file into the compressed writer ghost zip file and fills it up
 
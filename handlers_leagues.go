@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkPointsTable makes sure a points table is something we can rank with; returns an error message for the client
+func checkPointsTable(points []int, participation int) string {
+	if len(points) == 0 || len(points) > maxLeaguePlaces {
+		return fmt.Sprintf("The points table needs between 1 and %d places", maxLeaguePlaces)
+	}
+	for _, value := range points {
+		if value < 0 || value > 1000 {
+			return "Points per place must be between 0 and 1000"
+		}
+	}
+	if participation < 0 || participation > 1000 {
+		return "Participation points must be between 0 and 1000"
+	}
+	return ""
+}
+
+// lookupLeague loads a league, writing the error response itself when there isn't one
+func (s *Server) lookupLeague(w http.ResponseWriter, code string) *League {
+	league, err := s.getLeague(strings.ToUpper(code))
+	if err != nil {
+		log.Printf("Failed to read league %s: %v", code, err)
+		http.Error(w, "Failed to get league", http.StatusInternalServerError)
+		return nil
+	}
+	if league == nil {
+		http.Error(w, "League not found", http.StatusNotFound)
+		return nil
+	}
+	return league
+}
+
+// pageLeague is the league a round page links to, or nil; a missing league just means no link
+func (s *Server) pageLeague(code string) *League {
+	if code == "" {
+		return nil
+	}
+	league, err := s.getLeague(code)
+	if err != nil {
+		log.Printf("Failed to read league %s: %v", code, err)
+	}
+	return league
+}
+
+// handleCreateLeague starts a new league owned by the logged-in account
+func (s *Server) handleCreateLeague(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name                string `json:"name"`
+		Points              []int  `json:"points"`              // optional; defaults to defaultLeaguePoints
+		ParticipationPoints *int   `json:"participationPoints"` // optional; pointer so 0 can be asked for
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Leagues remember people across rounds, which needs someone to own them for longer than a session
+	account := s.getAccount(r)
+	if account == nil {
+		http.Error(w, "Log in to create a league", http.StatusUnauthorized)
+		return
+	}
+
+	league := &League{
+		Name:                strings.TrimSpace(req.Name),
+		OwnerID:             account.ID,
+		Points:              defaultLeaguePoints,
+		ParticipationPoints: defaultParticipationPoints,
+		Members:             make(map[string]*LeagueMember),
+		Rounds:              []*LeagueRound{},
+		CreatedAt:           time.Now(),
+	}
+	if len(req.Points) > 0 {
+		league.Points = req.Points
+	}
+	if req.ParticipationPoints != nil {
+		league.ParticipationPoints = *req.ParticipationPoints
+	}
+
+	errMsg := checkPointsTable(league.Points, league.ParticipationPoints)
+	if league.Name == "" || len(league.Name) > 50 {
+		errMsg = "League name must be 1-50 characters"
+	}
+	if errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return
+	}
+
+	// Same short codes as rounds, in their own namespace
+	for {
+		league.Code = generateJoinCode()
+		exists, _ := s.db.Exists(ctx, leagueKey(league.Code)).Result()
+		if exists == 0 {
+			break
+		}
+	}
+
+	if err := s.saveLeague(league); err != nil {
+		http.Error(w, "Failed to create league", http.StatusInternalServerError)
+		return
+	}
+	s.db.SAdd(ctx, userLeaguesKey(account.ID), league.Code)
+
+	log.Printf("League %s (%s) created by %s", league.Code, league.Name, account.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"code":    league.Code,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleCreateLeague; err: %v", err)
+	}
+}
+
+// handleListLeagues returns the leagues the logged-in account can host rounds for, for the create form and account page
+func (s *Server) handleListLeagues(w http.ResponseWriter, r *http.Request) {
+	account := s.getAccount(r)
+	if account == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := s.db.SMembers(ctx, userLeaguesKey(account.ID)).Result()
+	if err != nil {
+		http.Error(w, "Failed to get leagues", http.StatusInternalServerError)
+		return
+	}
+
+	leagues := make([]map[string]interface{}, 0, len(codes))
+	for _, code := range codes {
+		league, err := s.getLeague(code)
+		if err != nil || league == nil {
+			continue
+		}
+		leagues = append(leagues, map[string]interface{}{
+			"code":    league.Code,
+			"name":    league.Name,
+			"isOwner": league.OwnerID == account.ID,
+			"rounds":  len(league.Rounds),
+		})
+	}
+	sort.Slice(leagues, func(i, j int) bool {
+		return leagues[i]["name"].(string) < leagues[j]["name"].(string)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"leagues": leagues,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleListLeagues; err: %v", err)
+	}
+}
+
+// handleLeagueInfo is the league with its leaderboard worked out; anyone with the code can look
+func (s *Server) handleLeagueInfo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	league := s.lookupLeague(w, vars["code"])
+	if league == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"league":    league.public(),
+		"standings": league.standings(),
+	}); err != nil {
+		log.Printf("Failed to encode json for handleLeagueInfo; err: %v", err)
+	}
+}
+
+// handleUpdateLeague lets the owner rename the league or change the points table; standings follow straight away
+func (s *Server) handleUpdateLeague(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	// Pointers so a request can change one setting without touching the others
+	var req struct {
+		Name                *string `json:"name"`
+		Points              []int   `json:"points"`
+		ParticipationPoints *int    `json:"participationPoints"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	account := s.getAccount(r)
+	if account == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Checked and changed on a fresh copy, so a round closing at the same time still makes it into the league
+	var errMsg string
+	league, err := s.updateLeague(strings.ToUpper(vars["code"]), func(league *League) error {
+		if league.OwnerID != account.ID {
+			errMsg = "Only the league owner can change its settings"
+			return errLeagueRefused
+		}
+
+		if req.Name != nil {
+			league.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.Points != nil {
+			league.Points = req.Points
+		}
+		if req.ParticipationPoints != nil {
+			league.ParticipationPoints = *req.ParticipationPoints
+		}
+
+		errMsg = checkPointsTable(league.Points, league.ParticipationPoints)
+		if league.Name == "" || len(league.Name) > 50 {
+			errMsg = "League name must be 1-50 characters"
+		}
+		if errMsg != "" {
+			return errLeagueRefused
+		}
+		return nil
+	})
+	if errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update league", http.StatusInternalServerError)
+		return
+	}
+	if league == nil {
+		http.Error(w, "League not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"standings": league.standings(),
+		"message":   "League updated",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleUpdateLeague; err: %v", err)
+	}
+}
+
+// handleMergeMembers folds one league member into another when the same person ended up as two (see league.go)
+func (s *Server) handleMergeMembers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var req struct {
+		FromID string `json:"fromId"` // goes away
+		IntoID string `json:"intoId"` // keeps the name and gets the results
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	account := s.getAccount(r)
+	if account == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var errMsg, fromName string
+	var into *LeagueMember
+	league, err := s.updateLeague(strings.ToUpper(vars["code"]), func(league *League) error {
+		var from *LeagueMember
+		from, into = league.Members[req.FromID], league.Members[req.IntoID]
+		switch {
+		case league.OwnerID != account.ID:
+			errMsg = "Only the league owner can merge members"
+		case from == nil || into == nil:
+			errMsg = "Member not found"
+		case from.ID == into.ID:
+			errMsg = "Pick two different members"
+		case from.UserID != "" && into.UserID != "" && from.UserID != into.UserID:
+			errMsg = "Those two members are different accounts"
+		}
+		if errMsg != "" {
+			return errLeagueRefused
+		}
+
+		fromName = from.DisplayName
+		league.mergeMembers(from.ID, into.ID)
+		return nil
+	})
+	if errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to merge members", http.StatusInternalServerError)
+		return
+	}
+	if league == nil {
+		http.Error(w, "League not found", http.StatusNotFound)
+		return
+	}
+	if into.UserID != "" {
+		s.db.SAdd(ctx, userLeaguesKey(into.UserID), league.Code)
+	}
+
+	log.Printf("League %s: merged %s into %s", league.Code, fromName, into.DisplayName)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"standings": league.standings(),
+		"message":   fmt.Sprintf("Merged %s into %s", fromName, into.DisplayName),
+	}); err != nil {
+		log.Printf("Failed to encode json for handleMergeMembers; err: %v", err)
+	}
+}
+
+// handleLeagueView renders the league page: standings, points table and the rounds so far
+func (s *Server) handleLeagueView(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	league := s.lookupLeague(w, vars["code"])
+	if league == nil {
+		return
+	}
+
+	account := s.getAccount(r)
+
+	// Newest round first, each with its winner(s) spelled out
+	type roundRow struct {
+		JoinCode string
+		Name     string
+		ClosedAt time.Time
+		Entries  int
+		Winners  string
+	}
+	rounds := make([]roundRow, 0, len(league.Rounds))
+	for i := len(league.Rounds) - 1; i >= 0; i-- {
+		leagueRound := league.Rounds[i]
+		var winners []string
+		for _, result := range leagueRound.Results {
+			if member, exists := league.Members[result.MemberID]; exists && result.Place == 1 {
+				winners = append(winners, member.DisplayName)
+			}
+		}
+		rounds = append(rounds, roundRow{
+			JoinCode: leagueRound.JoinCode,
+			Name:     leagueRound.Name,
+			ClosedAt: leagueRound.ClosedAt,
+			Entries:  len(leagueRound.Results),
+			Winners:  strings.Join(winners, ", "),
+		})
+	}
+
+	// Templates can't do arithmetic, so the 1-based places are worked out here
+	type pointsRow struct {
+		Place  int
+		Points int
+	}
+	pointsTable := make([]pointsRow, len(league.Points))
+	for i, points := range league.Points {
+		pointsTable[i] = pointsRow{Place: i + 1, Points: points}
+	}
+
+	members := make([]*LeagueMember, 0, len(league.Members))
+	for _, member := range league.Members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].DisplayName < members[j].DisplayName
+	})
+
+	data := map[string]interface{}{
+		"League":      league,
+		"Standings":   league.standings(),
+		"PointsTable": pointsTable,
+		"Rounds":      rounds,
+		"Members":     members,
+		"IsOwner":     account != nil && account.ID == league.OwnerID,
+		"CanHost":     league.canHost(account),
+		"CSRFToken":   s.ensureCSRFToken(w, r),
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "league.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+	}
+}
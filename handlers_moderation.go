@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+	"os"                     // For OS interface
+	"path/filepath"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (s *Server) handleKickParticipant(w http.ResponseWriter, r *http.Request) {
+	s.moderateParticipant(w, r, false)
+}
+
+func (s *Server) handleBanParticipant(w http.ResponseWriter, r *http.Request) {
+	s.moderateParticipant(w, r, true)
+}
+
+/*
+moderateParticipant is the shared body of kick and ban. Both remove the participant (or spectator), their submission
+and their votes and log them out of the round; a ban additionally blocks their device and client fingerprints from
+rejoining.
+*/
+func (s *Server) moderateParticipant(w http.ResponseWriter, r *http.Request, ban bool) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		ParticipantID string `json:"participantId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can remove participants",
+		})
+		return
+	}
+
+	target, exists := round.Participants[req.ParticipantID]
+	spectator := false
+	if !exists {
+		target, spectator = round.Spectators[req.ParticipantID], true
+		exists = target != nil
+	}
+	if !exists {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "That person is not in this round",
+		})
+		return
+	}
+
+	// The host leaving goes through handleLeaveRound so that hosting gets handed off properly
+	if target.ID == round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You can't remove yourself",
+		})
+		return
+	}
+
+	// Remove the participant, whatever they submitted and any vote they cast
+	if spectator {
+		delete(round.Spectators, target.ID)
+	} else {
+		delete(round.Participants, target.ID)
+	}
+	delete(round.Votes, target.ID)
+	for _, matchVotes := range round.MatchVotes {
+		delete(matchVotes, target.ID)
+	}
+	layerStays := round.dropLayer(target.ID)
+	var removedFiles []string
+	if submission, hasSubmitted := round.Submissions[target.ID]; hasSubmitted {
+		delete(round.Submissions, target.ID)
+		round.forgetDuplicatesOf(target.ID)
+		// If others have built on their layer, the stem stays in the track along with everything made from it
+		if !layerStays {
+			removedFiles = append([]string{submission.Filename}, submission.extraFiles()...)
+		}
+	}
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	// Only touch the files and sessions once the round itself is saved
+	for _, removedFile := range removedFiles {
+		filePath := filepath.Join(s.cfg.UploadDir, round.ID, removedFile)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Could not delete removed submission %s: %v", filePath, err)
+		}
+	}
+	s.invalidateSessions(code, target.ID)
+
+	if ban {
+		// Copy their fingerprints over to the ban list; they were recorded when they joined
+		fingerprintData, err := s.db.HGet(ctx, roundFingerprintsKey(code), target.ID).Result()
+		var fingerprints []string
+		if err == nil {
+			if err := json.Unmarshal([]byte(fingerprintData), &fingerprints); err != nil {
+				log.Printf("Failed to parse fingerprints for participant %s: %v", target.ID, err)
+			}
+		}
+
+		if len(fingerprints) > 0 {
+			for _, fingerprint := range fingerprints {
+				s.db.SAdd(ctx, roundBansKey(code), fingerprint)
+			}
+			s.db.ExpireAt(ctx, roundBansKey(code), round.ExpiresAt)
+		} else {
+			log.Printf("No fingerprints recorded for %s in round %s; ban only removes them", target.DisplayName, code)
+		}
+		s.db.HDel(ctx, roundFingerprintsKey(code), target.ID)
+	}
+
+	action := "kicked"
+	if ban {
+		action = "banned"
+	}
+	log.Printf("Participant %s %s from round %s by host %s", target.DisplayName, action, code, session.ParticipantID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"message":        target.DisplayName + " was " + action,
+		"remainingCount": len(round.Participants),
+	}); err != nil {
+		log.Printf("Failed to encode json for moderateParticipant; err: %v", err)
+	}
+}
+
+// handleLockRound lets the host close the lobby to new joins (or reopen it) without changing the round state
+func (s *Server) handleLockRound(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Locked bool `json:"locked"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can lock the lobby",
+		})
+		return
+	}
+
+	round.Locked = req.Locked
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Lobby unlocked; new participants can join"
+	if round.Locked {
+		message = "Lobby locked; no new participants can join"
+	}
+	log.Printf("Round %s: %s", code, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"locked":  round.Locked,
+		"message": message,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleLockRound; err: %v", err)
+	}
+}
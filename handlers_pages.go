@@ -5,6 +5,8 @@ import (
 	"github.com/gorilla/mux" // Router for advanced URL Routing
 	"log"                    // For Logging errors and info messages
 	"net/http"               // For HTTP server and client funcionality
+	"net/url"
+	"sort"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -14,11 +16,17 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		So here, we take the template named index.html. index.html or any template for that matter may contain
 		some variables that are not hardcoded, and so that's where we would write something to fill variables in
 		the index.html or whatever file. We'd usually put it where the nil is in the ExecuteTemplate()
-		function parameter. We don't need any dynamic variables at the moment, so that's why we have nil
-		for some of the ExecuteTemplate() functions.
+		function parameter. The landing page needs the CSRF token that the JS sends back with its POSTs
+		(see csrf.go), plus the round length choices for the create form.
 	*/
 
-	if err := s.templates.ExecuteTemplate(w, "index.html", nil); err != nil {
+	data := map[string]interface{}{
+		"CSRFToken":            s.ensureCSRFToken(w, r),
+		"LifetimeOptions":      s.lifetimeOptions(),
+		"DefaultLifetimeHours": int(s.cfg.RoundTTL.Hours()),
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "index.html", data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		log.Printf("Template error: %v", err)
 	}
@@ -34,6 +42,15 @@ func (s *Server) handleRoundView(w http.ResponseWriter, r *http.Request) {
 	// Very useful when Pipelining commands [can look into that later]
 	roundData, err := cmd1.Result()
 	if err == redis.Nil {
+		// Gone from Redis; if it was closed before it expired, show the archived copy instead (see archive.go)
+		archived, archiveErr := s.archive.get(code)
+		if archiveErr != nil {
+			log.Printf("Failed to read archived round %s: %v", code, archiveErr)
+		}
+		if archived != nil && archived.canView(s.getAccount(r)) {
+			s.handleArchivedRoundView(w, r, archived)
+			return
+		}
 		http.Error(w, "Round not found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -49,15 +66,151 @@ func (s *Server) handleRoundView(w http.ResponseWriter, r *http.Request) {
 
 	// Check session
 	session := s.getSession(r)
+
+	// Outsiders get sent to the join form for a round with a password or invites, with the code filled in
+	if !round.canSeeRound(session) {
+		http.Redirect(w, r, "/?code="+url.QueryEscape(code), http.StatusSeeOther)
+		return
+	}
+
 	var participant *Participant
-	if session != nil && round.Participants != nil {
+	var spectator *Participant
+	if session != nil && session.Spectator {
+		spectator = round.Spectators[session.ParticipantID]
+	} else if session != nil && round.Participants != nil {
 		participant = round.Participants[session.ParticipantID]
 	}
 
+	// Entries to listen to (and vote on), sorted by name so everyone sees the same order
+	type entry struct {
+		ParticipantID string
+		DisplayName   string
+		Filename      string
+		IsMine        bool
+		Analysis      *AudioAnalysis
+	}
+	entries := make([]entry, 0, len(round.Submissions))
+	for participantID, submission := range round.Submissions {
+		owner, exists := round.Participants[participantID]
+		if !exists {
+			continue
+		}
+		entries = append(entries, entry{
+			ParticipantID: participantID,
+			DisplayName:   owner.DisplayName,
+			Filename:      submission.Filename,
+			IsMine:        participant != nil && participant.ID == participantID,
+			Analysis:      submission.Analysis,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DisplayName < entries[j].DisplayName
+	})
+
+	var myVote string
+	if session != nil {
+		myVote = round.Votes[session.ParticipantID]
+	}
+
+	// Tournament stages are voted match by match, and only the players still in a match submit
+	type ballot struct {
+		ID      string
+		Entries []entry // whoever in the match submitted; with only one there's nothing to vote on
+		MyVote  string
+		IsMine  bool
+	}
+	var ballots []ballot
+	inStage, hasBye := false, false
+	if round.Bracket != nil {
+		byPlayer := make(map[string]entry, len(entries))
+		for _, e := range entries {
+			byPlayer[e.ParticipantID] = e
+		}
+		for _, match := range round.Bracket.current().Matches {
+			if match.PlayerB == "" {
+				continue
+			}
+			matchBallot := ballot{ID: match.ID}
+			for _, playerID := range []string{match.PlayerA, match.PlayerB} {
+				if e, submitted := byPlayer[playerID]; submitted {
+					matchBallot.Entries = append(matchBallot.Entries, e)
+				}
+				if session != nil && playerID == session.ParticipantID {
+					matchBallot.IsMine = true
+				}
+			}
+			if session != nil {
+				matchBallot.MyVote = round.MatchVotes[match.ID][session.ParticipantID]
+			}
+			ballots = append(ballots, matchBallot)
+		}
+		if participant != nil {
+			match := round.Bracket.matchFor(participant.ID)
+			inStage = match != nil && match.PlayerB != ""
+			hasBye = match != nil && match.PlayerB == ""
+		}
+	}
+
+	// Build-up rounds: whose turn it is, and where the viewer's own layer sits
+	var nextLayerBy *Participant
+	myLayer := 0
+	layerBlocked := "" // why the viewer can't upload a layer right now, if they can't
+	if round.Mode == ModeBuildUp {
+		nextLayerBy = round.nextLayerBy()
+		if participant != nil {
+			_, index := round.layerBy(participant.ID)
+			myLayer = index + 1
+			_, layerBlocked = round.checkLayerTurn(participant.ID)
+		}
+	}
+
+	// Constraint roulette: the viewer's own rule once they've been dealt one
+	myConstraint := ""
+	if participant != nil {
+		myConstraint = round.constraintFor(participant.ID)
+	}
+
+	// Possible copies, for the hosts to look into before closing (see duplicates.go)
+	var duplicates []duplicatePair
+	if participant != nil && round.canManage(participant.ID) {
+		duplicates = round.duplicatePairs()
+	}
+
 	data := map[string]interface{}{
-		"Code":        code,
-		"Round":       round,
-		"Participant": participant,
+		"Code":            code,
+		"Round":           round,
+		"Participant":     participant,
+		"Spectator":       spectator,
+		"CanManage":       participant != nil && round.canManage(participant.ID),
+		"CanVote":         participant != nil || (spectator != nil && round.SpectatorsCanVote),
+		"MyVote":          myVote,
+		"Entries":         entries,
+		"SpectatorCount":  len(round.Spectators),
+		"Results":         round.info().Results,
+		"CSRFToken":       s.ensureCSRFToken(w, r),
+		"MaxUploadMB":     s.cfg.MaxUploadMB,
+		"LifetimeOptions": s.lifetimeOptions(),
+		"League":          s.pageLeague(round.LeagueCode),
+		"Bracket":         round.Bracket.view(),
+		"Ballots":         ballots,
+		"InStage":         inStage,
+		"HasBye":          hasBye,
+		"Deadline":        round.deadline(), // sprint mode; zero otherwise
+		"Cutoff":          round.cutoff(),
+		"UsesSample":      round.Mode.usesSample(),
+		"Duplicates":      duplicates,
+		"Layers":          layersForPage(&round),
+		"NextLayerBy":     nextLayerBy,
+		"MyLayer":         myLayer,
+		"MyTurn":          participant != nil && nextLayerBy != nil && nextLayerBy.ID == participant.ID,
+		"LayerBlocked":    layerBlocked,
+		"SampleHidden":    round.sampleHidden() && (participant == nil || !round.canManage(participant.ID)),
+		"MyConstraint":    myConstraint,
+	}
+
+	// Keeps the session cookie in step with the round, since the host may have extended it since the cookie was set
+	if participant != nil || spectator != nil {
+		s.setSessionCookie(w, session.Token, &round)
 	}
 
 	if err := s.templates.ExecuteTemplate(w, "round.html", data); err != nil {
@@ -65,3 +218,16 @@ func (s *Server) handleRoundView(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Template error: %v", err)
 	}
 }
+
+func (s *Server) handleAccountView(w http.ResponseWriter, r *http.Request) {
+	// The page itself is mostly static; account.js fetches the history from /api/account/me once it loads
+	data := map[string]interface{}{
+		"User":      s.getAccount(r),
+		"CSRFToken": s.ensureCSRFToken(w, r),
+	}
+
+	if err := s.templates.ExecuteTemplate(w, "account.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		log.Printf("Template error: %v", err)
+	}
+}
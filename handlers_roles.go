@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+
+	"github.com/redis/go-redis/v9"
+)
+
+// handleTransferHost lets the host explicitly hand hosting to someone else; the old host stays on as a regular participant
+func (s *Server) handleTransferHost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		ParticipantID string `json:"participantId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can hand off hosting",
+		})
+		return
+	}
+
+	newHost, exists := round.Participants[req.ParticipantID]
+	if !exists || newHost.ID == round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Pick another participant in this round",
+		})
+		return
+	}
+
+	// Swap the roles; the old host becomes a regular participant and can be made a co-host afterwards if wanted
+	if oldHost, exists := round.Participants[round.HostID]; exists {
+		oldHost.setRole(RoleParticipant)
+	}
+	newHost.setRole(RoleHost)
+	round.HostID = newHost.ID
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Host transferred from %s to %s in round %s", session.ParticipantID, newHost.DisplayName, code)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"newHost": newHost.DisplayName,
+		"message": fmt.Sprintf("%s is now the host", newHost.DisplayName),
+	}); err != nil {
+		log.Printf("Failed to encode json for handleTransferHost; err: %v", err)
+	}
+}
+
+// handleSetRole lets the host promote or demote someone between participant, co-host and judge
+func (s *Server) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		ParticipantID string          `json:"participantId"`
+		Role          ParticipantRole `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Host changes go through handleTransferHost, and spectators never have a participant entry to change
+	if req.Role != RoleParticipant && req.Role != RoleCoHost && req.Role != RoleJudge {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Invalid role",
+		})
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can change roles",
+		})
+		return
+	}
+
+	target, exists := round.Participants[req.ParticipantID]
+	if !exists || target.ID == round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Pick another participant in this round",
+		})
+		return
+	}
+
+	// A judge with an entry would be judging themselves
+	if req.Role == RoleJudge {
+		if _, hasSubmitted := round.Submissions[target.ID]; hasSubmitted {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Someone who already submitted can't become a judge",
+			})
+			return
+		}
+	}
+
+	target.setRole(req.Role)
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Round %s: %s is now %s", code, target.DisplayName, req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"role":    req.Role,
+		"message": fmt.Sprintf("%s is now a %s", target.DisplayName, roleLabel(req.Role)),
+	}); err != nil {
+		log.Printf("Failed to encode json for handleSetRole; err: %v", err)
+	}
+}
+
+// roleLabel is the human readable name of a role for messages
+func roleLabel(role ParticipantRole) string {
+	switch role {
+	case RoleHost:
+		return "host"
+	case RoleCoHost:
+		return "co-host"
+	case RoleJudge:
+		return "judge"
+	case RoleSpectator:
+		return "spectator"
+	default:
+		return "participant"
+	}
+}
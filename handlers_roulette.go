@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+handleUpdateRoulette lets the host (or a co-host) write or rewrite the constraint roulette pool before the round
+starts. An empty pool turns roulette off. Once the round has started (and the rules are dealt) the pool is fixed.
+*/
+func (s *Server) handleUpdateRoulette(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Constraints    []string `json:"constraints"`
+		PerParticipant bool     `json:"perParticipant"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if !round.canManage(session.ParticipantID) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host or a co-host can set the rules",
+		})
+		return
+	}
+
+	if round.State != StateWaiting || (round.Roulette != nil && !round.Roulette.DealtAt.IsZero()) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "The rules can only be changed before the round starts",
+		})
+		return
+	}
+
+	constraints, errMsg := checkConstraintPool(req.Constraints)
+	if errMsg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   errMsg,
+		})
+		return
+	}
+	round.Roulette = newRoulette(RoundSettings{Constraints: constraints, ConstraintsPerParticipant: req.PerParticipant})
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to update round", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Round %s roulette pool set to %d rules by %s", code, len(constraints), session.ParticipantID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"count":          len(constraints),
+		"perParticipant": req.PerParticipant,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleUpdateRoulette; err: %v", err)
+	}
+}
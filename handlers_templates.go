@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Round templates and "run it back"
+
+Hosts who run the same weekly battle don't want to fill in the create form every time. Two shortcuts:
+
+  - a template is a saved RoundSettings with a label. The host saves one from any round they're hosting and can
+    start a new round from it on the home page. Templates belong to the account if the host is logged in, otherwise
+    to the browser's device cookie, and they never expire.
+  - cloning starts a new round with the same settings as a closed one (live or archived), optionally with an invite
+    made out for everyone who was in it, so the host just has to send the links around.
+*/
+
+const maxTemplatesPerOwner = 50
+
+// RoundTemplate is a saved set of round settings
+type RoundTemplate struct {
+	ID        string        `json:"id"`
+	Label     string        `json:"label"`
+	Settings  RoundSettings `json:"settings"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// templatesKey is a hash of template ID -> RoundTemplate JSON for one owner
+func templatesKey(owner string) string {
+	return "roundtemplates:" + owner
+}
+
+// templateOwner is who saved templates belong to: the account if there is one, otherwise this browser
+func (s *Server) templateOwner(w http.ResponseWriter, r *http.Request) string {
+	if account := s.getAccount(r); account != nil {
+		return "user:" + account.ID
+	}
+	return "device:" + s.ensureDevice(w, r)
+}
+
+// public is the template as the browser sees it; the password hash stays on the server
+func (t *RoundTemplate) public() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                        t.ID,
+		"label":                     t.Label,
+		"name":                      t.Settings.Name,
+		"mode":                      t.Settings.Mode,
+		"allowGuestDownload":        t.Settings.AllowGuestDownload,
+		"inviteOnly":                t.Settings.InviteOnly,
+		"spectatorsCanVote":         t.Settings.SpectatorsCanVote,
+		"lifetimeHours":             t.Settings.LifetimeHours,
+		"leagueCode":                t.Settings.LeagueCode,
+		"timeLimitMinutes":          t.Settings.TimeLimitMinutes,
+		"graceMinutes":              t.Settings.GraceMinutes,
+		"constraints":               t.Settings.Constraints,
+		"constraintsPerParticipant": t.Settings.ConstraintsPerParticipant,
+		"normalizeListening":        t.Settings.NormalizeListening,
+		"hasPassword":               t.Settings.PasswordHash != "",
+		"createdAt":                 t.CreatedAt,
+	}
+}
+
+// listTemplates returns the owner's templates, oldest first so the dropdown doesn't reshuffle
+func (s *Server) listTemplates(owner string) ([]*RoundTemplate, error) {
+	stored, err := s.db.HGetAll(ctx, templatesKey(owner)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]*RoundTemplate, 0, len(stored))
+	for _, data := range stored {
+		var template RoundTemplate
+		if err := json.Unmarshal([]byte(data), &template); err != nil {
+			log.Printf("Skipping unreadable template for %s: %v", owner, err)
+			continue
+		}
+		templates = append(templates, &template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].CreatedAt.Before(templates[j].CreatedAt)
+	})
+	return templates, nil
+}
+
+// settingsFromRound is round.settings() with the lifetime pulled back under today's maximum, since extensions can push it past
+func (s *Server) settingsFromRound(round *Round) RoundSettings {
+	settings := round.settings()
+	if maxHours := int(s.cfg.MaxRoundLifetime.Hours()); settings.LifetimeHours > maxHours {
+		settings.LifetimeHours = maxHours
+	}
+	return settings
+}
+
+// handleSaveTemplate saves the settings of a round the requester is hosting
+func (s *Server) handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Label string `json:"label"` // optional; defaults to the round name
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if session.ParticipantID != round.HostID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can save this round as a template",
+		})
+		return
+	}
+
+	owner := s.templateOwner(w, r)
+	count, err := s.db.HLen(ctx, templatesKey(owner)).Result()
+	if err != nil {
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxTemplatesPerOwner {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You have too many templates saved. Delete some first",
+		})
+		return
+	}
+
+	label := strings.TrimSpace(req.Label)
+	if label == "" {
+		label = round.Name
+	}
+	template := &RoundTemplate{
+		ID:        uuid.New().String(),
+		Label:     label,
+		Settings:  s.settingsFromRound(&round),
+		CreatedAt: time.Now(),
+	}
+
+	templateData, err := json.Marshal(template)
+	if err != nil {
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.HSet(ctx, templatesKey(owner), template.ID, templateData).Err(); err != nil {
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Saved round %s as template %q", code, template.Label)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"template": template.public(),
+		"message":  "Template saved. You'll find it on the home page",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleSaveTemplate; err: %v", err)
+	}
+}
+
+// handleListTemplates returns the requester's templates
+func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := s.listTemplates(s.templateOwner(w, r))
+	if err != nil {
+		http.Error(w, "Failed to get templates", http.StatusInternalServerError)
+		return
+	}
+
+	public := make([]map[string]interface{}, 0, len(templates))
+	for _, template := range templates {
+		public = append(public, template.public())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"templates": public,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleListTemplates; err: %v", err)
+	}
+}
+
+// handleDeleteTemplate removes one of the requester's templates
+func (s *Server) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	removed, err := s.db.HDel(ctx, templatesKey(s.templateOwner(w, r)), vars["id"]).Result()
+	if err != nil {
+		http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		return
+	}
+	if removed == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Template deleted",
+	}); err != nil {
+		log.Printf("Failed to encode json for handleDeleteTemplate; err: %v", err)
+	}
+}
+
+// handleCreateFromTemplate starts a new round from a saved template, like handleCreateRound without the form
+func (s *Server) handleCreateFromTemplate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var req struct {
+		HostName string `json:"hostName"`
+		Name     string `json:"name"` // optional; overrides the template's round name (e.g. "Week 12")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	templateData, err := s.db.HGet(ctx, templatesKey(s.templateOwner(w, r)), vars["id"]).Result()
+	if err == redis.Nil {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get template", http.StatusInternalServerError)
+		return
+	}
+
+	var template RoundTemplate
+	if err := json.Unmarshal([]byte(templateData), &template); err != nil {
+		http.Error(w, "Failed to parse template", http.StatusInternalServerError)
+		return
+	}
+
+	settings := template.Settings
+	if name := strings.TrimSpace(req.Name); name != "" {
+		settings.Name = name
+	}
+
+	round := s.startRound(w, r, settings, req.HostName)
+	if round == nil {
+		return
+	}
+
+	log.Printf("Round %s created from template %q", round.JoinCode, template.Label)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"code":     round.JoinCode,
+		"roundId":  round.ID,
+		"hostName": req.HostName,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleCreateFromTemplate; err: %v", err)
+	}
+}
+
+/*
+handleCloneRound runs a closed round back: a new round with the same settings and the same host. It works on the
+live round (host recognised by their session) and, once that's expired, on the archived copy (host recognised by
+their account, the same way the archive page does it). Archived rounds don't keep their password, so a clone of one
+starts without.
+*/
+func (s *Server) handleCloneRound(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		Name               string `json:"name"`               // optional; defaults to the old round's name
+		InviteParticipants bool   `json:"inviteParticipants"` // make an invite for everyone else who was in it
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var source *Round
+	isHost := false
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		account := s.getAccount(r)
+		archived := s.lookupArchive(w, code, account)
+		if archived == nil {
+			return
+		}
+		source = &archived.Round
+		isHost = archived.canClone(account)
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	} else {
+		source = &Round{}
+		if err := json.Unmarshal([]byte(roundData), source); err != nil {
+			http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+			return
+		}
+		session := s.getSession(r)
+		isHost = session != nil && session.RoundCode == code && session.ParticipantID == source.HostID
+	}
+
+	if !isHost {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Only the host can run this round again",
+		})
+		return
+	}
+
+	if source.State != StateClosed {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Close the round before running it back",
+		})
+		return
+	}
+
+	settings := s.settingsFromRound(source)
+	if name := strings.TrimSpace(req.Name); name != "" {
+		settings.Name = name
+	}
+
+	hostName := ""
+	if host, exists := source.Participants[source.HostID]; exists {
+		hostName = host.DisplayName
+	}
+
+	round := s.startRound(w, r, settings, hostName)
+	if round == nil {
+		return
+	}
+
+	invited := 0
+	if req.InviteParticipants {
+		round.Invites = make(map[string]*Invite)
+		people := source.Participants
+		if source.Bracket != nil {
+			people = source.Bracket.Players // the final only has two players left; invite the whole field back
+		}
+		for id, participant := range people {
+			if id == source.HostID {
+				continue
+			}
+			invite := &Invite{
+				Token:     generateInviteToken(),
+				Label:     participant.DisplayName,
+				CreatedAt: time.Now(),
+			}
+			round.Invites[invite.Token] = invite
+		}
+		invited = len(round.Invites)
+
+		// The round is already saved and the host is in it, so a failure here only loses the invites
+		if err := s.saveRound(round); err != nil {
+			log.Printf("Failed to save invites for cloned round %s: %v", round.JoinCode, err)
+			invited = 0
+		}
+	}
+
+	log.Printf("Round %s cloned from %s (%d invites)", round.JoinCode, code, invited)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"code":     round.JoinCode,
+		"roundId":  round.ID,
+		"hostName": hostName,
+		"invited":  invited,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleCloneRound; err: %v", err)
+	}
+}
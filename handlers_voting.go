@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net/http"               // For HTTP server and client funcionality
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+handleVote records (or changes) the caller's vote while the round is in the voting state. Everyone gets exactly one
+vote, stored as voter ID -> participant ID, so voting again simply moves it. Participants and judges can always vote;
+spectators only when the host has switched SpectatorsCanVote on.
+
+Tournament stages vote per match instead: a vote names the match as well as the player, each voter gets one vote in
+every match, and nobody votes in their own match.
+*/
+func (s *Server) handleVote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var req struct {
+		ParticipantID string `json:"participantId"` // whose entry the vote is for
+		MatchID       string `json:"matchId"`       // tournament mode only
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session := s.getSession(r)
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Round not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get round", http.StatusInternalServerError)
+		return
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		http.Error(w, "Failed to parse round data", http.StatusInternalServerError)
+		return
+	}
+
+	if round.State != StateVoting {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Voting isn't open right now",
+		})
+		return
+	}
+
+	// Work out whether this caller gets a vote at all
+	if session.Spectator {
+		if _, isSpectator := round.Spectators[session.ParticipantID]; !isSpectator || !round.SpectatorsCanVote {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Spectators can't vote in this round",
+			})
+			return
+		}
+	} else if _, isParticipant := round.Participants[session.ParticipantID]; !isParticipant {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You are not a participant in this round",
+		})
+		return
+	}
+
+	if req.ParticipantID == session.ParticipantID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You can't vote for your own entry",
+		})
+		return
+	}
+
+	if _, hasSubmitted := round.Submissions[req.ParticipantID]; !hasSubmitted {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "That entry doesn't exist",
+		})
+		return
+	}
+
+	if round.Bracket != nil {
+		s.castMatchVote(w, &round, session.ParticipantID, req.MatchID, req.ParticipantID)
+		return
+	}
+
+	if round.Votes == nil {
+		round.Votes = make(map[string]string)
+	}
+	_, changedVote := round.Votes[session.ParticipantID]
+	round.Votes[session.ParticipantID] = req.ParticipantID
+
+	if err := s.saveRound(&round); err != nil {
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Vote cast!"
+	if changedVote {
+		message = "Vote changed!"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"votedFor":  req.ParticipantID,
+		"voteCount": len(round.Votes),
+		"message":   message,
+	}); err != nil {
+		log.Printf("Failed to encode json for handleVote; err: %v", err)
+	}
+}
+
+// castMatchVote is handleVote for a tournament stage, once the voter and the entry have been checked
+func (s *Server) castMatchVote(w http.ResponseWriter, round *Round, voterID string, matchID string, votedFor string) {
+	match := round.Bracket.match(matchID)
+	if match == nil || match.PlayerB == "" || (votedFor != match.PlayerA && votedFor != match.PlayerB) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "That entry isn't in this match",
+		})
+		return
+	}
+
+	if voterID == match.PlayerA || voterID == match.PlayerB {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "You can't vote in your own match",
+		})
+		return
+	}
+
+	if round.MatchVotes == nil {
+		round.MatchVotes = make(map[string]map[string]string)
+	}
+	if round.MatchVotes[matchID] == nil {
+		round.MatchVotes[matchID] = make(map[string]string)
+	}
+	_, changedVote := round.MatchVotes[matchID][voterID]
+	round.MatchVotes[matchID][voterID] = votedFor
+
+	if err := s.saveRound(round); err != nil {
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Vote cast!"
+	if changedVote {
+		message = "Vote changed!"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"matchId":   matchID,
+		"votedFor":  votedFor,
+		"voteCount": len(round.MatchVotes[matchID]),
+		"message":   message,
+	}); err != nil {
+		log.Printf("Failed to encode json for castMatchVote; err: %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log" // For Logging errors and info messages
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Background jobs
+
+The slow part of an upload (decoding it, working out tempo, key and loudness, making the preview and listening copy,
+checking it against the sample) runs as a job, so handleUpload answers as soon as the file is on disk. Jobs live in Redis rather than in a Go channel: a job
+that hasn't run yet survives a restart, and several instances sharing one Redis share the work too.
+
+  - jobs:queue is a list of jobs waiting their turn. New jobs go on the front and workers take from the back.
+  - jobs:running is a sorted set of the jobs being worked on, scored by when their lease runs out. If a worker dies
+    mid-job (a crash, a kill -9), the job goes back in line once the lease is up.
+  - jobs:retry is a sorted set of jobs that failed, scored by when to try again. The wait doubles every time (5s, 10s,
+    20s) and we give up after maxJobAttempts tries. Failures that retrying can't fix, like a corrupt file, fail right
+    away, and so does a job that panics, which is logged rather than taking the server down.
+
+Claiming a job is a single script (jobClaimScript), so two workers can never get the same one. How each upload is
+getting on is kept on the round as a JobStatus (pending, processing, done or failed), which the round page and the
+info API show.
+
+On shutdown main cancels the workers' context. Idle workers stop right away, busy ones finish the job they're on, and
+main waits for them before closing Redis.
+*/
+
+type JobState string
+
+const (
+	JobPending    JobState = "pending" // in line, or waiting to be retried
+	JobProcessing JobState = "processing"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed" // gave up; the upload itself is fine, it just goes without analysis
+)
+
+// JobStatus is how the background work on one upload is getting on
+type JobStatus struct {
+	State     JobState  `json:"state"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Error     string    `json:"error,omitempty"` // why the last attempt failed
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func newJobStatus() *JobStatus {
+	return &JobStatus{State: JobPending, UpdatedAt: time.Now()}
+}
+
+const (
+	jobQueueKey   = "jobs:queue"
+	jobRunningKey = "jobs:running"
+	jobRetryKey   = "jobs:retry"
+
+	maxJobAttempts  = 4
+	jobRetryBackoff = 5 * time.Second // doubled after every failed attempt
+	maxJobBackoff   = 5 * time.Minute
+	jobLease        = 10 * time.Minute // far longer than any job takes; after this the worker is presumed dead
+	jobPollInterval = 2 * time.Second  // how often idle workers check for jobs queued by other instances
+)
+
+// uploadJob is the work to do on one uploaded file; it sits in Redis as JSON
+type uploadJob struct {
+	ID         string `json:"id"` // keeps two otherwise identical jobs apart in the sorted sets
+	Code       string `json:"code"`
+	RoundID    string `json:"roundId"`
+	Filename   string `json:"filename"`
+	LevelMatch bool   `json:"levelMatch"`
+	Sample     bool   `json:"sample,omitempty"`     // it's the round's sample: fingerprint it (see fingerprint.go)
+	CheckUsage bool   `json:"checkUsage,omitempty"` // it's an entry in a sample round: compare it with the sample
+	Attempt    int    `json:"attempt"`              // failed tries so far
+}
+
+// permanentJobError is a failure that trying again won't fix, so the job fails without using up its retries
+type permanentJobError struct {
+	error
+}
+
+/*
+jobClaimScript first puts due retries and jobs with expired leases back in line (at the back end, since they've
+waited already), then takes the next job and leases it. Like the rate limiter it uses Redis' clock, so instances
+with slightly different clocks still agree on when a lease is up.
+*/
+var jobClaimScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+for _, key in ipairs({KEYS[2], KEYS[3]}) do
+	for _, job in ipairs(redis.call('ZRANGEBYSCORE', key, '-inf', now)) do
+		redis.call('ZREM', key, job)
+		redis.call('RPUSH', KEYS[1], job)
+	end
+end
+
+local job = redis.call('RPOP', KEYS[1])
+if job then
+	redis.call('ZADD', KEYS[3], now + tonumber(ARGV[1]), job)
+end
+return job
+`)
+
+// jobRetryScript moves a failed job from running to retry in one go, so it can't be lost in between
+var jobRetryScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[3]), ARGV[2])
+return 1
+`)
+
+/*
+enqueueUpload queues the background work for a file that has just been saved. The caller sets the pending JobStatus
+on the round before saving it; if the job can't be queued, that status is turned into a failure.
+*/
+func (s *Server) enqueueUpload(job uploadJob) {
+	job.ID = uuid.NewString()
+	payload, err := json.Marshal(job)
+	if err == nil {
+		err = s.db.LPush(ctx, jobQueueKey, payload).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to queue processing of %s in round %s: %v", job.Filename, job.Code, err)
+		s.setJobStatus(job.Code, job.Filename, &JobStatus{State: JobFailed, Error: "couldn't be queued", UpdatedAt: time.Now()})
+		return
+	}
+
+	// Nudge an idle worker here so the job starts now rather than at its next poll
+	select {
+	case s.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobWorkers starts cfg.JobWorkers workers; the WaitGroup is done once they've all stopped after jobsCtx ends
+func (s *Server) startJobWorkers(jobsCtx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for range s.cfg.JobWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJobWorker(jobsCtx)
+		}()
+	}
+	return &wg
+}
+
+/*
+runJobWorker takes jobs one at a time until jobsCtx is cancelled. The Redis calls use the global ctx rather than
+jobsCtx, so a job that's already started gets to finish.
+*/
+func (s *Server) runJobWorker(jobsCtx context.Context) {
+	for jobsCtx.Err() == nil {
+		payload, err := jobClaimScript.Run(ctx, s.db, []string{jobQueueKey, jobRetryKey, jobRunningKey},
+			jobLease.Milliseconds()).Text()
+		if err == nil {
+			s.runJob(payload)
+			continue // there may be more waiting
+		}
+		if err != redis.Nil {
+			log.Printf("Failed to claim a job: %v", err)
+		}
+
+		select {
+		case <-jobsCtx.Done():
+		case <-s.jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// runJob does one claimed job, then either retires it or puts it in line for a retry
+func (s *Server) runJob(payload string) {
+	defer s.db.ZRem(ctx, jobRunningKey, payload) // a no-op when it's been moved to retry
+
+	var job uploadJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		log.Printf("Dropping unreadable job %q: %v", payload, err)
+		return
+	}
+
+	processing := &JobStatus{State: JobProcessing, Attempts: job.Attempt + 1, UpdatedAt: time.Now()}
+	if found, err := s.setJobStatus(job.Code, job.Filename, processing); err == nil && !found {
+		return // the file was replaced or the round is over; nobody wants the result
+	}
+
+	err := s.processUploadSafely(job)
+	if err == nil {
+		return
+	}
+
+	job.Attempt++
+	var permanent permanentJobError
+	if job.Attempt >= maxJobAttempts || errors.As(err, &permanent) {
+		log.Printf("Gave up processing %s in round %s after %d attempt(s): %v", job.Filename, job.Code, job.Attempt, err)
+		s.setJobStatus(job.Code, job.Filename,
+			&JobStatus{State: JobFailed, Attempts: job.Attempt, Error: jobErrorText(err), UpdatedAt: time.Now()})
+		return
+	}
+
+	delay := min(jobRetryBackoff<<(job.Attempt-1), maxJobBackoff)
+	log.Printf("Processing %s in round %s failed, retrying in %s: %v", job.Filename, job.Code, delay, err)
+	s.setJobStatus(job.Code, job.Filename,
+		&JobStatus{State: JobPending, Attempts: job.Attempt, Error: jobErrorText(err), UpdatedAt: time.Now()})
+
+	retry, err := json.Marshal(job)
+	if err == nil {
+		err = jobRetryScript.Run(ctx, s.db, []string{jobRunningKey, jobRetryKey}, payload, retry, delay.Milliseconds()).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to schedule a retry for %s in round %s: %v", job.Filename, job.Code, err)
+	}
+}
+
+/*
+processUploadSafely is processUpload with a panic turned into a permanent failure. A file that crashes a decoder
+would crash it again on every retry, and left to run its course it would take the whole server down with it and
+then, once the lease ran out, the next one to pick it up.
+*/
+func (s *Server) processUploadSafely(job uploadJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Processing %s in round %s panicked: %v\n%s", job.Filename, job.Code, r, debug.Stack())
+			err = permanentJobError{fmt.Errorf("the file couldn't be processed")}
+		}
+	}()
+	return s.processUpload(job)
+}
+
+// jobErrorText is the error as shown to players; file errors lose their path so the upload folder isn't given away
+func jobErrorText(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+/*
+updateUpload calls update for everything in the round that uses the file (submission is nil for the sample; in
+telephone mode one file can be both) and saves it through updateRound, so nothing else saved meanwhile is lost.
+Returns false, without saving, when nothing uses the file any more because it was replaced or the round has ended.
+*/
+func (s *Server) updateUpload(code string, filename string, update func(round *Round, submission *Submission)) (bool, error) {
+	round, err := s.updateRound(code, func(round *Round) error {
+		found := false
+		if round.SampleFileID == filename {
+			update(round, nil)
+			found = true
+		}
+		for _, submission := range round.Submissions {
+			if submission.Filename == filename {
+				update(round, submission)
+				found = true
+			}
+		}
+		if !found {
+			return errUploadGone
+		}
+		return nil
+	})
+	if err == errUploadGone {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return round != nil, nil
+}
+
+var errUploadGone = errors.New("nothing in the round uses the file any more")
+
+/*
+keepUploadResults copies what the job workers have recorded in current (the round as it is in Redis) onto r, for every
+file r still has. Only the workers change those fields on a file once it's in, so current's are never older. Duplicate
+warnings are kept only while the entry they point at is still the same file.
+*/
+func (r *Round) keepUploadResults(current *Round) {
+	if r.SampleFileID != "" && r.SampleFileID == current.SampleFileID {
+		r.SampleJob, r.SampleAnalysis = current.SampleJob, current.SampleAnalysis
+		r.SamplePreview, r.SamplePrint = current.SamplePreview, current.SamplePrint
+	}
+
+	sameFile := func(participantID string) bool {
+		mine, stored := r.Submissions[participantID], current.Submissions[participantID]
+		return mine != nil && stored != nil && mine.Filename == stored.Filename
+	}
+	for participantID, submission := range r.Submissions {
+		if !sameFile(participantID) {
+			continue
+		}
+		stored := current.Submissions[participantID]
+		submission.Job, submission.Analysis, submission.Preview = stored.Job, stored.Analysis, stored.Preview
+		submission.ListeningCopy, submission.ListeningGain = stored.ListeningCopy, stored.ListeningGain
+		submission.Print, submission.SampleMatch = stored.Print, stored.SampleMatch
+		submission.Duplicates = nil
+		for _, warning := range stored.Duplicates {
+			if warning.ParticipantID == "" || sameFile(warning.ParticipantID) {
+				submission.Duplicates = append(submission.Duplicates, warning)
+			}
+		}
+	}
+}
+
+// getRound loads a round for the workers, or returns nil if it's over
+func (s *Server) getRound(code string) (*Round, error) {
+	roundData, err := s.db.Get(ctx, roundKey(code)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var round Round
+	if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+		return nil, err
+	}
+	return &round, nil
+}
+
+// setJobStatus records how the job on a file is getting on; failures to save are logged, since the job carries on
+func (s *Server) setJobStatus(code string, filename string, status *JobStatus) (bool, error) {
+	found, err := s.updateUpload(code, filename, func(round *Round, submission *Submission) {
+		if submission == nil {
+			round.SampleJob = status
+		} else {
+			submission.Job = status
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to save job status of %s in round %s: %v", filename, code, err)
+	}
+	return found, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestKeepUploadResults(t *testing.T) {
+	done := &JobStatus{State: JobDone}
+	stored := &Round{
+		SampleFileID: "sample.wav",
+		SampleJob:    done,
+		SamplePrint:  "sample.print",
+		Submissions: map[string]*Submission{
+			"a": {ParticipantID: "a", Filename: "a.wav", Job: done, Print: "a.print", Duplicates: []DuplicateWarning{
+				{Kind: DuplicateExact, ParticipantID: "b"},
+				{Kind: DuplicateExact, ParticipantID: "c"},
+				{Kind: DuplicateExact, EarlierRound: "ABC123"},
+			}},
+			"b": {ParticipantID: "b", Filename: "b-old.wav", Job: done},
+			"c": {ParticipantID: "c", Filename: "c.wav", Job: done},
+		},
+	}
+
+	// A handler loaded the round before the jobs finished; since then b replaced their entry and c's was removed
+	pending := newJobStatus()
+	round := &Round{
+		SampleFileID: "sample.wav",
+		SampleJob:    pending,
+		Submissions: map[string]*Submission{
+			"a": {ParticipantID: "a", Filename: "a.wav", Job: pending},
+			"b": {ParticipantID: "b", Filename: "b-new.wav", Job: pending},
+		},
+	}
+	round.keepUploadResults(stored)
+
+	if round.SampleJob != done || round.SamplePrint != "sample.print" {
+		t.Error("the sample's results were lost")
+	}
+	a := round.Submissions["a"]
+	if a.Job != done || a.Print != "a.print" {
+		t.Error("a's results were lost")
+	}
+	if len(a.Duplicates) != 1 || a.Duplicates[0].EarlierRound != "ABC123" {
+		t.Errorf("a kept warnings %+v, want only the one about an earlier round", a.Duplicates)
+	}
+	if round.Submissions["b"].Job != pending {
+		t.Error("b's new file got the old file's results")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log" // For Logging errors and info messages
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Build-up mode
+
+Telephone passes one finished remix down the line; build-up passes a growing multitrack instead. Everyone (except
+judges) takes a turn in the order they joined: download every stem laid down so far, make exactly one new stem that
+sits on top of them, and upload it. The stems are kept in order on Round.Layers, each credited to whoever made it.
+
+Every layer is also its owner's Submission, so voting, history and the archive work as they do in other modes. A
+layer can be swapped for a new take until the next person builds on it; after that it's part of the track for good,
+even if its owner leaves or gets kicked (the next layers were made against it). If the person whose turn it is goes
+quiet, the host can kick them and the turn moves on.
+*/
+
+const maxLayerCreditLength = 60
+
+// Layer is one stem in a build-up round; its number is its position in Round.Layers plus one
+type Layer struct {
+	ParticipantID string    `json:"participantId"`
+	DisplayName   string    `json:"displayName"` // kept here so the credits survive the person leaving
+	Credit        string    `json:"credit"`      // what they added, e.g. "bassline" or "vocal chops"
+	Filename      string    `json:"filename"`
+	OriginalName  string    `json:"originalName"`
+	AddedAt       time.Time `json:"addedAt"`
+}
+
+// layerBy finds the participant's layer and its index, or -1 if they haven't added one
+func (r *Round) layerBy(participantID string) (*Layer, int) {
+	for i, layer := range r.Layers {
+		if layer.ParticipantID == participantID {
+			return layer, i
+		}
+	}
+	return nil, -1
+}
+
+// nextLayerBy is whose turn it is: the earliest-joined non-judge who hasn't added a layer yet (nil once everyone has)
+func (r *Round) nextLayerBy() *Participant {
+	var next *Participant
+	for _, participant := range r.Participants {
+		if participant.role() == RoleJudge {
+			continue
+		}
+		if layer, _ := r.layerBy(participant.ID); layer != nil {
+			continue
+		}
+		if next == nil || participant.JoinedAt.Before(next.JoinedAt) {
+			next = participant
+		}
+	}
+	return next
+}
+
+/*
+checkLayerTurn says whether the participant can upload a layer right now. Replacing means they're swapping the top
+layer for a new take. Returns an error message for the participant otherwise.
+*/
+func (r *Round) checkLayerTurn(participantID string) (replacing bool, errMsg string) {
+	if _, index := r.layerBy(participantID); index >= 0 {
+		if index != len(r.Layers)-1 {
+			return false, "Someone has already built on your layer, so it can't be swapped now"
+		}
+		return true, ""
+	}
+
+	next := r.nextLayerBy()
+	switch {
+	case next == nil:
+		return false, "Everyone has added their layer"
+	case next.ID != participantID && len(r.Layers) == 0:
+		return false, fmt.Sprintf("%s lays down the first layer", next.DisplayName)
+	case next.ID != participantID:
+		return false, fmt.Sprintf("It's %s's turn to add a layer", next.DisplayName)
+	}
+	return false, ""
+}
+
+// addLayer puts the participant's stem on top of the stack, or swaps their top layer for a new take
+func (r *Round) addLayer(participant *Participant, submission *Submission, credit string) *Layer {
+	layer := &Layer{
+		ParticipantID: participant.ID,
+		DisplayName:   participant.DisplayName,
+		Credit:        cleanLayerCredit(credit),
+		Filename:      submission.Filename,
+		OriginalName:  submission.OriginalName,
+		AddedAt:       submission.UploadedAt,
+	}
+	if _, index := r.layerBy(participant.ID); index >= 0 {
+		if layer.Credit == "" {
+			layer.Credit = r.Layers[index].Credit // a new take of the same part
+		}
+		r.Layers[index] = layer
+	} else {
+		r.Layers = append(r.Layers, layer)
+	}
+	return layer
+}
+
+// cleanLayerCredit tidies what the uploader typed; it ends up in file names in the stems ZIP, so no folders in it
+func cleanLayerCredit(credit string) string {
+	credit = strings.TrimSpace(entryNamePart(credit))
+	if runes := []rune(credit); len(runes) > maxLayerCreditLength {
+		credit = strings.TrimSpace(string(runes[:maxLayerCreditLength])) // cut by characters, not mid-way through one
+	}
+	return credit
+}
+
+/*
+dropLayer is for someone leaving or being removed: their layer goes with them if it's still on top, otherwise it
+stays in the track. Returns true when the layer stays, so the caller keeps the file.
+*/
+func (r *Round) dropLayer(participantID string) bool {
+	_, index := r.layerBy(participantID)
+	if index < 0 {
+		return false
+	}
+	if index == len(r.Layers)-1 {
+		r.Layers = r.Layers[:index]
+		return false
+	}
+	return true
+}
+
+// layerZipName is a layer's file name inside a ZIP, numbered so the stems sort in the order they were stacked
+func layerZipName(number int, layer *Layer) string {
+	name := fmt.Sprintf("%02d_%s", number, entryNamePart(layer.DisplayName))
+	if layer.Credit != "" {
+		name += "_" + entryNamePart(layer.Credit) // credits saved before they were cleaned of slashes
+	}
+	return name + filepath.Ext(layer.OriginalName)
+}
+
+// layerCredits is the credits.txt that goes in with the stems
+func layerCredits(round *Round) string {
+	var credits strings.Builder
+	fmt.Fprintf(&credits, "%s\n\n", round.Name)
+	for i, layer := range round.Layers {
+		part := layer.Credit
+		if part == "" {
+			part = "untitled layer"
+		}
+		fmt.Fprintf(&credits, "Layer %d: %s by %s (%s)\n", i+1, part, layer.DisplayName, layer.AddedAt.Format("Jan 2, 15:04"))
+	}
+	return credits.String()
+}
+
+// layerExportFiles lists the layers as they go into a ZIP under dir, in the order they were stacked
+func layerExportFiles(round *Round, dir string) []exportFile {
+	files := make([]exportFile, 0, len(round.Layers))
+	for i, layer := range round.Layers {
+		tags := &trackTags{
+			Title:   layer.Credit,
+			Artist:  layer.DisplayName,
+			Album:   round.Name,
+			Track:   i + 1,
+			Tracks:  len(round.Layers),
+			Comment: exportComment(round),
+		}
+		if tags.Title == "" {
+			tags.Title = fmt.Sprintf("Layer %d", i+1)
+		}
+		files = append(files, exportFile{
+			Kind:          "layer",
+			Filename:      layer.Filename,
+			Path:          dir + layerZipName(i+1, layer),
+			ParticipantID: layer.ParticipantID,
+			Submission:    round.Submissions[layer.ParticipantID], // nil once they've left
+			Layer:         layer,
+			Tags:          tags,
+		})
+	}
+	return files
+}
+
+/*
+sendStemsZip is the "download everything so far" for whoever's turn it is (and anyone else following along). Works
+like sendExport but only ever has the layers in it.
+*/
+func sendStemsZip(w http.ResponseWriter, round *Round, pathFor func(filename string) string) (int, error) {
+	if len(round.Layers) == 0 {
+		http.Error(w, "No layers yet; the first person starts from scratch", http.StatusNotFound)
+		return 0, fmt.Errorf("no layers")
+	}
+
+	buf := new(bytes.Buffer)
+	out := newExportWriter(exportZip, buf)
+	count := addExportFiles(out, layerExportFiles(round, ""), pathFor)
+	addTextToExport(out, "credits.txt", layerCredits(round))
+	if err := out.close(); err != nil {
+		http.Error(w, "Failed to create zip file", http.StatusInternalServerError)
+		return 0, err
+	}
+
+	zipFilename := fmt.Sprintf("%s_stems_%d_layers.zip", round.Name, len(round.Layers))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", zipFilename))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Failed to send stems zip: %v", err)
+		return count, err
+	}
+	return count, nil
+}
+
+// layerView is one row of the layer stack on the round page
+type layerView struct {
+	Number int
+	Layer  *Layer
+	IsTop  bool
+}
+
+// layersForPage lists the layers newest first, like a track stack with the latest stem on top
+func layersForPage(round *Round) []layerView {
+	layers := make([]layerView, 0, len(round.Layers))
+	for i := len(round.Layers) - 1; i >= 0; i-- {
+		layers = append(layers, layerView{Number: i + 1, Layer: round.Layers[i], IsTop: i == len(round.Layers)-1})
+	}
+	return layers
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanLayerCredit(t *testing.T) {
+	tests := []struct {
+		credit string
+		want   string
+	}{
+		{"  bass  ", "bass"},
+		{"vocal/chops", "vocal-chops"},
+		{"/../../x", "-.-.-x"},
+		{`..\..\x`, ".-.-x"},
+		{"pad\x00\n", "pad"},
+	}
+	for _, test := range tests {
+		if got := cleanLayerCredit(test.credit); got != test.want {
+			t.Errorf("cleanLayerCredit(%q) = %q, want %q", test.credit, got, test.want)
+		}
+	}
+
+	// Cut by characters: 59 letters then a two-byte one is exactly the limit, and stays valid UTF-8
+	long := cleanLayerCredit(strings.Repeat("a", maxLayerCreditLength-1) + "éé")
+	if !utf8.ValidString(long) || utf8.RuneCountInString(long) != maxLayerCreditLength {
+		t.Errorf("long credit cut to %q", long)
+	}
+}
+
+func TestLayerZipNameStaysInItsFolder(t *testing.T) {
+	layer := &Layer{DisplayName: "../Sam", Credit: "../../etc/x", OriginalName: "take.wav"}
+	name := layerZipName(3, layer)
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		t.Errorf("layerZipName gave %q", name)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log" // For Logging errors and info messages
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Leagues
+
+A league groups a crew's rounds into a season with a running leaderboard. Each round created for a league (the host
+picks it on the create form, and templates/clones carry it over) adds its results to the league when it's closed.
+
+Rounds come and go, but league members stick around: the first time someone places in a league round they get a
+LeagueMember, and after that they're recognised by their account if they were logged in, or by their display name if
+they were a guest. When a guest shows up under two names (or plays once as a guest and once logged in) the league
+owner can merge the two members.
+
+Only placements are stored, never points. Standings are worked out from the points table every time, so the owner can
+change how many points a win is worth halfway through a season and the whole leaderboard follows.
+*/
+
+var defaultLeaguePoints = []int{10, 8, 6, 4, 2}
+
+const (
+	defaultParticipationPoints = 1
+	maxLeaguePlaces            = 20 // the most places the points table can cover
+)
+
+type League struct {
+	Code                string                   `json:"code"`
+	Name                string                   `json:"name"`
+	OwnerID             string                   `json:"ownerId"`             // account that created it
+	Points              []int                    `json:"points"`              // points for 1st, 2nd, 3rd...
+	ParticipationPoints int                      `json:"participationPoints"` // for an entry placed below the table, or in a round nobody voted in
+	Members             map[string]*LeagueMember `json:"members"`
+	Rounds              []*LeagueRound           `json:"rounds"` // oldest first
+	CreatedAt           time.Time                `json:"createdAt"`
+}
+
+// LeagueMember is one person across every round of the league
+type LeagueMember struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"displayName"`      // whatever they called themselves most recently
+	UserID      string    `json:"userId,omitempty"` // empty for guests, who are matched by name instead
+	JoinedAt    time.Time `json:"joinedAt"`
+}
+
+// LeagueRound is a closed round's results, as far as the league cares
+type LeagueRound struct {
+	RoundID  string         `json:"roundId"`
+	JoinCode string         `json:"joinCode"`
+	Name     string         `json:"name"`
+	ClosedAt time.Time      `json:"closedAt"`
+	Results  []LeagueResult `json:"results"`
+}
+
+type LeagueResult struct {
+	MemberID string `json:"memberId"`
+	Place    int    `json:"place"` // 0 when nobody voted, so there was no real ranking
+	Votes    int    `json:"votes"`
+}
+
+// Standing is one row of the leaderboard
+type Standing struct {
+	Place       int    `json:"place"`
+	MemberID    string `json:"memberId"`
+	DisplayName string `json:"displayName"`
+	Points      int    `json:"points"`
+	Rounds      int    `json:"rounds"`
+	Wins        int    `json:"wins"`
+}
+
+func leagueKey(code string) string {
+	return "league:" + code
+}
+
+// userLeaguesKey is a set of the league codes an account owns or is a member of
+func userLeaguesKey(userID string) string {
+	return "userleagues:" + userID
+}
+
+// getLeague loads a league, or returns nil if there's no league with this code
+func (s *Server) getLeague(code string) (*League, error) {
+	leagueData, err := s.db.Get(ctx, leagueKey(code)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var league League
+	if err := json.Unmarshal([]byte(leagueData), &league); err != nil {
+		return nil, err
+	}
+	if league.Members == nil {
+		league.Members = make(map[string]*LeagueMember)
+	}
+	return &league, nil
+}
+
+// saveLeague writes the league back; leagues don't expire, a season can run as long as the crew keeps playing
+func (s *Server) saveLeague(league *League) error {
+	leagueData, err := json.Marshal(league)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(ctx, leagueKey(league.Code), leagueData, 0).Err()
+}
+
+var errLeagueRefused = errors.New("league change refused")
+
+/*
+updateLeague loads the league, lets update change it and saves it under a WATCH, running update again on a fresh copy
+if anything else saved the league in between; a round closing at the same moment as the owner merging members
+mustn't lose either. Returns nil if there's no such league. If update returns an error nothing is saved.
+*/
+func (s *Server) updateLeague(code string, update func(league *League) error) (*League, error) {
+	key := leagueKey(code)
+	for attempt := 0; attempt < maxRoundUpdateAttempts; attempt++ {
+		var updated *League
+		err := s.db.Watch(ctx, func(tx *redis.Tx) error {
+			leagueData, err := tx.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			var league League
+			if err := json.Unmarshal([]byte(leagueData), &league); err != nil {
+				return err
+			}
+			if league.Members == nil {
+				league.Members = make(map[string]*LeagueMember)
+			}
+			if err := update(&league); err != nil {
+				return err
+			}
+			record, err := json.Marshal(&league)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, record, 0)
+				return nil
+			}); err != nil {
+				return err
+			}
+			updated = &league
+			return nil
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return updated, nil
+	}
+	return nil, errors.New("the league kept changing while saving")
+}
+
+// public is the league as anyone with its code gets to see it: no account IDs
+func (l *League) public() *League {
+	copied := *l
+	copied.OwnerID = ""
+	copied.Members = make(map[string]*LeagueMember, len(l.Members))
+	for id, member := range l.Members {
+		memberCopy := *member
+		memberCopy.UserID = ""
+		copied.Members[id] = &memberCopy
+	}
+	return &copied
+}
+
+// pointsFor is what a place is worth under the league's current table
+func (l *League) pointsFor(place int) int {
+	if place >= 1 && place <= len(l.Points) {
+		return l.Points[place-1]
+	}
+	return l.ParticipationPoints
+}
+
+// canHost reports whether an account may create rounds for the league: the owner, or anyone who's played in it logged in
+func (l *League) canHost(account *User) bool {
+	if account == nil {
+		return false
+	}
+	if account.ID == l.OwnerID {
+		return true
+	}
+	for _, member := range l.Members {
+		if member.UserID == account.ID {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+memberFor finds (or adds) the league member a round participant is. Accounts are matched by user ID, and guests by
+name against other guest members. The two never cross: a name is all anyone needs to type, so an account doesn't
+get to take over a guest's points and history by using the same one. If they really are the same person, the league
+owner merges them. taken is the members already placed in this round: two guests there under the same name are two
+people, so the second one can't be matched to the first one's member and gets a new one.
+*/
+func (l *League) memberFor(participant *Participant, taken map[string]bool) *LeagueMember {
+	name := strings.TrimSpace(participant.DisplayName)
+
+	for _, member := range l.Members {
+		if participant.UserID != "" && member.UserID == participant.UserID {
+			member.DisplayName = name
+			return member
+		}
+		sameGuest := participant.UserID == "" && member.UserID == "" && strings.EqualFold(member.DisplayName, name)
+		if sameGuest && !taken[member.ID] {
+			member.DisplayName = name
+			return member
+		}
+	}
+
+	member := &LeagueMember{
+		ID:          uuid.New().String(),
+		DisplayName: name,
+		UserID:      participant.UserID,
+		JoinedAt:    time.Now(),
+	}
+	l.Members[member.ID] = member
+	return member
+}
+
+// standings adds up every round into the leaderboard: most points first, then most wins, then by name
+func (l *League) standings() []Standing {
+	byMember := make(map[string]*Standing)
+	for _, round := range l.Rounds {
+		for _, result := range round.Results {
+			member, exists := l.Members[result.MemberID]
+			if !exists {
+				continue
+			}
+			standing, exists := byMember[member.ID]
+			if !exists {
+				standing = &Standing{MemberID: member.ID, DisplayName: member.DisplayName}
+				byMember[member.ID] = standing
+			}
+			standing.Points += l.pointsFor(result.Place)
+			standing.Rounds++
+			if result.Place == 1 {
+				standing.Wins++
+			}
+		}
+	}
+
+	standings := make([]Standing, 0, len(byMember))
+	for _, standing := range byMember {
+		standings = append(standings, *standing)
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Points != standings[j].Points {
+			return standings[i].Points > standings[j].Points
+		}
+		if standings[i].Wins != standings[j].Wins {
+			return standings[i].Wins > standings[j].Wins
+		}
+		return standings[i].DisplayName < standings[j].DisplayName
+	})
+
+	// Same tie rule as round results: equal points and wins share a place
+	for i := range standings {
+		if i > 0 && standings[i].Points == standings[i-1].Points && standings[i].Wins == standings[i-1].Wins {
+			standings[i].Place = standings[i-1].Place
+		} else {
+			standings[i].Place = i + 1
+		}
+	}
+	return standings
+}
+
+// mergeMembers folds one member into another, e.g. a guest name into the same person's account
+func (l *League) mergeMembers(fromID string, intoID string) {
+	from, into := l.Members[fromID], l.Members[intoID]
+	if into.UserID == "" {
+		into.UserID = from.UserID
+	}
+	for _, round := range l.Rounds {
+		for i := range round.Results {
+			if round.Results[i].MemberID == fromID {
+				round.Results[i].MemberID = intoID
+			}
+		}
+	}
+	delete(l.Members, fromID)
+}
+
+/*
+recordLeagueRound adds a just-closed round to its league. Closing a round again (after the host reopened it) replaces
+its earlier results instead of counting it twice. Failures are only logged; the round itself closed fine.
+*/
+func (s *Server) recordLeagueRound(round *Round) {
+	// Without any votes every entry "ties for first"; count it as taking part rather than handing everyone a win
+	placements := round.results()
+	people := round.Participants
+	ranked := len(round.Votes) > 0
+
+	// A tournament only counts once, when its final closes, with everyone placed by how far they got
+	if round.Bracket != nil {
+		if round.Bracket.ChampionID == "" {
+			return
+		}
+		placements = round.Bracket.placements()
+		people = round.Bracket.Players
+		ranked = true
+	}
+
+	var leagueRound *LeagueRound
+	league, err := s.updateLeague(round.LeagueCode, func(league *League) error {
+		leagueRound = &LeagueRound{
+			RoundID:  round.ID,
+			JoinCode: round.JoinCode,
+			Name:     round.Name,
+			ClosedAt: time.Now(),
+		}
+		if round.Bracket != nil {
+			leagueRound.Name = round.Bracket.Name // rather than "...: Final"
+		}
+
+		taken := make(map[string]bool)
+		for _, placement := range placements {
+			member := league.memberFor(people[placement.ParticipantID], taken)
+			taken[member.ID] = true
+			result := LeagueResult{MemberID: member.ID, Votes: placement.Votes}
+			if ranked {
+				result.Place = placement.Place
+			}
+			leagueRound.Results = append(leagueRound.Results, result)
+		}
+
+		replaced := false
+		for i, existing := range league.Rounds {
+			if existing.RoundID == round.ID {
+				league.Rounds[i] = leagueRound
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			league.Rounds = append(league.Rounds, leagueRound)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save league %s after round %s: %v", round.LeagueCode, round.JoinCode, err)
+		return
+	}
+	if league == nil {
+		return // league was deleted while the round was running
+	}
+
+	for _, result := range leagueRound.Results {
+		if member := league.Members[result.MemberID]; member.UserID != "" {
+			s.db.SAdd(ctx, userLeaguesKey(member.UserID), league.Code)
+		}
+	}
+	log.Printf("Recorded round %s in league %s (%d entries)", round.JoinCode, league.Code, len(leagueRound.Results))
+}
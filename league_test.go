@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestMemberForSameNamedGuests(t *testing.T) {
+	league := &League{Members: make(map[string]*LeagueMember)}
+	taken := make(map[string]bool)
+	first := league.memberFor(&Participant{DisplayName: "Sam"}, taken)
+	taken[first.ID] = true
+	second := league.memberFor(&Participant{DisplayName: "sam"}, taken)
+	if first.ID == second.ID {
+		t.Fatal("two guests called Sam in one round became one member")
+	}
+
+	// Next round, a guest called Sam is matched again; an account called Sam never is
+	again := league.memberFor(&Participant{DisplayName: "Sam"}, map[string]bool{})
+	if again.ID != first.ID && again.ID != second.ID {
+		t.Error("a returning guest got a new member")
+	}
+	account := league.memberFor(&Participant{DisplayName: "Sam", UserID: "u1"}, map[string]bool{})
+	if account.ID == first.ID || account.ID == second.ID {
+		t.Error("an account took over a guest member")
+	}
+}
+
+func TestLeaguePublicHidesAccounts(t *testing.T) {
+	league := &League{OwnerID: "owner", Members: map[string]*LeagueMember{"m": {ID: "m", UserID: "u1"}}}
+	public := league.public()
+	if public.OwnerID != "" || public.Members["m"].UserID != "" {
+		t.Errorf("public league shows account IDs: %+v", public)
+	}
+	if league.Members["m"].UserID != "u1" {
+		t.Error("public changed the league itself")
+	}
+}
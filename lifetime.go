@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log" // For Logging errors and info messages
+	"os"  // For OS interface
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Round lifetimes
+
+Every round has an ExpiresAt that the host picks when creating it (anywhere from minRoundLifetime up to the
+MaxRoundLifetime from the config) and can push back later from the round page, up to MaxRoundLifetime after the
+round was created. Everything that belongs to the round expires at that same moment: the round itself, everyone's
+sessions (and their cookies), and the moderation bookkeeping in session.go. Saving the round no longer resets the
+clock, so a busy round lives exactly as long as a quiet one.
+
+Redis forgets keys by itself, but the uploaded files on disk don't, so saveRound also records each round's ID in a
+sorted set ordered by expiry time, and cleanupExpiredRounds (run on a timer from main) deletes the folders of rounds
+whose time is up.
+*/
+
+const (
+	minRoundLifetime = time.Hour
+
+	roundExpiryKey       = "roundexpiry" // sorted set: round ID -> ExpiresAt as unix seconds
+	roundCleanupInterval = 10 * time.Minute
+)
+
+// lifetimeOption is one choice in the "round lasts" and "extend by" dropdowns
+type lifetimeOption struct {
+	Hours int
+	Label string
+}
+
+var lifetimePresets = []lifetimeOption{
+	{1, "1 hour"},
+	{6, "6 hours"},
+	{24, "1 day"},
+	{72, "3 days"},
+	{168, "1 week"},
+	{720, "30 days"},
+}
+
+// lifetimeOptions is the presets that fit under the configured maximum
+func (s *Server) lifetimeOptions() []lifetimeOption {
+	var options []lifetimeOption
+	for _, option := range lifetimePresets {
+		if time.Duration(option.Hours)*time.Hour <= s.cfg.MaxRoundLifetime.Duration {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// ttl is how long the round has left; never zero or negative, since Redis treats those as "keep forever" / "delete now"
+func (r *Round) ttl() time.Duration {
+	remaining := time.Until(r.ExpiresAt)
+	if remaining < time.Second {
+		return time.Second
+	}
+	return remaining
+}
+
+/*
+saveRound writes the round back to Redis with whatever time it has left. Every handler that changes a round goes
+through here instead of calling Set itself, so the expiry can't drift between handlers. The job workers save their
+results through updateRound while handlers have the round loaded, so before writing, saveRound carries over whatever
+they've recorded since (see keepUploadResults); the WATCH makes sure nothing lands between that read and the write.
+*/
+func (s *Server) saveRound(round *Round) error {
+	key := roundKey(round.JoinCode)
+	for attempt := 0; attempt < maxRoundUpdateAttempts; attempt++ {
+		err := s.db.Watch(ctx, func(tx *redis.Tx) error {
+			stored, err := tx.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				var current Round
+				if err := json.Unmarshal([]byte(stored), &current); err == nil {
+					round.keepUploadResults(&current)
+				}
+			}
+
+			roundData, err := s.roundRecord(round)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, roundData, round.ttl())
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue // a worker saved it in between; carry its results over too
+		} else if err != nil {
+			return err
+		}
+
+		s.recordRoundExpiry(round)
+		return nil
+	}
+	return errRoundBusy
+}
+
+// roundRecord is the round as it's stored in Redis
+func (s *Server) roundRecord(round *Round) ([]byte, error) {
+	// Rounds saved before lifetimes existed have no ExpiresAt; they get the default from now on
+	if round.ExpiresAt.IsZero() {
+		round.ExpiresAt = time.Now().Add(s.cfg.RoundTTL.Duration)
+	}
+	return json.Marshal(round)
+}
+
+// recordRoundExpiry is only needed for the file cleanup, so a failure here is logged rather than failing the save
+func (s *Server) recordRoundExpiry(round *Round) {
+	if err := s.db.ZAdd(ctx, roundExpiryKey, redis.Z{
+		Score:  float64(round.ExpiresAt.Unix()),
+		Member: round.ID,
+	}).Err(); err != nil {
+		log.Printf("Failed to record expiry for round %s: %v", round.JoinCode, err)
+	}
+}
+
+const maxRoundUpdateAttempts = 20
+
+var errRoundBusy = errors.New("the round kept changing while saving")
+
+/*
+updateRound loads the round, lets update change it and saves it, all under a WATCH: if anything else saves the round
+in between, the save is dropped and update runs again on the fresh copy. That's for changes that mustn't wipe out
+(or be wiped out by) whatever else happened to the round meanwhile: the job workers, and uploads, which can take
+minutes to arrive. Returns nil, without calling update, if the round is gone. If update returns an error nothing is
+saved and the error comes back as is.
+*/
+func (s *Server) updateRound(code string, update func(round *Round) error) (*Round, error) {
+	key := roundKey(code)
+	for attempt := 0; attempt < maxRoundUpdateAttempts; attempt++ {
+		var updated *Round
+		err := s.db.Watch(ctx, func(tx *redis.Tx) error {
+			roundData, err := tx.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			var round Round
+			if err := json.Unmarshal([]byte(roundData), &round); err != nil {
+				return err
+			}
+			if err := update(&round); err != nil {
+				return err
+			}
+			record, err := s.roundRecord(&round)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, record, round.ttl())
+				return nil
+			}); err != nil {
+				return err
+			}
+			updated = &round
+			return nil
+		}, key)
+		if err == redis.TxFailedErr {
+			continue // someone else saved it first
+		} else if err != nil {
+			return nil, err
+		}
+
+		if updated != nil {
+			s.recordRoundExpiry(updated)
+		}
+		return updated, nil
+	}
+	return nil, errRoundBusy
+}
+
+/*
+syncRoundExpiry moves every key that belongs to the round to its current ExpiresAt; used after the host extends it.
+Cookies can't be reached from here, so handleRoundView re-issues the session cookie whenever someone opens the page.
+*/
+func (s *Server) syncRoundExpiry(round *Round) {
+	code := round.JoinCode
+	keys := []string{roundFingerprintsKey(code), roundBansKey(code)}
+
+	people := make([]string, 0, len(round.Participants)+len(round.Spectators))
+	for id := range round.Participants {
+		people = append(people, id)
+	}
+	for id := range round.Spectators {
+		people = append(people, id)
+	}
+
+	for _, id := range people {
+		setKey := participantSessionsKey(code, id)
+		keys = append(keys, setKey)
+		tokens, err := s.db.SMembers(ctx, setKey).Result()
+		if err != nil {
+			log.Printf("Failed to look up sessions for %s in round %s: %v", id, code, err)
+			continue
+		}
+		for _, token := range tokens {
+			keys = append(keys, sessionKey(token))
+		}
+	}
+
+	// ExpireAt on a key that doesn't exist (e.g. no bans yet) just does nothing
+	for _, key := range keys {
+		s.db.ExpireAt(ctx, key, round.ExpiresAt)
+	}
+}
+
+/*
+cleanupExpiredRounds deletes the upload folders of rounds that have expired. Folders with no entry in the expiry set
+(rounds from before it existed, or a Redis that got wiped) are removed once they're older than the longest a round
+can possibly live.
+*/
+func (s *Server) cleanupExpiredRounds() {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	expiredIDs, err := s.db.ZRangeByScore(ctx, roundExpiryKey, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+	if err != nil {
+		log.Printf("Failed to look up expired rounds: %v", err)
+		return
+	}
+
+	for _, roundID := range expiredIDs {
+		if err := os.RemoveAll(filepath.Join(s.cfg.UploadDir, roundID)); err != nil {
+			log.Printf("Failed to delete files for expired round %s: %v", roundID, err)
+			continue
+		}
+		s.db.ZRem(ctx, roundExpiryKey, roundID)
+		log.Printf("Deleted files for expired round %s", roundID)
+	}
+
+	entries, err := os.ReadDir(s.cfg.UploadDir)
+	if err != nil {
+		log.Printf("Failed to read upload directory: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := s.db.ZScore(ctx, roundExpiryKey, entry.Name()).Result(); err != redis.Nil {
+			continue // tracked (or Redis is having trouble, in which case leave it alone)
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < s.cfg.MaxRoundLifetime.Duration {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.cfg.UploadDir, entry.Name())); err != nil {
+			log.Printf("Failed to delete untracked upload folder %s: %v", entry.Name(), err)
+			continue
+		}
+		log.Printf("Deleted untracked upload folder %s", entry.Name())
+	}
+}
+
+// runRoundCleanup calls cleanupExpiredRounds every roundCleanupInterval, forever; main starts it in its own goroutine
+func (s *Server) runRoundCleanup() {
+	ticker := time.NewTicker(roundCleanupInterval)
+	defer ticker.Stop()
+
+	s.cleanupExpiredRounds()
+	for range ticker.C {
+		s.cleanupExpiredRounds()
+	}
+}
+
+// parseLifetimeHours checks a host-picked lifetime; 0 means "use the default"
+func (s *Server) parseLifetimeHours(hours int) (time.Duration, error) {
+	if hours == 0 {
+		return s.cfg.RoundTTL.Duration, nil
+	}
+	lifetime := time.Duration(hours) * time.Hour
+	if lifetime < minRoundLifetime || lifetime > s.cfg.MaxRoundLifetime.Duration {
+		return 0, fmt.Errorf("a round can last between %d hour and %d hours",
+			int(minRoundLifetime.Hours()), int(s.cfg.MaxRoundLifetime.Hours()))
+	}
+	return lifetime, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Loudness
+
+Listening to entries back to back isn't fair when one was mastered at -6 LUFS and the next at -16: the louder one
+just sounds better. So alongside tempo and key (analysis.go) every WAV/FLAC upload gets measured the way broadcasters
+do it, per ITU-R BS.1770 / EBU R128:
+
+  - Integrated loudness, in LUFS: the audio is K-weighted (a filter roughly shaped like how loud we hear each
+    frequency), cut into 400 ms blocks, and the blocks that are near-silent (below -70 LUFS, then more than 10 LU
+    under the average) are left out of the average.
+  - True peak, in dBTP: the highest level the waveform reaches between samples as well as on them, found by
+    oversampling 4x. A file can peak at 0 dBFS on every sample and still clip after conversion.
+
+If the host turned on level-matched listening for the round, each entry also gets a listening copy: a 16-bit WAV
+turned up or down to listeningTargetLUFS, but never so far that its true peak goes over listeningPeakCeiling (a quiet
+file with a big transient can end up under the target). The round page plays and votes on the copies; downloads and
+the export always hand out the original file.
+*/
+
+const (
+	listeningTargetLUFS  = -14.0 // what most streaming services play at
+	listeningPeakCeiling = -1.0  // dBTP headroom left after the gain
+	absoluteGateLUFS     = -70.0
+	relativeGateLU       = -10.0
+)
+
+// Loudness is the BS.1770 measurement of a file
+type Loudness struct {
+	Integrated float64 `json:"integrated"` // LUFS
+	TruePeak   float64 `json:"truePeak"`   // dBTP
+}
+
+// biquad is one second-order IIR filter section, with a0 normalized to 1
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+func (f biquad) apply(signal []float64) {
+	var x1, x2, y1, y2 float64
+	for i, x := range signal {
+		y := f.b0*x + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		x2, x1 = x1, x
+		y2, y1 = y1, y
+		signal[i] = y
+	}
+}
+
+/*
+kWeighting returns the two K-weighting stages for a sample rate: a high shelf (+4 dB above about 1.7 kHz, the head's
+effect) and a high pass around 38 Hz. BS.1770 only lists the coefficients for 48 kHz; these are the same filters
+worked out for any rate, and come out identical at 48 kHz.
+*/
+func kWeighting(sampleRate int) []biquad {
+	rate := float64(sampleRate)
+
+	// Stage 1: high shelf
+	frequency, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * frequency / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// Stage 2: high pass
+	frequency, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * frequency / rate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{b0: 1, b1: -2, b2: 1, a1: 2 * (k*k - 1) / a0, a2: (1 - k/q + k*k) / a0}
+
+	return []biquad{shelf, highPass}
+}
+
+// channelWeight is BS.1770's weighting per channel: surrounds count a bit more, and the LFE of a 5.1 file not at all
+func channelWeight(channel int, channels int) float64 {
+	if channels == 6 {
+		return []float64{1, 1, 1, 0, 1.41, 1.41}[channel]
+	}
+	return 1
+}
+
+/*
+measureLoudness returns the file's loudness, or nil when there's nothing to measure (too short for one 400 ms block,
+or quiet enough that every block is gated out).
+*/
+func measureLoudness(audio *pcmAudio) *Loudness {
+	blockSize := audio.SampleRate * 4 / 10 // 400 ms
+	step := audio.SampleRate / 10          // 75% overlap
+	frames := audio.frames()
+	if frames < blockSize || step == 0 {
+		return nil
+	}
+
+	// Mean square of every block, summed over the weighted channels
+	blocks := make([]float64, (frames-blockSize)/step+1)
+	for c, samples := range audio.Channels {
+		weight := channelWeight(c, len(audio.Channels))
+		if weight == 0 {
+			continue
+		}
+		filtered := make([]float64, frames)
+		for i, sample := range samples {
+			filtered[i] = float64(sample)
+		}
+		for _, stage := range kWeighting(audio.SampleRate) {
+			stage.apply(filtered)
+		}
+
+		// Running sums of squares, so each block is a subtraction instead of a loop
+		squares := make([]float64, frames+1)
+		for i, value := range filtered {
+			squares[i+1] = squares[i] + value*value
+		}
+		for j := range blocks {
+			start := j * step
+			blocks[j] += weight * (squares[start+blockSize] - squares[start]) / float64(blockSize)
+		}
+	}
+
+	// Absolute gate, then the relative gate 10 LU under what's left
+	gatedMean := func(threshold float64) (float64, int) {
+		var sum float64
+		count := 0
+		for _, power := range blocks {
+			if blockLoudness(power) > threshold {
+				sum += power
+				count++
+			}
+		}
+		if count == 0 {
+			return 0, 0
+		}
+		return sum / float64(count), count
+	}
+	mean, count := gatedMean(absoluteGateLUFS)
+	if count == 0 {
+		return nil
+	}
+	mean, count = gatedMean(blockLoudness(mean) + relativeGateLU)
+	if count == 0 {
+		return nil
+	}
+
+	return &Loudness{
+		Integrated: math.Round(blockLoudness(mean)*10) / 10,
+		TruePeak:   math.Round(truePeak(audio)*10) / 10,
+	}
+}
+
+func blockLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+/*
+truePeak oversamples every channel 4x with a 48-tap interpolation filter (the size BS.1770 suggests) and returns the
+highest level found, in dBTP. Audio that's already at 176.4 kHz or more is close enough as it is.
+*/
+func truePeak(audio *pcmAudio) float64 {
+	const factor, taps = 4, 48
+	oversample := audio.SampleRate < 176400
+
+	// Windowed sinc low pass at the original Nyquist, split into one 12-tap filter per output phase
+	var phases [factor][taps / factor]float64
+	center := float64(taps-1) / 2
+	for m := 0; m < taps; m++ {
+		x := (float64(m) - center) / factor
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		window := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(m)+0.5)/taps)
+		phases[m%factor][m/factor] = sinc * window
+	}
+
+	peak := 0.0
+	for _, samples := range audio.Channels {
+		for i, sample := range samples {
+			peak = max(peak, math.Abs(float64(sample)))
+			if !oversample || i < taps/factor {
+				continue
+			}
+			for _, phase := range phases {
+				var sum float64
+				for k, coefficient := range phase {
+					sum += coefficient * float64(samples[i-k])
+				}
+				peak = max(peak, math.Abs(sum))
+			}
+		}
+	}
+	if peak == 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(peak)
+}
+
+// listeningGain is how many dB to turn a file up (or down) by for level-matched playback
+func listeningGain(loudness *Loudness) float64 {
+	gain := listeningTargetLUFS - loudness.Integrated
+	gain = min(gain, listeningPeakCeiling-loudness.TruePeak) // don't push the peaks past the ceiling
+	return math.Round(gain*10) / 10
+}
+
+// listeningCopyName is where a file's level-matched copy goes, next to the original
+func listeningCopyName(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "_listen.wav"
+}
+
+// writeWAV16 writes the audio as a 16-bit WAV with the gain (in dB) applied; used for listening copies and previews
+func writeWAV16(path string, audio *pcmAudio, gain float64) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	channels, frames := len(audio.Channels), audio.frames()
+	dataSize := frames * channels * 2
+	out := bufio.NewWriter(file)
+
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+dataSize))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, wavFormatPCM)
+	header = binary.LittleEndian.AppendUint16(header, uint16(channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(audio.SampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(audio.SampleRate*channels*2))
+	header = binary.LittleEndian.AppendUint16(header, uint16(channels*2))
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(dataSize))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	scale := math.Pow(10, gain/20) * 32767
+	sample := make([]byte, 2)
+	for i := 0; i < frames; i++ {
+		for _, samples := range audio.Channels {
+			value := math.Round(float64(samples[i]) * scale)
+			binary.LittleEndian.PutUint16(sample, uint16(int16(max(-32768, min(32767, value)))))
+			if _, err := out.Write(sample); err != nil {
+				return err
+			}
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"embed" // Allows embedding files into binary at compile time
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux" // Router for advanced URL Routing
 	"html/template"          // HTML templating engine for rendering dynamic web pages
@@ -11,6 +12,9 @@ import (
 	"log"                    // For Logging errors and info messages
 	"net/http"               // For HTTP server and client funcionality
 	"os"                     // For OS interface
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -34,6 +38,12 @@ var staticFS embed.FS
 var ctx = context.Background()
 
 func main() {
+	// Defaults, then config file, then environment, then flags (see config.go); a bad config stops us right here
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	/*
 		os.MkdirAll makes sure data/uploads exists (if not, it creates), and gives permission 0755
 		for the 0000 format: (1st 0: special bit [we can ignore rn], 2nd 0: owner (you),
@@ -48,11 +58,13 @@ func main() {
 		0755 means that owner has RWX (read, write, and exectute), group has RX, and others have RX
 	*/
 
-	if err := os.MkdirAll("temp/uploads", 0755); err != nil {
-		log.Fatal("Failed to create data directories:", err)
+	for _, dir := range []string{cfg.UploadDir, cfg.LibraryDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatal("Failed to create data directories:", err)
+		}
 	}
 
-	rdb := initRDB() // Initialize database
+	rdb := initRDB(cfg.Redis) // Initialize database
 
 	// "defer" ensures rdb.close() runs when main() exits (cleanup)
 	defer func() { // using anonymous func for defered close of rdb because I need to error check
@@ -61,6 +73,17 @@ func main() {
 		}
 	}() // () for immediate call
 
+	// The archive keeps closed rounds around after they expire from Redis (see archive.go)
+	archive, err := openArchive(cfg.ArchiveDir)
+	if err != nil {
+		log.Fatal("Failed to open archive:", err)
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			log.Printf("Failed to close archive with error: %v", err)
+		}
+	}()
+
 	// ParseFS reads from the embedded FS that we created earlier here; We parse all embeddded HTML templates into memory
 	templates, err := template.ParseFS(templatesFS, "web/templates/*.html")
 	if err != nil {
@@ -70,25 +93,68 @@ func main() {
 	// Initializing new server (we ofc want a pointer because all those member vars are shared resources; Not
 	// good to be copying large structs around either and also wouldn't make sense to)
 	server := &Server{
-		db:        rdb,
-		templates: templates,
-		router:    mux.NewRouter(),
+		db:         rdb,
+		templates:  templates,
+		router:     mux.NewRouter(),
+		cfg:        cfg,
+		archive:    archive,
+		jobWake:    make(chan struct{}, 1),
+		transcoder: newTranscoder(cfg),
 	}
 
 	// This uses the function below to register URL paths and link them to their handler functions
 	server.setupRoutes()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	// Deletes the upload folders of expired rounds every so often (see lifetime.go)
+	go server.runRoundCleanup()
 
-	log.Printf("Server starting on http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, server.router); err != nil {
-		log.Fatal("Server failed to start:", err)
+	// Processes uploads in the background (see jobs.go); cancelling jobsCtx tells the workers to stop
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	workers := server.startJobWorkers(jobsCtx)
+
+	httpServer := &http.Server{Addr: cfg.ListenAddr, Handler: server.router}
+
+	// With a certificate we serve HTTPS ourselves; otherwise plain HTTP (e.g. behind a proxy that does the HTTPS)
+	go func() {
+		var err error
+		if cfg.tlsEnabled() {
+			log.Printf("Server starting on https://%s", cfg.ListenAddr)
+			err = httpServer.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			log.Printf("Server starting on http://%s", cfg.ListenAddr)
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server failed to start:", err)
+		}
+	}()
+
+	/*
+		Ctrl+C or a SIGTERM (what Docker and systemd send) shuts down cleanly: requests in flight get up to
+		shutdownTimeout to finish, then the job workers finish whatever they're on and rounds being archived are
+		written out, and only then do the deferred closes of Redis and the archive run. Jobs still waiting in Redis are
+		picked up on the next start.
+	*/
+	stopCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	<-stopCtx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server didn't shut down cleanly: %v", err)
 	}
+
+	stopJobs()
+	workers.Wait()
+	server.archiving.Wait()
+	log.Println("Stopped")
 }
 
+// shutdownTimeout is how long requests in flight get to finish once we're asked to stop
+const shutdownTimeout = 15 * time.Second
+
 /*
 This is a member function for the Server class; 's' is the equivalent of "self" in python.
 
@@ -157,20 +223,69 @@ func (s *Server) setupRoutes() {
 	s.router.HandleFunc("/", s.handleIndex).Methods("GET")
 	// Want to note that {code} is like a reverse template where the URL fulfills that variable, but in the handler
 	// function we will extract that {code} variable with mux.Vars(r)
-	s.router.HandleFunc("/round/{code}", s.handleRoundView).Methods("GET")
+	s.router.Handle("/round/{code}", s.rateLimitVisitors(s.cfg.RateLimits.Join)(http.HandlerFunc(s.handleRoundView))).Methods("GET")
+	s.router.HandleFunc("/account", s.handleAccountView).Methods("GET")
+	s.router.HandleFunc("/league/{code}", s.handleLeagueView).Methods("GET")
 
 	// Api route registration
 	// as per it says in the method, this is a subrouter of our 's' Server; All full paths would include /api if not
 	api := s.router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/round/create", s.handleCreateRound).Methods("POST")
-	api.HandleFunc("/round/join", s.handleJoinRound).Methods("POST")
-	api.HandleFunc("/round/{code}/info", s.handleRoundInfo).Methods("GET")
+
+	// Every state-changing API request must come from our own pages (see csrf.go); GETs pass straight through
+	api.Use(s.csrfProtect)
+
+	// Routes that take a join code or write files get rate limited (see ratelimit.go); the middleware wraps just that one handler
+	api.Handle("/round/create", s.rateLimit(s.cfg.RateLimits.Create)(http.HandlerFunc(s.handleCreateRound))).Methods("POST")
+	api.Handle("/round/join", s.rateLimit(s.cfg.RateLimits.Join)(http.HandlerFunc(s.handleJoinRound))).Methods("POST")
+	api.Handle("/round/spectate", s.rateLimit(s.cfg.RateLimits.Join)(http.HandlerFunc(s.handleSpectateRound))).Methods("POST")
+	api.Handle("/round/{code}/info", s.rateLimitVisitors(s.cfg.RateLimits.Join)(http.HandlerFunc(s.handleRoundInfo))).Methods("GET")
 	api.HandleFunc("/round/{code}/state", s.handleUpdateState).Methods("POST")
-	api.HandleFunc("/round/{code}/upload", s.handleUpload).Methods("POST")
+	api.Handle("/round/{code}/upload", s.rateLimit(s.cfg.RateLimits.Upload)(http.HandlerFunc(s.handleUpload))).Methods("POST")
 	api.HandleFunc("/round/{code}/download/{filename}", s.handleDownload).Methods("GET")
+	api.HandleFunc("/round/{code}/preview/{filename}", s.handlePreview).Methods("GET")
 	api.HandleFunc("/round/{code}/export", s.handleExport).Methods("GET")
-	api.HandleFunc("/round/{code}/upload-sample", s.handleUploadSample).Methods("POST")
+	api.HandleFunc("/round/{code}/manifest", s.handleManifest).Methods("GET")
+	api.Handle("/round/{code}/upload-sample", s.rateLimit(s.cfg.RateLimits.Upload)(http.HandlerFunc(s.handleUploadSample))).Methods("POST")
 	api.HandleFunc("/round/{code}/leave", s.handleLeaveRound).Methods("POST")
+	api.HandleFunc("/round/{code}/kick", s.handleKickParticipant).Methods("POST")
+	api.HandleFunc("/round/{code}/ban", s.handleBanParticipant).Methods("POST")
+	api.HandleFunc("/round/{code}/lock", s.handleLockRound).Methods("POST")
+	api.HandleFunc("/round/{code}/transfer-host", s.handleTransferHost).Methods("POST")
+	api.HandleFunc("/round/{code}/role", s.handleSetRole).Methods("POST")
+	api.HandleFunc("/round/{code}/settings", s.handleUpdateSettings).Methods("POST")
+	api.HandleFunc("/round/{code}/extend", s.handleExtendRound).Methods("POST")
+	api.HandleFunc("/round/{code}/roulette", s.handleUpdateRoulette).Methods("POST")
+	api.HandleFunc("/round/{code}/vote", s.handleVote).Methods("POST")
+	api.HandleFunc("/round/{code}/access", s.handleUpdateAccess).Methods("POST")
+	api.HandleFunc("/round/{code}/invites", s.handleListInvites).Methods("GET")
+	api.HandleFunc("/round/{code}/invites", s.handleCreateInvite).Methods("POST")
+	api.HandleFunc("/round/{code}/invites/{token}", s.handleRevokeInvite).Methods("DELETE")
+
+	// Saved round settings and running a closed round again (see handlers_templates.go)
+	api.HandleFunc("/round/{code}/template", s.handleSaveTemplate).Methods("POST")
+	api.Handle("/round/{code}/clone", s.rateLimit(s.cfg.RateLimits.Create)(http.HandlerFunc(s.handleCloneRound))).Methods("POST")
+	api.HandleFunc("/templates", s.handleListTemplates).Methods("GET")
+	api.HandleFunc("/templates/{id}", s.handleDeleteTemplate).Methods("DELETE")
+	api.Handle("/templates/{id}/create", s.rateLimit(s.cfg.RateLimits.Create)(http.HandlerFunc(s.handleCreateFromTemplate))).Methods("POST")
+
+	// Read-only access to archived rounds once they're gone from Redis (see handlers_archive.go)
+	api.Handle("/archive/{code}", s.rateLimitVisitors(s.cfg.RateLimits.Join)(http.HandlerFunc(s.handleArchiveInfo))).Methods("GET")
+	api.HandleFunc("/archive/{code}/download/{filename}", s.handleArchiveDownload).Methods("GET")
+	api.HandleFunc("/archive/{code}/export", s.handleArchiveExport).Methods("GET")
+
+	// Leagues: many rounds, one leaderboard (see league.go)
+	api.HandleFunc("/leagues", s.handleCreateLeague).Methods("POST")
+	api.HandleFunc("/leagues", s.handleListLeagues).Methods("GET")
+	api.HandleFunc("/league/{code}", s.handleLeagueInfo).Methods("GET")
+	api.HandleFunc("/league/{code}/settings", s.handleUpdateLeague).Methods("POST")
+	api.HandleFunc("/league/{code}/merge", s.handleMergeMembers).Methods("POST")
+
+	// Optional accounts; everything above still works for guests
+	api.Handle("/account/register", s.rateLimit(s.cfg.RateLimits.Account)(http.HandlerFunc(s.handleRegister))).Methods("POST")
+	api.Handle("/account/login", s.rateLimit(s.cfg.RateLimits.Account)(http.HandlerFunc(s.handleLogin))).Methods("POST")
+	api.HandleFunc("/account/logout", s.handleLogout).Methods("POST")
+	api.HandleFunc("/account/me", s.handleAccountInfo).Methods("GET")
+	api.HandleFunc("/account/submissions/{roundId}/{filename}", s.handleAccountDownload).Methods("GET")
 }
 
 // Redis key helper functions
@@ -214,20 +329,14 @@ func generateJoinCode() string {
 	return string(b)
 }
 
-func initRDB() *redis.Client {
-
-	redisAddr := os.Getenv("REDIS_URL")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
-
+func initRDB(cfg RedisConfig) *redis.Client {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: os.Getenv("REDIS_PASSWORD"), // Default to "" if no password set
+		Addr:     cfg.Addr,
+		Password: cfg.Password, // "" if no password set
 
-		// We only use the first one '0' since we can put the whole lobby structure on there
-		DB:       0, // This DB parameter is a namespace;
-		Protocol: 3, // This parameter tells us how we want our formatting style (e.g. RESP2, RESP3 [protocol 3 = RESP3])
+		// Defaults to '0' since we can put the whole lobby structure on there
+		DB:       cfg.DB,       // This DB parameter is a namespace;
+		Protocol: cfg.Protocol, // This parameter tells us how we want our formatting style (e.g. RESP2, RESP3 [protocol 3 = RESP3])
 	})
 
 	// Test Redis connection
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Export manifest
+
+A folder of audio files doesn't say much once the round is gone: who sent in what, when, whether it was swapped out,
+or who won. So every export has a manifest.json and a manifest.csv in it, and the same thing is served on its own at
+/api/round/{code}/manifest (add ?format=csv for the spreadsheet version).
+
+  - manifest.json has the round's settings, the participants (with their roulette rule, if one was dealt), every file
+    and the results. Files are listed under the name they have in the export, with their original name, upload time,
+    how many times they were replaced, size, SHA-256 and whatever analysis finished (tempo, key, loudness).
+  - manifest.csv is one row per file, with the participant's place and votes on their row.
+
+Sizes and hashes are of the stored uploads. The exported copies have fresh tags written into them (see tags.go), so
+their bytes differ, though the audio in them doesn't.
+*/
+
+// ExportManifest is the record of a round that goes with its export
+type ExportManifest struct {
+	GeneratedAt  time.Time             `json:"generatedAt"`
+	Round        manifestRound         `json:"round"`
+	Participants []manifestParticipant `json:"participants"`
+	Files        []manifestFile        `json:"files"`
+	Results      []Placement           `json:"results,omitempty"`  // once the round is closed
+	Champion     string                `json:"champion,omitempty"` // tournaments, once there is one
+}
+
+type manifestRound struct {
+	ID         string        `json:"id"`
+	JoinCode   string        `json:"joinCode"`
+	Name       string        `json:"name"`
+	Mode       RoundMode     `json:"mode"`
+	State      RoundState    `json:"state"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	StartedAt  *time.Time    `json:"startedAt,omitempty"` // sprint mode
+	Settings   RoundSettings `json:"settings"`
+	Constraint string        `json:"constraint,omitempty"` // the roulette rule, when everyone got the same one
+}
+
+type manifestParticipant struct {
+	ID          string          `json:"id"`
+	DisplayName string          `json:"displayName"`
+	Role        ParticipantRole `json:"role"`
+	JoinedAt    time.Time       `json:"joinedAt"`
+	Constraint  string          `json:"constraint,omitempty"`
+}
+
+type manifestFile struct {
+	Kind          string         `json:"kind"` // "sample", "submission" or "layer"
+	Path          string         `json:"path"` // its name in the export
+	ParticipantID string         `json:"participantId,omitempty"`
+	Participant   string         `json:"participant,omitempty"`
+	OriginalName  string         `json:"originalName,omitempty"`
+	UploadedAt    *time.Time     `json:"uploadedAt,omitempty"`
+	Late          bool           `json:"late,omitempty"`
+	Replacements  int            `json:"replacements,omitempty"` // times it was swapped for a new upload
+	Credit        string         `json:"credit,omitempty"`       // build-up layers
+	Size          int64          `json:"size"`
+	SHA256        string         `json:"sha256,omitempty"`
+	Missing       bool           `json:"missing,omitempty"` // the stored file couldn't be found, so it's not in the export either
+	Analysis      *AudioAnalysis `json:"analysis,omitempty"`
+}
+
+// buildManifest describes the round and the files that go into its export; pathFor is the same as sendExport's
+func buildManifest(round *Round, files []exportFile, pathFor func(filename string) string) *ExportManifest {
+	settings := round.settings()
+	settings.PasswordHash = ""
+	started := round.Roulette != nil && !round.Roulette.DealtAt.IsZero()
+	if !started {
+		settings.Constraints = nil // the pool is the hosts' secret until it's dealt
+	}
+
+	manifest := &ExportManifest{
+		GeneratedAt: time.Now(),
+		Round: manifestRound{
+			ID:        round.ID,
+			JoinCode:  round.JoinCode,
+			Name:      round.Name,
+			Mode:      round.Mode,
+			State:     round.State,
+			CreatedAt: round.CreatedAt,
+			Settings:  settings,
+		},
+	}
+	if !round.StartedAt.IsZero() {
+		manifest.Round.StartedAt = &round.StartedAt
+	}
+	if started && !round.Roulette.PerParticipant {
+		manifest.Round.Constraint = round.Roulette.Shared
+	}
+
+	for id, participant := range round.Participants {
+		manifest.Participants = append(manifest.Participants, manifestParticipant{
+			ID:          id,
+			DisplayName: participant.DisplayName,
+			Role:        participant.role(),
+			JoinedAt:    participant.JoinedAt,
+			Constraint:  round.constraintFor(id),
+		})
+	}
+	sort.Slice(manifest.Participants, func(i, j int) bool {
+		return manifest.Participants[i].JoinedAt.Before(manifest.Participants[j].JoinedAt)
+	})
+
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, describeExportFile(round, file, pathFor))
+	}
+
+	if round.State == StateClosed {
+		manifest.Results = round.results()
+	}
+	if round.Bracket != nil && round.Bracket.ChampionID != "" {
+		if champion := round.Bracket.Players[round.Bracket.ChampionID]; champion != nil {
+			manifest.Champion = champion.DisplayName
+		}
+	}
+	return manifest
+}
+
+// describeExportFile is one file's line in the manifest
+func describeExportFile(round *Round, file exportFile, pathFor func(filename string) string) manifestFile {
+	entry := manifestFile{Kind: file.Kind, Path: file.Path, ParticipantID: file.ParticipantID}
+	if participant := round.Participants[file.ParticipantID]; participant != nil {
+		entry.Participant = participant.DisplayName
+	}
+
+	var contentHash string
+	switch {
+	case file.Kind == "sample":
+		entry.Analysis = round.SampleAnalysis
+	case file.Submission != nil && file.Submission.Filename == file.Filename:
+		submission := file.Submission
+		entry.OriginalName, entry.UploadedAt = submission.OriginalName, &submission.UploadedAt
+		entry.Late, entry.Replacements = submission.Late, submission.Replacements
+		entry.Analysis, contentHash = submission.Analysis, submission.ContentHash
+	}
+	if layer := file.Layer; layer != nil {
+		entry.Participant = layer.DisplayName // kept on the layer even after they've left
+		entry.OriginalName, entry.UploadedAt, entry.Credit = layer.OriginalName, &layer.AddedAt, layer.Credit
+	}
+
+	// Uploads from before hashes were kept (and the sample) get hashed now
+	path := pathFor(file.Filename)
+	info, err := os.Stat(path)
+	if err != nil {
+		entry.Missing = true
+		return entry
+	}
+	entry.Size = info.Size()
+	if contentHash == "" {
+		contentHash, _ = hashFile(path)
+	}
+	entry.SHA256 = contentHash
+	return entry
+}
+
+// hashFile is the SHA-256 of a file, hex encoded
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (m *ExportManifest) json() (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// csv is the manifest as a spreadsheet: one row per file, with how its maker placed
+func (m *ExportManifest) csv() (string, error) {
+	placements := make(map[string]Placement, len(m.Results))
+	for _, placement := range m.Results {
+		placements[placement.ParticipantID] = placement
+	}
+	constraints := make(map[string]string, len(m.Participants))
+	for _, participant := range m.Participants {
+		constraints[participant.ID] = participant.Constraint
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{
+		"kind", "path", "participant", "participant_id", "original_name", "uploaded_at", "late", "replacements",
+		"credit", "size_bytes", "sha256", "bpm", "key", "loudness_lufs", "true_peak_dbtp", "place", "votes", "constraint",
+	})
+	for _, file := range m.Files {
+		row := []string{
+			file.Kind, file.Path, file.Participant, file.ParticipantID, file.OriginalName, "",
+			strconv.FormatBool(file.Late), strconv.Itoa(file.Replacements), file.Credit, "", file.SHA256,
+			"", "", "", "", "", "", constraints[file.ParticipantID],
+		}
+		if file.UploadedAt != nil {
+			row[5] = file.UploadedAt.UTC().Format(time.RFC3339)
+		}
+		if !file.Missing {
+			row[9] = strconv.FormatInt(file.Size, 10)
+		}
+		if analysis := file.Analysis; analysis != nil {
+			if analysis.BPM > 0 {
+				row[11] = fmt.Sprintf("%.1f", analysis.BPM)
+			}
+			row[12] = analysis.Key
+			if loudness := analysis.Loudness; loudness != nil {
+				row[13], row[14] = fmt.Sprintf("%.1f", loudness.Integrated), fmt.Sprintf("%.1f", loudness.TruePeak)
+			}
+		}
+		if placement, placed := placements[file.ParticipantID]; placed && file.Kind == "submission" {
+			row[15], row[16] = strconv.Itoa(placement.Place), strconv.Itoa(placement.Votes)
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
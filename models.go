@@ -3,6 +3,8 @@ package main
 import (
 	"github.com/gorilla/mux" // Router for advanced URL Routing
 	"html/template"          // HTML templating engine for rendering dynamic web pages
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -11,49 +13,339 @@ import (
 type RoundMode string
 
 const (
-	ModeSample    RoundMode = "sample"    // Everyone doanloads the same sample file
-	ModeTelephone RoundMode = "telephone" // each person gets the previous person's upload
+	ModeSample     RoundMode = "sample"     // Everyone doanloads the same sample file
+	ModeTelephone  RoundMode = "telephone"  // each person gets the previous person's upload
+	ModeTournament RoundMode = "tournament" // head-to-head bracket of sample rounds (see tournament.go)
+	ModeSprint     RoundMode = "sprint"     // sample mode against the clock (see sprint.go)
+	ModeBuildUp    RoundMode = "buildup"    // each person adds one stem to a growing multitrack (see layers.go)
 )
 
+// usesSample reports whether the host uploads one sample that everyone flips; true for every mode but telephone
+func (m RoundMode) usesSample() bool {
+	return m == ModeSample || m == ModeTournament || m == ModeSprint
+}
+
 type RoundState string
 
 const (
 	StateWaiting RoundState = "waiting"
 	StateActive  RoundState = "active"
+	StateVoting  RoundState = "voting" // uploads are shut, everyone listens and votes
 	StateClosed  RoundState = "closed"
 )
 
+type ParticipantRole string
+
+const (
+	RoleHost        ParticipantRole = "host"        // exactly one per round; always matches Round.HostID
+	RoleCoHost      ParticipantRole = "cohost"      // can start/close the round and upload the sample
+	RoleParticipant ParticipantRole = "participant" // the default; submits an entry
+	RoleJudge       ParticipantRole = "judge"       // follows the round but doesn't submit
+	RoleSpectator   ParticipantRole = "spectator"   // watching only
+)
+
 type Participant struct {
-	ID          string    `json:"id"`
-	DisplayName string    `json:"displayName"`
-	IsHost      bool      `json:"isHost"`
-	JoinedAt    time.Time `json:"joinedAt"`
+	ID          string          `json:"id"`
+	DisplayName string          `json:"displayName"`
+	Role        ParticipantRole `json:"role"`
+	IsHost      bool            `json:"isHost"` // kept alongside Role since the templates and round.js check it everywhere
+	JoinedAt    time.Time       `json:"joinedAt"`
+	UserID      string          `json:"userId,omitempty"` // Only set when they joined while logged into an account
 }
 
 type Submission struct {
-	ParticipantID string    `json:"participantId"`
-	Filename      string    `json:"filename"`
-	OriginalName  string    `json:"originalName"`
-	UploadedAt    time.Time `json:"uploadedAt"`
-	AssignedToID  string    `json:"assignedToId,omitempty"`
+	ParticipantID string             `json:"participantId"`
+	Filename      string             `json:"filename"`
+	OriginalName  string             `json:"originalName"`
+	UploadedAt    time.Time          `json:"uploadedAt"`
+	AssignedToID  string             `json:"assignedToId,omitempty"`
+	Late          bool               `json:"late,omitempty"`          // sprint mode: came in during the grace window
+	Replacements  int                `json:"replacements,omitempty"`  // how many earlier uploads this one replaced
+	Analysis      *AudioAnalysis     `json:"analysis,omitempty"`      // tempo and key, once worked out (see analysis.go)
+	ListeningCopy string             `json:"listeningCopy,omitempty"` // level-matched copy for playback (see loudness.go)
+	ListeningGain float64            `json:"listeningGain,omitempty"` // dB applied to make it
+	Preview       string             `json:"preview,omitempty"`       // small copy for streaming in the lobby (see preview.go)
+	SampleMatch   *SampleMatch       `json:"sampleMatch,omitempty"`   // sample rounds: how much of the sample it uses (see fingerprint.go)
+	ContentHash   string             `json:"contentHash,omitempty"`   // SHA-256 of the file, to spot exact copies (see duplicates.go)
+	Print         string             `json:"print,omitempty"`         // its fingerprint, to spot copies that aren't exact
+	Duplicates    []DuplicateWarning `json:"duplicates,omitempty"`    // entries it looks like a copy of
+	Job           *JobStatus         `json:"job,omitempty"`           // the background processing of the file (see jobs.go)
+}
+
+// sampleExtraFiles are the files made from the sample in the background, which go when it's replaced
+func (r *Round) sampleExtraFiles() []string {
+	var files []string
+	for _, name := range []string{r.SamplePreview, r.SamplePrint} {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// extraFiles are the files made from the upload in the background, which go when it does
+func (sub *Submission) extraFiles() []string {
+	var files []string
+	for _, name := range []string{sub.ListeningCopy, sub.Preview, sub.Print} {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files
 }
 
 type Round struct {
-	ID                 string                  `json:"id"`
-	Name               string                  `json:"name"`
-	Mode               RoundMode               `json:"mode"`
-	JoinCode           string                  `json:"joinCode"`
-	State              RoundState              `json:"state"`
-	HostID             string                  `json:"hostId"`
-	Participants       map[string]*Participant `json:"participants"`
-	Submissions        map[string]*Submission  `json:"submissions"`
-	AllowGuestDownload bool                    `json:"allowGuestDownload"`
-	CreatedAt          time.Time               `json:"createdAt"`
-	SampleFileID       string                  `json:"sampleFileId,omitempty"` // Particularly for sample mode
+	ID                 string                       `json:"id"`
+	Name               string                       `json:"name"`
+	Mode               RoundMode                    `json:"mode"`
+	JoinCode           string                       `json:"joinCode"`
+	State              RoundState                   `json:"state"`
+	HostID             string                       `json:"hostId"`
+	Participants       map[string]*Participant      `json:"participants"`
+	Submissions        map[string]*Submission       `json:"submissions"`
+	AllowGuestDownload bool                         `json:"allowGuestDownload"`
+	CreatedAt          time.Time                    `json:"createdAt"`
+	SampleFileID       string                       `json:"sampleFileId,omitempty"` // Particularly for sample mode
+	Locked             bool                         `json:"locked"`                 // Host can lock the lobby so nobody new can join
+	Spectators         map[string]*Participant      `json:"spectators,omitempty"`   // Following along; never in Participants
+	SpectatorsCanVote  bool                         `json:"spectatorsCanVote"`
+	NormalizeListening bool                         `json:"normalizeListening,omitempty"` // entries play back level-matched
+	Votes              map[string]string            `json:"votes,omitempty"`              // voter ID -> ID of the participant whose entry they picked
+	PasswordHash       string                       `json:"passwordHash,omitempty"`       // Optional join password, hashed like account passwords
+	InviteOnly         bool                         `json:"inviteOnly"`
+	Invites            map[string]*Invite           `json:"invites,omitempty"`    // keyed by token
+	ExpiresAt          time.Time                    `json:"expiresAt"`            // the host picks this at creation and can push it back (see lifetime.go)
+	LeagueCode         string                       `json:"leagueCode,omitempty"` // results go to this league when the round closes (see league.go)
+	Bracket            *Bracket                     `json:"bracket,omitempty"`    // tournament mode only
+	MatchVotes         map[string]map[string]string `json:"matchVotes,omitempty"` // tournament mode: match ID -> voter ID -> player they picked
+	StartedAt          time.Time                    `json:"startedAt"`            // sprint mode: when the clock started (zero until then)
+	TimeLimitMinutes   int                          `json:"timeLimitMinutes,omitempty"`
+	GraceMinutes       int                          `json:"graceMinutes,omitempty"` // late uploads are still taken (and flagged) for this long
+	Layers             []*Layer                     `json:"layers,omitempty"`       // build-up mode: the stems, bottom layer first
+	Roulette           *Roulette                    `json:"roulette,omitempty"`     // optional rules dealt out at the start (see roulette.go)
+	SampleAnalysis     *AudioAnalysis               `json:"sampleAnalysis,omitempty"`
+	SamplePreview      string                       `json:"samplePreview,omitempty"`
+	SamplePrint        string                       `json:"samplePrint,omitempty"` // its fingerprint, for checking entries against
+	SampleJob          *JobStatus                   `json:"sampleJob,omitempty"`
+}
+
+// RoundSettings is everything the host chooses up front; a new round, a saved template and a clone all start from one
+type RoundSettings struct {
+	Name                      string    `json:"name"`
+	Mode                      RoundMode `json:"mode"`
+	AllowGuestDownload        bool      `json:"allowGuestDownload"`
+	InviteOnly                bool      `json:"inviteOnly"`
+	SpectatorsCanVote         bool      `json:"spectatorsCanVote"`
+	NormalizeListening        bool      `json:"normalizeListening,omitempty"`
+	LifetimeHours             int       `json:"lifetimeHours"`          // 0 means the server default
+	PasswordHash              string    `json:"passwordHash,omitempty"` // already hashed; never sent to the browser
+	LeagueCode                string    `json:"leagueCode,omitempty"`
+	TimeLimitMinutes          int       `json:"timeLimitMinutes,omitempty"` // sprint mode only
+	GraceMinutes              int       `json:"graceMinutes,omitempty"`
+	Constraints               []string  `json:"constraints,omitempty"` // constraint roulette pool; empty for none
+	ConstraintsPerParticipant bool      `json:"constraintsPerParticipant,omitempty"`
+}
+
+// Invite is a single-use token the host hands to one person for an invite-only round
+type Invite struct {
+	Token      string     `json:"token"`
+	Label      string     `json:"label"` // who the host meant it for, e.g. "Sam"
+	CreatedAt  time.Time  `json:"createdAt"`
+	UsedAt     *time.Time `json:"usedAt,omitempty"` // nil until someone joins with it
+	UsedByID   string     `json:"usedById,omitempty"`
+	UsedByName string     `json:"usedByName,omitempty"`
+}
+
+// Placement is one line of the final results
+type Placement struct {
+	Place         int    `json:"place"` // ties share a place (1, 1, 3)
+	ParticipantID string `json:"participantId"`
+	DisplayName   string `json:"displayName"`
+	Votes         int    `json:"votes"`
+}
+
+/*
+RoundInfo is what the info API sends to the browser. It embeds the Round so every field still shows up at the top level,
+but the ballot itself (who voted for whom), the spectator list, the password hash and invite tokens stay private;
+clients get counts and flags instead.
+*/
+type RoundInfo struct {
+	Round
+	SpectatorCount int         `json:"spectatorCount"`
+	VoteCount      int         `json:"voteCount"`
+	HasPassword    bool        `json:"hasPassword"`
+	Results        []Placement `json:"results,omitempty"` // only once the round is closed
+}
+
+// role returns the participant's role, treating rounds saved before roles existed as plain participants
+func (p *Participant) role() ParticipantRole {
+	if p.IsHost {
+		return RoleHost
+	}
+	if p.Role == "" {
+		return RoleParticipant
+	}
+	return p.Role
+}
+
+// setRole updates Role and keeps the older IsHost flag in sync with it
+func (p *Participant) setRole(role ParticipantRole) {
+	p.Role = role
+	p.IsHost = role == RoleHost
+}
+
+// canManage reports whether the participant can run the round (start/close it, upload the sample): the host or a co-host
+func (r *Round) canManage(participantID string) bool {
+	if participantID == r.HostID {
+		return true
+	}
+	participant, exists := r.Participants[participantID]
+	return exists && participant.role() == RoleCoHost
+}
+
+// telephoneLine is the order a telephone round passes files along: everyone but the judges, who don't upload, by ID
+func (r *Round) telephoneLine() []string {
+	line := make([]string, 0, len(r.Participants))
+	for id, participant := range r.Participants {
+		if participant.role() != RoleJudge {
+			line = append(line, id)
+		}
+	}
+	sort.Strings(line) // Deterministic order
+	return line
+}
+
+// info builds the client-facing view of the round
+func (r *Round) info() *RoundInfo {
+	info := &RoundInfo{
+		Round:          *r,
+		SpectatorCount: len(r.Spectators),
+		VoteCount:      len(r.Votes),
+		HasPassword:    r.PasswordHash != "",
+	}
+	for _, matchVotes := range r.MatchVotes {
+		info.VoteCount += len(matchVotes)
+	}
+	if r.State == StateClosed {
+		info.Results = r.results()
+	}
+
+	info.Votes = nil
+	info.MatchVotes = nil
+	info.Spectators = nil
+	info.PasswordHash = ""
+	info.Invites = nil // the host lists these through the invites endpoint instead
+
+	// Which account someone played from is nobody else's business; copied, since info shares the map with the round
+	info.Participants = make(map[string]*Participant, len(r.Participants))
+	for id, participant := range r.Participants {
+		copied := *participant
+		copied.UserID = ""
+		info.Participants[id] = &copied
+	}
+	if r.sampleHidden() {
+		// Even the tempo and key would be a head start in a sprint
+		info.SampleAnalysis, info.SampleJob, info.SamplePreview = nil, nil, ""
+	}
+	if r.Roulette != nil {
+		// Only the draw goes out; the pool stays with the hosts so nobody can see what they might get
+		roulette := *r.Roulette
+		roulette.Pool, roulette.Uses = nil, nil
+		info.Roulette = &roulette
+	}
+	return info
+}
+
+/*
+hideHostChecks takes the sample usage scores (see fingerprint.go) and duplicate warnings (see duplicates.go) out of
+the info, for everyone but the hosts. The submissions are copied first, since info shares them with the round.
+*/
+func (info *RoundInfo) hideHostChecks() {
+	submissions := make(map[string]*Submission, len(info.Submissions))
+	for id, submission := range info.Submissions {
+		copied := *submission
+		copied.SampleMatch, copied.Duplicates = nil, nil
+		submissions[id] = &copied
+	}
+	info.Submissions = submissions
+}
+
+// settings pulls out what the host chose for this round, so it can be saved as a template or run again
+func (r *Round) settings() RoundSettings {
+	// The round may have been extended since it was made; whole hours is what the create form deals in
+	lifetimeHours := int(r.ExpiresAt.Sub(r.CreatedAt).Round(time.Hour).Hours())
+	if lifetimeHours < 1 {
+		lifetimeHours = 0 // rounds from before lifetimes existed get the default
+	}
+	name := r.Name
+	if r.Bracket != nil {
+		name = r.Bracket.Name // not "...: Semifinals"
+	}
+	settings := RoundSettings{
+		Name:               name,
+		Mode:               r.Mode,
+		AllowGuestDownload: r.AllowGuestDownload,
+		InviteOnly:         r.InviteOnly,
+		SpectatorsCanVote:  r.SpectatorsCanVote,
+		NormalizeListening: r.NormalizeListening,
+		LifetimeHours:      lifetimeHours,
+		PasswordHash:       r.PasswordHash,
+		LeagueCode:         r.LeagueCode,
+		TimeLimitMinutes:   r.TimeLimitMinutes,
+		GraceMinutes:       r.GraceMinutes,
+	}
+	if r.Roulette != nil {
+		settings.Constraints = r.Roulette.Pool
+		settings.ConstraintsPerParticipant = r.Roulette.PerParticipant
+	}
+	return settings
+}
+
+// results tallies the votes for every submission, most votes first
+func (r *Round) results() []Placement {
+	tally := make(map[string]int)
+	for _, votedFor := range r.Votes {
+		tally[votedFor]++
+	}
+
+	placements := make([]Placement, 0, len(r.Submissions))
+	for participantID := range r.Submissions {
+		participant, exists := r.Participants[participantID]
+		if !exists {
+			continue
+		}
+		placements = append(placements, Placement{
+			ParticipantID: participantID,
+			DisplayName:   participant.DisplayName,
+			Votes:         tally[participantID],
+		})
+	}
+
+	// Most votes first; ties broken by name just so the order is stable
+	sort.Slice(placements, func(i, j int) bool {
+		if placements[i].Votes != placements[j].Votes {
+			return placements[i].Votes > placements[j].Votes
+		}
+		return placements[i].DisplayName < placements[j].DisplayName
+	})
+
+	for i := range placements {
+		if i > 0 && placements[i].Votes == placements[i-1].Votes {
+			placements[i].Place = placements[i-1].Place
+		} else {
+			placements[i].Place = i + 1
+		}
+	}
+	return placements
 }
 
 type Server struct {
-	db        *redis.Client      // Pointer to database connection
-	templates *template.Template // parsed HTML templates
-	router    *mux.Router        //HTTP router for handling different URLs
+	db         *redis.Client      // Pointer to database connection
+	templates  *template.Template // parsed HTML templates
+	router     *mux.Router        //HTTP router for handling different URLs
+	cfg        *Config            // settings loaded at startup (see config.go)
+	archive    *Archive           // closed rounds, kept after Redis forgets them (see archive.go)
+	jobWake    chan struct{}      // pokes an idle job worker when something is queued (see jobs.go)
+	transcoder transcoder         // makes the previews (see preview.go)
+	archiving  sync.WaitGroup     // rounds being archived, which main waits for before closing the archive
 }
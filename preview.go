@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Previews
+
+A 50 MB WAV is fine to download but painful to stream on a phone. So each upload also gets a small preview, made by
+the same background job that analyzes it (see jobs.go). The round page's players stream the preview from
+/api/round/{code}/preview/{filename}, while /download/ and the export still hand out the original.
+
+How previews are made is up to a transcoder:
+
+  - commandTranscoder shells out to ffmpeg (cfg.PreviewEncoder) and makes a 96 kbps AAC file. It reads anything
+    ffmpeg does, MP3 and M4A uploads included.
+  - wavTranscoder is plain Go and needs nothing installed: it mixes the decoded audio down to mono around 22 kHz and
+    writes a 16-bit WAV, roughly a sixth of a 24-bit stereo file. It only handles what we can decode (WAV and FLAC).
+
+When the round is level-matched (see loudness.go) the preview is made with the listening gain, so it plays at the
+same level as the listening copy would. Until a preview is ready, or when there isn't one (the original is already
+small, or no transcoder could read it), the preview endpoint falls back to the listening copy and then the original.
+*/
+
+const (
+	previewSampleRate = 22050
+	previewBitrate    = "96k"
+	previewTimeout    = 5 * time.Minute // for the external encoder
+)
+
+// transcoder makes the preview of an upload. audio is the decoded file, or nil when we couldn't decode it
+type transcoder interface {
+	ext() string // the extension of the previews it makes, e.g. ".m4a"
+	// transcode writes the preview of src to dst, with gain (in dB) applied; errUnsupportedAudio when it can't read src
+	transcode(src string, audio *pcmAudio, gain float64, dst string) error
+}
+
+// newTranscoder picks the external encoder when one is configured, and the built-in one otherwise
+func newTranscoder(cfg *Config) transcoder {
+	if cfg.PreviewEncoder != "" {
+		return commandTranscoder{path: cfg.PreviewEncoder}
+	}
+	return wavTranscoder{}
+}
+
+// commandTranscoder runs ffmpeg, or anything that takes the same arguments
+type commandTranscoder struct {
+	path string
+}
+
+func (t commandTranscoder) ext() string {
+	return ".m4a"
+}
+
+func (t commandTranscoder) transcode(src string, audio *pcmAudio, gain float64, dst string) error {
+	runCtx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+
+	args := []string{"-nostdin", "-v", "error", "-y", "-i", src, "-vn", "-ac", "2", "-c:a", "aac", "-b:a", previewBitrate}
+	if gain != 0 {
+		args = append(args, "-af", fmt.Sprintf("volume=%.1fdB", gain))
+	}
+	args = append(args, "-movflags", "+faststart", dst) // index up front so the player can start before it's all loaded
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(runCtx, t.path, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%s: %w: %s", filepath.Base(t.path), err, message)
+		}
+		return fmt.Errorf("%s: %w", filepath.Base(t.path), err)
+	}
+	return nil
+}
+
+// wavTranscoder downsamples decoded audio to a mono 16-bit WAV, with no outside tools
+type wavTranscoder struct{}
+
+func (t wavTranscoder) ext() string {
+	return ".wav"
+}
+
+func (t wavTranscoder) transcode(src string, audio *pcmAudio, gain float64, dst string) error {
+	if audio == nil {
+		return errUnsupportedAudio
+	}
+	mono, rate := downsample(audio.mono(), audio.SampleRate, previewSampleRate)
+	samples := make([]float32, len(mono))
+	for i, sample := range mono {
+		samples[i] = float32(sample)
+	}
+	return writeWAV16(dst, &pcmAudio{SampleRate: int(rate), Channels: [][]float32{samples}}, gain)
+}
+
+// previewName is where a file's preview goes, next to the original
+func previewName(filename string, ext string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "_preview" + ext
+}
+
+/*
+makePreview writes the preview of an upload next to it and returns its name, or "" when there's no preview to make:
+no transcoder, one that can't read the file, or a preview that came out no smaller than the original.
+*/
+func (s *Server) makePreview(dir string, filename string, audio *pcmAudio, gain float64) (string, error) {
+	if s.transcoder == nil {
+		return "", nil
+	}
+	src := filepath.Join(dir, filename)
+	name := previewName(filename, s.transcoder.ext())
+	dst := filepath.Join(dir, name)
+
+	err := s.transcoder.transcode(src, audio, gain, dst)
+	if errors.Is(err, errUnsupportedAudio) {
+		return "", nil
+	} else if err != nil {
+		os.Remove(dst) // don't leave half a file behind
+		return "", err
+	}
+
+	// A low-bitrate MP3 or a short loop can come out bigger; then the original makes a fine preview itself
+	original, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	preview, err := os.Stat(dst)
+	if err != nil {
+		return "", err
+	}
+	if preview.Size() >= original.Size() {
+		os.Remove(dst)
+		return "", nil
+	}
+	return name, nil
+}
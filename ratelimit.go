@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux" // Router for advanced URL Routing
+	"log"                    // For Logging errors and info messages
+	"net"
+	"net/http" // For HTTP server and client funcionality
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit describes one token bucket: Burst requests straight away, then one more every Every
+type RateLimit struct {
+	Name  string   `json:"-"` // part of the Redis key, so each route group gets its own buckets
+	Burst int      `json:"burst"`
+	Every Duration `json:"every"`
+}
+
+/*
+The limits below are the defaults (config.go lets a deployment change them) and apply per client IP and, separately, per session; a request has to fit in both.
+
+Joining is the tight one: a join code is only 6 characters, so without a limit someone could just walk through
+codes until one works. 10 tries up front and then one every 6 seconds is plenty for a person who fat-fingered
+a code but makes enumerating 36^6 codes hopeless.
+
+Registering and logging in share the account limit. Every attempt costs a full PBKDF2 run, so it's there as much to
+keep the CPU free as to slow down password guessing; logins also get a bucket per username (see handleLogin), so
+spreading the guesses over many addresses doesn't help either.
+*/
+var (
+	joinRateLimit    = RateLimit{Name: "join", Burst: 10, Every: Duration{6 * time.Second}}
+	createRateLimit  = RateLimit{Name: "create", Burst: 5, Every: Duration{time.Minute}}
+	uploadRateLimit  = RateLimit{Name: "upload", Burst: 20, Every: Duration{3 * time.Second}}
+	accountRateLimit = RateLimit{Name: "account", Burst: 10, Every: Duration{30 * time.Second}}
+)
+
+/*
+tokenBucketScript runs inside Redis so the read-refill-take happens atomically, even with several app instances
+sharing the same Redis. The bucket is a hash of {tokens, ts}; we top it up based on how long it's been since the last
+request, take a token if there is one, and otherwise report how many milliseconds until there will be.
+Using Redis' own clock (TIME) means instances with slightly different clocks still agree.
+*/
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local refill_ms = tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+tokens = math.min(capacity, tokens + (now - ts) / refill_ms)
+
+local allowed = 0
+local retry_ms = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_ms = math.ceil((1 - tokens) * refill_ms)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity * refill_ms))
+return {allowed, retry_ms}
+`)
+
+func rateLimitKey(name string, scope string, id string) string {
+	return fmt.Sprintf("ratelimit:%s:%s:%s", name, scope, id)
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// take tries to take one token from the bucket; when it can't, it returns how long until one frees up
+func (s *Server) take(limit RateLimit, key string) (bool, time.Duration, error) {
+	result, err := tokenBucketScript.Run(ctx, s.db, []string{key}, limit.Burst, limit.Every.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+/*
+rateLimit returns Gorilla middleware enforcing the limit. Over-limit requests get a 429 with a Retry-After header
+(in whole seconds, rounded up) so well-behaved clients know when to try again.
+
+If Redis itself is having problems we let the request through rather than take the whole site down with it;
+the handler is going to need Redis anyway and will fail on its own if it's really gone.
+*/
+func (s *Server) rateLimit(limit RateLimit) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys := []string{rateLimitKey(limit.Name, "ip", clientIP(r))}
+			if cookie, err := r.Cookie("session"); err == nil && cookie.Value != "" {
+				keys = append(keys, rateLimitKey(limit.Name, "session", cookie.Value))
+			}
+
+			for _, key := range keys {
+				allowed, retryAfter, err := s.take(limit, key)
+				if err != nil {
+					log.Printf("Rate limiter unavailable, allowing request: %v", err)
+					break
+				}
+				if !allowed {
+					tooManyRequests(w, r, limit, retryAfter)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+rateLimitVisitors is rateLimit for the routes that look a round up by its code, except for the round's own members.
+Their pages poll these every few seconds, while for anyone else each request is another guess at a code: without a
+limit, a 404 against a 200 or 403 would give away which codes are in use as quickly as they could be asked.
+*/
+func (s *Server) rateLimitVisitors(limit RateLimit) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		limited := s.rateLimit(limit)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if session := s.getSession(r); session != nil && session.RoundCode == mux.Vars(r)["code"] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limited.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tooManyRequests is the 429 for a request over the limit, with a Retry-After in whole seconds (rounded up)
+func tooManyRequests(w http.ResponseWriter, r *http.Request, limit RateLimit, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	log.Printf("Rate limited %s on %s (%s)", clientIP(r), r.URL.Path, limit.Name)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many requests. Try again in %d seconds", seconds), http.StatusTooManyRequests)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Constraint roulette
+
+An optional twist on any round: the host writes a pool of creative rules ("no drums", "must reverse the sample",
+"make it {bpm:70-90} BPM", "in {key}") and when the round starts the server deals them out, either one rule for
+everyone or a different rule for each participant. Until the deal the pool is only shown to the hosts, so nobody
+can get a head start.
+
+Two placeholders get filled in at the deal, so one line in the pool can come out differently every time:
+
+	{bpm:LOW-HIGH}  a tempo in that range, e.g. {bpm:80-100} -> 93
+	{key}           a random key, e.g. "F# minor"
+
+The draw is stored on the round, so reloading the page (or reopening the round) never re-rolls anyone's rule. People
+who join after the deal get dealt a rule as they come in.
+*/
+
+const (
+	maxConstraints      = 50
+	maxConstraintLength = 100
+)
+
+// Roulette is the host's pool of rules and, once the round has started, what was dealt
+type Roulette struct {
+	Pool           []string          `json:"pool"`
+	PerParticipant bool              `json:"perParticipant"`   // false: one rule for the whole round
+	Shared         string            `json:"shared,omitempty"` // the rule everyone got, when it isn't per participant
+	Dealt          map[string]string `json:"dealt,omitempty"`  // participant ID -> their rule, when it is
+	DealtAt        time.Time         `json:"dealtAt"`          // zero until the deal
+	Uses           []int             `json:"uses,omitempty"`   // how many times each pool entry has been dealt
+}
+
+var (
+	bpmPlaceholder = regexp.MustCompile(`\{bpm:(\d{2,3})-(\d{2,3})\}`)
+	keyNames       = []string{"C", "C#", "D", "Eb", "E", "F", "F#", "G", "Ab", "A", "Bb", "B"}
+)
+
+// checkConstraintPool tidies the host's pool (trims, drops blanks) and returns an error message if it's unusable
+func checkConstraintPool(pool []string) ([]string, string) {
+	cleaned := make([]string, 0, len(pool))
+	for _, constraint := range pool {
+		constraint = strings.TrimSpace(constraint)
+		if constraint == "" {
+			continue
+		}
+		if len(constraint) > maxConstraintLength {
+			return nil, fmt.Sprintf("Keep each rule under %d characters", maxConstraintLength)
+		}
+		for _, match := range bpmPlaceholder.FindAllStringSubmatch(constraint, -1) {
+			low, _ := strconv.Atoi(match[1])
+			high, _ := strconv.Atoi(match[2])
+			if low < 40 || high > 300 || low > high {
+				return nil, "BPM ranges need to be low-high, somewhere between 40 and 300"
+			}
+		}
+		cleaned = append(cleaned, constraint)
+	}
+	if len(cleaned) > maxConstraints {
+		return nil, fmt.Sprintf("A pool can have up to %d rules", maxConstraints)
+	}
+	return cleaned, ""
+}
+
+// fillConstraint swaps the placeholders for actual values
+func fillConstraint(constraint string) string {
+	constraint = bpmPlaceholder.ReplaceAllStringFunc(constraint, func(placeholder string) string {
+		match := bpmPlaceholder.FindStringSubmatch(placeholder)
+		low, _ := strconv.Atoi(match[1])
+		high, _ := strconv.Atoi(match[2])
+		return strconv.Itoa(low + rand.IntN(high-low+1))
+	})
+	for strings.Contains(constraint, "{key}") {
+		key := keyNames[rand.IntN(len(keyNames))] + " major"
+		if rand.IntN(2) == 0 {
+			key = strings.Replace(key, "major", "minor", 1)
+		}
+		constraint = strings.Replace(constraint, "{key}", key, 1)
+	}
+	return constraint
+}
+
+// draw picks one of the least-dealt rules, so a small group doesn't all end up with the same one
+func (rt *Roulette) draw() string {
+	if len(rt.Uses) != len(rt.Pool) {
+		rt.Uses = make([]int, len(rt.Pool))
+	}
+	fewest := rt.Uses[0]
+	for _, uses := range rt.Uses {
+		fewest = min(fewest, uses)
+	}
+	var candidates []int
+	for i, uses := range rt.Uses {
+		if uses == fewest {
+			candidates = append(candidates, i)
+		}
+	}
+	picked := candidates[rand.IntN(len(candidates))]
+	rt.Uses[picked]++
+	return fillConstraint(rt.Pool[picked])
+}
+
+// dealConstraints runs the deal when the round starts; it only ever happens once per round
+func (r *Round) dealConstraints() {
+	rt := r.Roulette
+	if rt == nil || len(rt.Pool) == 0 || !rt.DealtAt.IsZero() {
+		return
+	}
+	rt.DealtAt = time.Now()
+	if !rt.PerParticipant {
+		rt.Shared = rt.draw()
+		return
+	}
+
+	// Deal in join order, so the "fewest used" spreading is fair to whoever joined first
+	participants := make([]*Participant, 0, len(r.Participants))
+	for _, participant := range r.Participants {
+		participants = append(participants, participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+	rt.Dealt = make(map[string]string, len(participants))
+	for _, participant := range participants {
+		if participant.role() != RoleJudge {
+			rt.Dealt[participant.ID] = rt.draw()
+		}
+	}
+}
+
+// dealConstraintTo gives someone who joined after the deal their rule; does nothing before the deal or for shared rules
+func (r *Round) dealConstraintTo(participant *Participant) {
+	rt := r.Roulette
+	if rt == nil || rt.DealtAt.IsZero() || !rt.PerParticipant || participant.role() == RoleJudge {
+		return
+	}
+	if _, dealt := rt.Dealt[participant.ID]; dealt {
+		return
+	}
+	if rt.Dealt == nil {
+		rt.Dealt = make(map[string]string)
+	}
+	rt.Dealt[participant.ID] = rt.draw()
+}
+
+// constraintFor is the rule the participant has to follow, or "" if there isn't one (yet)
+func (r *Round) constraintFor(participantID string) string {
+	rt := r.Roulette
+	if rt == nil || rt.DealtAt.IsZero() {
+		return ""
+	}
+	if !rt.PerParticipant {
+		return rt.Shared
+	}
+	return rt.Dealt[participantID]
+}
+
+// newRoulette sets up roulette from a round's settings; nil when the host didn't write any rules
+func newRoulette(settings RoundSettings) *Roulette {
+	if len(settings.Constraints) == 0 {
+		return nil
+	}
+	return &Roulette{Pool: settings.Constraints, PerParticipant: settings.ConstraintsPerParticipant}
+}
+
+// constraintsText lists the draw for the export
+func constraintsText(round *Round) string {
+	rt := round.Roulette
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s: constraint roulette\n\n", round.Name)
+	if !rt.PerParticipant {
+		fmt.Fprintf(&text, "Everyone: %s\n", rt.Shared)
+		return text.String()
+	}
+
+	lines := make([]string, 0, len(rt.Dealt))
+	for participantID, constraint := range rt.Dealt {
+		name := participantID
+		if participant, exists := round.Participants[participantID]; exists {
+			name = participant.DisplayName
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, constraint))
+	}
+	sort.Strings(lines)
+	text.WriteString(strings.Join(lines, "\n") + "\n")
+	return text.String()
+}
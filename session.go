@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"      // For Logging errors and info messages
 	"net/http" // For HTTP server and client funcionality
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type Session struct {
@@ -11,6 +17,7 @@ type Session struct {
 	ParticipantID string    `json:"participantId"`
 	RoundCode     string    `json:"roundCode"`
 	CreatedAt     time.Time `json:"createdAt"`
+	Spectator     bool      `json:"spectator,omitempty"` // ParticipantID then points into Round.Spectators instead
 }
 
 func (s *Server) getSession(r *http.Request) *Session {
@@ -56,3 +63,140 @@ func (s *Server) getSession(r *http.Request) *Session {
 
 	return &session
 }
+
+// setSessionCookie hands the browser its round session; the cookie lasts exactly as long as the round does
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, round *Round) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(round.ttl().Seconds()),
+		HttpOnly: true, // Can't be accessed by JavaScript (security)
+
+		// This is to prevent CSRF (cross-site request forgery) attacks.
+		// Limits cookies to be delivered by links clicked on other websites and also by refreshing
+		// Secure (HTTPS only) comes from the config, since it breaks plain-HTTP local development
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.cfg.secureCookies(),
+	})
+}
+
+func (s *Server) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1, // Delete cookie
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.cfg.secureCookies(),
+	})
+}
+
+// saveSession stores a round session until the round expires
+func (s *Server) saveSession(session *Session, round *Round) error {
+	sessionData, _ := json.Marshal(session)
+	return s.db.Set(ctx, sessionKey(session.Token), sessionData, round.ttl()).Err()
+}
+
+// Redis key helpers for moderation bookkeeping; they live next to the round and expire with it
+func participantSessionsKey(code string, participantID string) string {
+	return fmt.Sprintf("participantsessions:%s:%s", code, participantID)
+}
+
+func roundFingerprintsKey(code string) string {
+	return "roundprints:" + code
+}
+
+func roundBansKey(code string) string {
+	return "roundbans:" + code
+}
+
+/*
+trackSession remembers which session tokens belong to a participant, so that when the host kicks someone we can
+find and delete every session they have (e.g. if they joined from two tabs) instead of just the one we know about.
+*/
+func (s *Server) trackSession(round *Round, participantID string, token string) {
+	key := participantSessionsKey(round.JoinCode, participantID)
+	if err := s.db.SAdd(ctx, key, token).Err(); err != nil {
+		log.Printf("Failed to track session for participant %s: %v", participantID, err)
+		return
+	}
+	s.db.ExpireAt(ctx, key, round.ExpiresAt)
+}
+
+// invalidateSessions deletes every session the participant has in this round; getSession returns nil for them afterwards
+func (s *Server) invalidateSessions(code string, participantID string) {
+	key := participantSessionsKey(code, participantID)
+	tokens, err := s.db.SMembers(ctx, key).Result()
+	if err != nil {
+		log.Printf("Failed to look up sessions for participant %s: %v", participantID, err)
+		return
+	}
+
+	for _, token := range tokens {
+		s.db.Del(ctx, sessionKey(token))
+	}
+	s.db.Del(ctx, key)
+}
+
+/*
+ensureDevice returns the browser's long-lived device ID, handing out a new one if it doesn't have one yet.
+Unlike the session cookie this survives leaving a round, which is what makes bans stick.
+*/
+func (s *Server) ensureDevice(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie("device"); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	deviceID := uuid.New().String()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "device",
+		Value:    deviceID,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60, // A year; it only identifies the browser, nothing else
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.cfg.secureCookies(),
+	})
+	return deviceID
+}
+
+/*
+clientFingerprints returns the hashes we ban by: one for the device cookie and one for the IP + User-Agent pair.
+Clearing cookies gets around the first, and switching networks gets around the second, but a troll has to do both.
+We only ever store the hashes, never the raw device ID or IP.
+*/
+func clientFingerprints(r *http.Request, deviceID string) []string {
+	ip := clientIP(r)
+
+	deviceSum := sha256.Sum256([]byte("device:" + deviceID))
+	clientSum := sha256.Sum256([]byte("client:" + ip + "|" + r.UserAgent()))
+
+	return []string{
+		hex.EncodeToString(deviceSum[:16]),
+		hex.EncodeToString(clientSum[:16]),
+	}
+}
+
+// recordFingerprints stores the participant's fingerprints so a later ban knows what to block
+func (s *Server) recordFingerprints(round *Round, participantID string, fingerprints []string) {
+	fingerprintData, _ := json.Marshal(fingerprints)
+	key := roundFingerprintsKey(round.JoinCode)
+	if err := s.db.HSet(ctx, key, participantID, fingerprintData).Err(); err != nil {
+		log.Printf("Failed to record fingerprints for participant %s: %v", participantID, err)
+		return
+	}
+	s.db.ExpireAt(ctx, key, round.ExpiresAt)
+}
+
+// isBanned reports whether any of the given fingerprints has been banned from the round
+func (s *Server) isBanned(code string, fingerprints []string) bool {
+	for _, fingerprint := range fingerprints {
+		banned, err := s.db.SIsMember(ctx, roundBansKey(code), fingerprint).Result()
+		if err == nil && banned {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Sprint mode
+
+A sprint is a sample round against the clock ("beat in an hour"):
+
+ 1. The host uploads the sample while the round is waiting, but nobody else can hear or download it yet.
+ 2. Starting the round reveals the sample and starts the clock (Round.StartedAt). The clock never restarts, even if
+    the host moves the round back and forth between states afterwards.
+ 3. Uploads are accepted until StartedAt + TimeLimitMinutes. If the host allowed a grace window, uploads during it
+    still go in but the Submission is flagged Late; after that the server turns them away.
+
+Everything here is enforced server-side, downloads and exports included; the countdown on the round page is just for
+show.
+*/
+
+const (
+	defaultSprintMinutes = 60      // the classic beat-in-an-hour
+	maxSprintMinutes     = 24 * 60 // a "sprint" longer than a day is just a round
+	maxGraceMinutes      = 60
+)
+
+// checkSprintSettings fills in the time limit for a sprint (and clears it for every other mode). Returns an error
+// message for the host if the numbers don't make sense.
+func checkSprintSettings(settings *RoundSettings) string {
+	if settings.Mode != ModeSprint {
+		settings.TimeLimitMinutes, settings.GraceMinutes = 0, 0
+		return ""
+	}
+	if settings.TimeLimitMinutes == 0 {
+		settings.TimeLimitMinutes = defaultSprintMinutes
+	}
+	if settings.TimeLimitMinutes < 1 || settings.TimeLimitMinutes > maxSprintMinutes {
+		return fmt.Sprintf("Sprint time limit must be between 1 and %d minutes", maxSprintMinutes)
+	}
+	if settings.GraceMinutes < 0 || settings.GraceMinutes > maxGraceMinutes {
+		return fmt.Sprintf("Grace window must be between 0 and %d minutes", maxGraceMinutes)
+	}
+	return ""
+}
+
+// sampleHidden reports whether the sample is still under wraps: a sprint whose clock hasn't started
+func (r *Round) sampleHidden() bool {
+	return r.Mode == ModeSprint && r.StartedAt.IsZero()
+}
+
+// withoutHiddenSample leaves the sample out of an export (and its manifest) while it's hidden from participantID
+func (r *Round) withoutHiddenSample(files []exportFile, participantID string) []exportFile {
+	if !r.sampleHidden() || r.canManage(participantID) {
+		return files
+	}
+	var visible []exportFile
+	for _, file := range files {
+		if file.Kind != "sample" {
+			visible = append(visible, file)
+		}
+	}
+	return visible
+}
+
+// deadline is when on-time uploads stop; zero unless this is a sprint that has started
+func (r *Round) deadline() time.Time {
+	if r.Mode != ModeSprint || r.StartedAt.IsZero() {
+		return time.Time{}
+	}
+	return r.StartedAt.Add(time.Duration(r.TimeLimitMinutes) * time.Minute)
+}
+
+// cutoff is the hard end of uploads: the deadline plus the grace window
+func (r *Round) cutoff() time.Time {
+	deadline := r.deadline()
+	if deadline.IsZero() {
+		return deadline
+	}
+	return deadline.Add(time.Duration(r.GraceMinutes) * time.Minute)
+}
+
+/*
+sprintStateChange starts the clock when a sprint first goes active. There has to be a sample to reveal, and once the
+clock is running the round can't go back to waiting (that's when the sample can be swapped). Returns an error message
+for the host, or "" if the change can go ahead.
+*/
+func sprintStateChange(round *Round, newState RoundState) string {
+	if !round.StartedAt.IsZero() {
+		if newState == StateWaiting {
+			return "The clock is already running, so the round can't go back to waiting"
+		}
+		return ""
+	}
+	if newState == StateWaiting {
+		return ""
+	}
+	if round.SampleFileID == "" {
+		return "Upload the sample before starting the clock"
+	}
+	round.StartedAt = time.Now()
+	return ""
+}
+
+// uploadLateness checks an upload against the sprint clock: late is true inside the grace window, and a non-empty
+// message means the cutoff has passed and the upload should be refused
+func (r *Round) uploadLateness(now time.Time) (late bool, message string) {
+	deadline := r.deadline()
+	if deadline.IsZero() {
+		return false, ""
+	}
+	if now.After(r.cutoff()) {
+		return false, fmt.Sprintf("Time's up! Uploads closed at %s", r.cutoff().Format("15:04 MST"))
+	}
+	return now.After(deadline), ""
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+/*
+Tagging exported files
+
+The files in an export are named after who made them, but players and DJ software go by the tags inside, which still
+say whatever the producer's DAW left there (often "Untitled 3" by nobody). So the copies that go into the export get
+fresh tags: title, artist (the participant's name), album (the round's name), track number and a comment with the join
+code. The stored originals aren't touched; the tags are written into the bytes on their way into the ZIP.
+
+Each format keeps its tags in its own place:
+
+  - MP3: an ID3v2.3 tag at the front, replacing any that was there. Text is UTF-16 so names in any script show up,
+    even in players that don't read ID3v2.4. A trailing ID3v1 tag is dropped, since players prefer it over nothing.
+  - FLAC: a Vorbis comment block. Our fields replace theirs, and whatever else they tagged (genre, BPM...) stays, as
+    do the other metadata blocks like cover art.
+  - WAV: a LIST/INFO chunk at the end, replacing any that was there along with any "id3 " chunk.
+
+Anything else (M4A, OGG, AAC) goes in as it is.
+*/
+
+// trackTags is what an exported file gets tagged with; empty fields and a zero track are left out
+type trackTags struct {
+	Title   string
+	Artist  string
+	Album   string
+	Track   int
+	Tracks  int // how many there are, for "3/8"; 0 when it's not worth saying
+	Comment string
+}
+
+// trackNumber is the track as tags write it: "3/8", "3" or ""
+func (t trackTags) trackNumber() string {
+	switch {
+	case t.Track <= 0:
+		return ""
+	case t.Tracks > 0:
+		return fmt.Sprintf("%d/%d", t.Track, t.Tracks)
+	}
+	return fmt.Sprint(t.Track)
+}
+
+// exportComment is the comment exported files are tagged with
+func exportComment(round *Round) string {
+	return fmt.Sprintf("Partitionly round %s", round.JoinCode)
+}
+
+/*
+stampTags returns a copy of an audio file with the tags written in, telling the format apart by its header like
+decodeAudioFile does. Formats it doesn't tag come back as errUnsupportedAudio; the caller then uses the file as it is.
+*/
+func stampTags(data []byte, tags trackTags) ([]byte, error) {
+	audio := skipID3(data)
+	switch {
+	case len(audio) >= 12 && string(audio[0:4]) == "RIFF" && string(audio[8:12]) == "WAVE":
+		return stampWAV(audio, tags)
+	case len(audio) >= 4 && string(audio[0:4]) == "fLaC":
+		return stampFLAC(audio, tags)
+	case isMP3Frame(audio):
+		return stampMP3(audio, tags), nil
+	}
+	return nil, errUnsupportedAudio
+}
+
+// isMP3Frame checks for an MPEG audio frame header: 11 sync bits, then a layer that isn't 0 (which would be AAC)
+func isMP3Frame(data []byte) bool {
+	return len(data) >= 4 && data[0] == 0xff && data[1]&0xe0 == 0xe0 && data[1]>>1&0x3 != 0
+}
+
+// stampMP3 puts a new ID3v2.3 tag in front of the audio (which has had any old one skipped already)
+func stampMP3(audio []byte, tags trackTags) []byte {
+	// An ID3v1 tag is the last 128 bytes, starting "TAG"
+	if len(audio) >= 128 && string(audio[len(audio)-128:len(audio)-125]) == "TAG" {
+		audio = audio[:len(audio)-128]
+	}
+
+	var frames bytes.Buffer
+	textFrame := func(id string, text string) {
+		if text != "" {
+			writeID3Frame(&frames, id, append([]byte{1}, utf16Text(text)...))
+		}
+	}
+	textFrame("TIT2", tags.Title)
+	textFrame("TPE1", tags.Artist)
+	textFrame("TALB", tags.Album)
+	textFrame("TRCK", tags.trackNumber())
+	if tags.Comment != "" {
+		// Encoding, language, an empty description (just its terminator), then the comment
+		body := append([]byte{1, 'e', 'n', 'g'}, utf16Text("")...)
+		body = append(body, 0, 0)
+		writeID3Frame(&frames, "COMM", append(body, utf16Text(tags.Comment)...))
+	}
+
+	out := make([]byte, 0, 10+frames.Len()+len(audio))
+	out = append(out, 'I', 'D', '3', 3, 0, 0) // version 2.3.0, no flags
+	out = append(out, syncsafe(frames.Len())...)
+	out = append(out, frames.Bytes()...)
+	return append(out, audio...)
+}
+
+// writeID3Frame writes one ID3v2.3 frame: ID, a plain 32-bit size, no flags, then the body
+func writeID3Frame(buf *bytes.Buffer, id string, body []byte) {
+	buf.WriteString(id)
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	buf.Write([]byte{0, 0})
+	buf.Write(body)
+}
+
+// utf16Text is text as ID3 encoding 1 has it: UTF-16 with a little-endian byte order mark
+func utf16Text(text string) []byte {
+	out := []byte{0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(text)) {
+		out = binary.LittleEndian.AppendUint16(out, unit)
+	}
+	return out
+}
+
+// syncsafe is the tag size as ID3 writes it: four bytes of seven bits each (the opposite of skipID3)
+func syncsafe(size int) []byte {
+	return []byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+}
+
+// stampFLAC swaps the Vorbis comment block for one with our tags, keeping the rest of the file as it is
+func stampFLAC(data []byte, tags trackTags) ([]byte, error) {
+	type metadataBlock struct {
+		blockType byte
+		body      []byte
+	}
+
+	// Metadata blocks as in decodeFLAC: a "last block" flag, a 7-bit type and a 24-bit length, then the block
+	var blocks []metadataBlock
+	var oldComments []byte
+	pos := 4
+	for {
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("flac: truncated metadata")
+		}
+		last := data[pos]&0x80 != 0
+		blockType := data[pos] & 0x7f
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+length > len(data) {
+			return nil, fmt.Errorf("flac: truncated metadata")
+		}
+		if blockType == flacVorbisComment {
+			oldComments = data[pos : pos+length]
+		} else {
+			blocks = append(blocks, metadataBlock{blockType, data[pos : pos+length]})
+		}
+		pos += length
+		if last {
+			break
+		}
+	}
+	if len(blocks) == 0 || blocks[0].blockType != 0 {
+		return nil, fmt.Errorf("flac: no STREAMINFO")
+	}
+
+	// STREAMINFO has to come first; the comments go straight after it
+	comments := vorbisComments(oldComments, tags)
+	if len(comments) >= 1<<24 {
+		return nil, fmt.Errorf("flac: tags too big")
+	}
+	blocks = append(blocks[:1], append([]metadataBlock{{flacVorbisComment, comments}}, blocks[1:]...)...)
+
+	out := make([]byte, 0, len(data)+len(comments))
+	out = append(out, "fLaC"...)
+	for i, block := range blocks {
+		header := block.blockType
+		if i == len(blocks)-1 {
+			header |= 0x80
+		}
+		length := len(block.body)
+		out = append(out, header, byte(length>>16), byte(length>>8), byte(length))
+		out = append(out, block.body...)
+	}
+	return append(out, data[pos:]...), nil
+}
+
+const flacVorbisComment = 4
+
+/*
+vorbisComments builds a Vorbis comment block: the vendor string, then "FIELD=value" entries, every length a
+little-endian uint32. The old block's vendor and the fields we don't set are kept; if it can't be read it's dropped.
+*/
+func vorbisComments(old []byte, tags trackTags) []byte {
+	fields := []struct{ name, value string }{
+		{"TITLE", tags.Title},
+		{"ARTIST", tags.Artist},
+		{"ALBUM", tags.Album},
+		{"TRACKNUMBER", fmt.Sprint(tags.Track)},
+		{"TRACKTOTAL", fmt.Sprint(tags.Tracks)},
+		{"COMMENT", tags.Comment},
+	}
+	ours := make(map[string]bool, len(fields))
+	var entries []string
+	for _, field := range fields {
+		ours[field.name] = true
+		if field.value != "" && field.value != "0" {
+			entries = append(entries, field.name+"="+field.value)
+		}
+	}
+
+	vendor := "Partitionly"
+	if oldVendor, oldEntries, ok := readVorbisComments(old); ok {
+		vendor = oldVendor
+		for _, entry := range oldEntries {
+			name, _, _ := strings.Cut(entry, "=")
+			if !ours[strings.ToUpper(name)] {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(vendor)))
+	out = append(out, vendor...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(entries)))
+	for _, entry := range entries {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(entry)))
+		out = append(out, entry...)
+	}
+	return out
+}
+
+func readVorbisComments(block []byte) (string, []string, bool) {
+	next := func() (string, bool) {
+		if len(block) < 4 {
+			return "", false
+		}
+		length := binary.LittleEndian.Uint32(block)
+		if uint64(length) > uint64(len(block)-4) {
+			return "", false
+		}
+		text := string(block[4 : 4+length])
+		block = block[4+length:]
+		return text, true
+	}
+
+	vendor, ok := next()
+	if !ok || len(block) < 4 {
+		return "", nil, false
+	}
+	count := binary.LittleEndian.Uint32(block)
+	block = block[4:]
+	var entries []string
+	for range count {
+		entry, ok := next()
+		if !ok {
+			return "", nil, false
+		}
+		entries = append(entries, entry)
+	}
+	return vendor, entries, true
+}
+
+// stampWAV rebuilds the RIFF file without its old tags and with a new LIST/INFO chunk at the end
+func stampWAV(data []byte, tags trackTags) ([]byte, error) {
+	out := make([]byte, 12, len(data)+256)
+	copy(out, "RIFF\x00\x00\x00\x00WAVE") // the size is filled in once we know it
+
+	// The same chunk walk as decodeWAV, except a truncated chunk is an error: we'd be writing out a broken file
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if pos+8+size > len(data) {
+			return nil, fmt.Errorf("wav: truncated %q chunk", id)
+		}
+		chunk := data[pos : pos+8+size]
+		pos += 8 + size + size%2
+
+		isInfo := id == "LIST" && size >= 4 && string(chunk[8:12]) == "INFO"
+		if isInfo || id == "id3 " || id == "ID3 " {
+			continue
+		}
+		out = append(out, chunk...)
+		if size%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	for _, field := range []struct{ id, value string }{
+		{"INAM", tags.Title},
+		{"IART", tags.Artist},
+		{"IPRD", tags.Album},
+		{"ITRK", tags.trackNumber()},
+		{"ICMT", tags.Comment},
+	} {
+		if field.value == "" {
+			continue
+		}
+		// Each value is NUL-terminated, and padded to an even length like every chunk
+		value := append([]byte(field.value), 0)
+		info.WriteString(field.id)
+		binary.Write(&info, binary.LittleEndian, uint32(len(value)))
+		info.Write(value)
+		if len(value)%2 == 1 {
+			info.WriteByte(0)
+		}
+	}
+	if info.Len() > 4 {
+		out = append(out, "LIST"...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(info.Len()))
+		out = append(out, info.Bytes()...)
+	}
+
+	if uint64(len(out)-8) > 0xffffffff {
+		return nil, fmt.Errorf("wav: too big to tag")
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
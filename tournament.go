@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log" // For Logging errors and info messages
+	"os"  // For OS interface
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+Tournament mode
+
+A tournament is a chain of ordinary sample rounds, one per stage of a single-elimination bracket:
+
+ 1. The first round is a normal lobby. When the host starts it, everyone who isn't a judge is seeded into the
+    bracket in the order they joined (seed 1 = first in). If the field isn't a power of two, the top seeds get byes.
+ 2. Every stage works like sample mode: the host uploads a sample, the players still standing flip it, then voting
+    opens. Instead of one vote for the whole round, each voter gets one vote per match.
+ 3. Closing a stage decides its matches and spawns the next stage as a brand new round (new join code, waiting for
+    its own sample) with the winners, the host and any co-hosts/judges carried over, sessions and all. The final
+    stage crowns the champion instead.
+
+The Bracket travels inside each stage's Round, so every stage (and its archived copy) can draw the whole bracket
+up to that point without looking anything else up.
+*/
+
+type Bracket struct {
+	Name         string                  `json:"name"`    // the tournament's name; stage rounds are named after it
+	Seeds        []string                `json:"seeds"`   // participant IDs, seed 1 first
+	Players      map[string]*Participant `json:"players"` // everyone seeded, kept even after they're knocked out
+	Stages       []*BracketStage         `json:"stages"`  // every stage so far; the last one is this round's
+	PreviousCode string                  `json:"previousCode,omitempty"`
+	NextCode     string                  `json:"nextCode,omitempty"` // set once this stage has closed and spawned the next
+	ChampionID   string                  `json:"championId,omitempty"`
+}
+
+type BracketStage struct {
+	Number    int      `json:"number"`
+	Name      string   `json:"name"` // "Quarterfinals", "Final"...
+	RoundCode string   `json:"roundCode"`
+	Matches   []*Match `json:"matches"`
+}
+
+// Match is one head-to-head; PlayerB is empty for a bye, which PlayerA wins without playing
+type Match struct {
+	ID       string `json:"id"` // "2-1" is stage 2, match 1
+	PlayerA  string `json:"playerA"`
+	PlayerB  string `json:"playerB,omitempty"`
+	VotesA   int    `json:"votesA"` // counted when the stage closes
+	VotesB   int    `json:"votesB"`
+	WinnerID string `json:"winnerId,omitempty"`
+}
+
+// current is the stage this round is playing
+func (b *Bracket) current() *BracketStage {
+	return b.Stages[len(b.Stages)-1]
+}
+
+// matchFor finds the player's match in the current stage, or nil if they aren't (or are no longer) playing
+func (b *Bracket) matchFor(playerID string) *Match {
+	for _, match := range b.current().Matches {
+		if match.PlayerA == playerID || match.PlayerB == playerID {
+			return match
+		}
+	}
+	return nil
+}
+
+// match looks a match up by ID in the current stage
+func (b *Bracket) match(matchID string) *Match {
+	for _, match := range b.current().Matches {
+		if match.ID == matchID {
+			return match
+		}
+	}
+	return nil
+}
+
+// seedRank is the player's seed (1 is best); used to break ties in favour of the better seed
+func (b *Bracket) seedRank(playerID string) int {
+	for i, id := range b.Seeds {
+		if id == playerID {
+			return i + 1
+		}
+	}
+	return len(b.Seeds) + 1
+}
+
+/*
+bracketView is the bracket as the round and archive pages draw it: names instead of IDs, and vote counts only for
+matches that have been decided.
+*/
+type bracketView struct {
+	Name         string
+	Stages       []stageView
+	Champion     string
+	PreviousCode string
+	NextCode     string
+}
+
+type stageView struct {
+	Name      string
+	RoundCode string
+	Matches   []matchView
+}
+
+type matchView struct {
+	ID      string
+	NameA   string
+	NameB   string // empty for a bye
+	VotesA  int
+	VotesB  int
+	Decided bool
+	WinnerA bool
+	WinnerB bool
+}
+
+// view builds the page version of the bracket; nil for rounds that aren't tournaments
+func (b *Bracket) view() *bracketView {
+	if b == nil {
+		return nil
+	}
+	nameOf := func(playerID string) string {
+		if player, exists := b.Players[playerID]; exists {
+			return player.DisplayName
+		}
+		return ""
+	}
+
+	view := &bracketView{
+		Name:         b.Name,
+		Champion:     nameOf(b.ChampionID),
+		PreviousCode: b.PreviousCode,
+		NextCode:     b.NextCode,
+	}
+	for _, stage := range b.Stages {
+		stageData := stageView{Name: stage.Name, RoundCode: stage.RoundCode}
+		for _, match := range stage.Matches {
+			stageData.Matches = append(stageData.Matches, matchView{
+				ID:      match.ID,
+				NameA:   nameOf(match.PlayerA),
+				NameB:   nameOf(match.PlayerB),
+				VotesA:  match.VotesA,
+				VotesB:  match.VotesB,
+				Decided: match.WinnerID != "" && match.PlayerB != "",
+				WinnerA: match.WinnerID != "" && match.WinnerID == match.PlayerA,
+				WinnerB: match.WinnerID != "" && match.WinnerID == match.PlayerB,
+			})
+		}
+		view.Stages = append(view.Stages, stageData)
+	}
+	return view
+}
+
+// stageName names a stage by how many matches it has
+func stageName(matches int) string {
+	switch matches {
+	case 1:
+		return "Final"
+	case 2:
+		return "Semifinals"
+	case 4:
+		return "Quarterfinals"
+	default:
+		return fmt.Sprintf("Round of %d", matches*2)
+	}
+}
+
+/*
+bracketOrder is the classic seeding order for a bracket of the given size (a power of two): 1 plays the last seed, and
+the top seeds are spread out so they can only meet late. For 8 it's 1 8 4 5 2 7 3 6.
+*/
+func bracketOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		next := make([]int, 0, len(order)*2)
+		total := len(order)*2 + 1
+		for _, seed := range order {
+			next = append(next, seed, total-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+/*
+seedBracket builds the first stage when the tournament's first round starts. Returns an error message for the host
+if there aren't enough players.
+*/
+func seedBracket(round *Round) string {
+	players := make([]*Participant, 0, len(round.Participants))
+	for _, participant := range round.Participants {
+		if participant.role() != RoleJudge {
+			players = append(players, participant)
+		}
+	}
+	if len(players) < 2 {
+		return "A tournament needs at least 2 players (judges don't count)"
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].JoinedAt.Before(players[j].JoinedAt)
+	})
+
+	bracket := &Bracket{
+		Name:    round.Name,
+		Players: make(map[string]*Participant, len(players)),
+	}
+	for _, player := range players {
+		copied := *player
+		bracket.Seeds = append(bracket.Seeds, player.ID)
+		bracket.Players[player.ID] = &copied
+	}
+
+	size := 2
+	for size < len(players) {
+		size *= 2
+	}
+
+	// Seeds past the number of players are byes
+	playerAt := func(seed int) string {
+		if seed > len(players) {
+			return ""
+		}
+		return bracket.Seeds[seed-1]
+	}
+	order := bracketOrder(size)
+	stage := &BracketStage{Number: 1, Name: stageName(size / 2), RoundCode: round.JoinCode}
+	for i := 0; i < len(order); i += 2 {
+		match := &Match{
+			ID:      fmt.Sprintf("1-%d", i/2+1),
+			PlayerA: playerAt(order[i]),
+			PlayerB: playerAt(order[i+1]),
+		}
+		if match.PlayerB == "" {
+			match.WinnerID = match.PlayerA
+		}
+		stage.Matches = append(stage.Matches, match)
+	}
+	bracket.Stages = []*BracketStage{stage}
+
+	round.Bracket = bracket
+	round.Name = fmt.Sprintf("%s: %s", bracket.Name, stage.Name)
+	return ""
+}
+
+/*
+tournamentStateChange runs the bracket side of a state change: seeding when the first stage starts, and deciding the
+stage (plus spawning the next one) when it closes. A stage that's already been decided can't change state at all, or
+the bracket would end up with two next stages. Returns an error message for the host, or an error if spawning failed.
+*/
+func (s *Server) tournamentStateChange(round *Round, newState RoundState) (string, error) {
+	bracket := round.Bracket
+	if bracket != nil && (bracket.NextCode != "" || bracket.ChampionID != "") {
+		return "This stage is over and the tournament has moved on", nil
+	}
+
+	switch {
+	case newState != StateWaiting && bracket == nil:
+		// Normally on start; a host who skips straight to voting or closing still gets a bracket
+		if errMsg := seedBracket(round); errMsg != "" || newState != StateClosed {
+			return errMsg, nil
+		}
+		return "", s.advanceTournament(round)
+	case newState == StateClosed && bracket != nil:
+		return "", s.advanceTournament(round)
+	}
+	return "", nil
+}
+
+/*
+decideStage settles every match in the current stage from the round's votes. Someone who didn't submit loses to
+someone who did; otherwise most votes wins, and a tie goes to the better seed (so does a match where neither played).
+*/
+func decideStage(round *Round) {
+	bracket := round.Bracket
+	for _, match := range bracket.current().Matches {
+		if match.PlayerB == "" {
+			continue // bye, already decided
+		}
+
+		match.VotesA, match.VotesB = 0, 0
+		for _, votedFor := range round.MatchVotes[match.ID] {
+			switch votedFor {
+			case match.PlayerA:
+				match.VotesA++
+			case match.PlayerB:
+				match.VotesB++
+			}
+		}
+
+		_, submittedA := round.Submissions[match.PlayerA]
+		_, submittedB := round.Submissions[match.PlayerB]
+		betterSeed := match.PlayerA
+		if bracket.seedRank(match.PlayerB) < bracket.seedRank(match.PlayerA) {
+			betterSeed = match.PlayerB
+		}
+
+		switch {
+		case submittedA && !submittedB:
+			match.WinnerID = match.PlayerA
+		case submittedB && !submittedA:
+			match.WinnerID = match.PlayerB
+		case match.VotesA > match.VotesB:
+			match.WinnerID = match.PlayerA
+		case match.VotesB > match.VotesA:
+			match.WinnerID = match.PlayerB
+		default:
+			match.WinnerID = betterSeed
+		}
+	}
+}
+
+/*
+placements ranks everyone once the champion is known, by how far they got: the champion is 1st, the other finalist
+2nd, both losing semifinalists 3rd, quarterfinal losers 5th and so on. Leagues use this for tournament results.
+*/
+func (b *Bracket) placements() []Placement {
+	if b.ChampionID == "" {
+		return nil
+	}
+
+	placements := []Placement{{Place: 1, ParticipantID: b.ChampionID, DisplayName: b.Players[b.ChampionID].DisplayName}}
+	for i := len(b.Stages) - 1; i >= 0; i-- {
+		stage := b.Stages[i]
+		for _, match := range stage.Matches {
+			if match.PlayerB == "" {
+				continue
+			}
+			loser, votes := match.PlayerA, match.VotesA
+			if match.WinnerID == match.PlayerA {
+				loser, votes = match.PlayerB, match.VotesB
+			}
+			placements = append(placements, Placement{
+				Place:         len(stage.Matches) + 1,
+				ParticipantID: loser,
+				DisplayName:   b.Players[loser].DisplayName,
+				Votes:         votes,
+			})
+		}
+	}
+	return placements
+}
+
+/*
+advanceTournament is called as a stage closes. It decides the matches, then either crowns the champion or spawns the
+next stage's round and points this one at it. The caller saves this round afterwards.
+*/
+func (s *Server) advanceTournament(round *Round) error {
+	bracket := round.Bracket
+	decideStage(round)
+
+	finished := bracket.current()
+	winners := make([]string, 0, len(finished.Matches))
+	for _, match := range finished.Matches {
+		winners = append(winners, match.WinnerID)
+	}
+
+	if len(winners) == 1 {
+		bracket.ChampionID = winners[0]
+		log.Printf("Tournament %s won by %s", bracket.Name, bracket.Players[winners[0]].DisplayName)
+		return nil
+	}
+
+	// Winners of neighbouring matches meet next, which keeps the seeding spread from stage 1
+	nextStage := &BracketStage{Number: finished.Number + 1, Name: stageName(len(winners) / 2)}
+	for i := 0; i < len(winners); i += 2 {
+		nextStage.Matches = append(nextStage.Matches, &Match{
+			ID:      fmt.Sprintf("%d-%d", nextStage.Number, i/2+1),
+			PlayerA: winners[i],
+			PlayerB: winners[i+1],
+		})
+	}
+
+	// Whoever runs the round comes along even if they're out; the winners come along to play
+	carried := make(map[string]*Participant)
+	for id, participant := range round.Participants {
+		if participant.role() == RoleHost || participant.role() == RoleCoHost || participant.role() == RoleJudge {
+			carried[id] = participant
+		}
+	}
+	for _, winner := range winners {
+		if participant, exists := round.Participants[winner]; exists {
+			carried[winner] = participant
+		}
+	}
+
+	var joinCode string
+	for {
+		joinCode = generateJoinCode()
+		exists, _ := s.db.Exists(ctx, roundKey(joinCode)).Result()
+		if exists == 0 && !s.archive.has(joinCode) {
+			break
+		}
+	}
+	nextStage.RoundCode = joinCode
+
+	// The next stage gets a copy of the bracket; this round's copy only learns the next round's code
+	var nextBracket Bracket
+	bracketData, err := json.Marshal(bracket)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bracketData, &nextBracket); err != nil {
+		return err
+	}
+	nextBracket.Stages = append(nextBracket.Stages, nextStage)
+	nextBracket.PreviousCode = round.JoinCode
+
+	expiresAt := round.ExpiresAt
+	if earliest := time.Now().Add(minRoundLifetime); expiresAt.Before(earliest) {
+		expiresAt = earliest
+	}
+
+	next := &Round{
+		ID:                 uuid.New().String(),
+		Name:               fmt.Sprintf("%s: %s", bracket.Name, nextStage.Name),
+		Mode:               ModeTournament,
+		JoinCode:           joinCode,
+		State:              StateWaiting,
+		HostID:             round.HostID,
+		Participants:       carried,
+		Submissions:        make(map[string]*Submission),
+		AllowGuestDownload: round.AllowGuestDownload,
+		CreatedAt:          time.Now(),
+		SpectatorsCanVote:  round.SpectatorsCanVote,
+		NormalizeListening: round.NormalizeListening,
+		PasswordHash:       round.PasswordHash,
+		InviteOnly:         round.InviteOnly,
+		ExpiresAt:          expiresAt,
+		LeagueCode:         round.LeagueCode,
+		Bracket:            &nextBracket,
+	}
+
+	if err := s.saveRound(next); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.cfg.UploadDir, next.ID), 0755); err != nil {
+		log.Printf("Failed to create upload directory for round with err: %v", err)
+	}
+	s.carryOverRound(round, next)
+
+	bracket.NextCode = joinCode
+	log.Printf("Tournament %s: %s done, %s is round %s", bracket.Name, finished.Name, nextStage.Name, joinCode)
+	return nil
+}
+
+/*
+carryOverRound moves everyone carried into the next stage across without making them join again: their existing
+session tokens are pointed at the new round and tracked there (so kicks still work), and bans follow too. Ends with
+syncRoundExpiry, which also moves the carried sessions to the new round's expiry.
+*/
+func (s *Server) carryOverRound(from *Round, to *Round) {
+	for id, participant := range to.Participants {
+		tokens, err := s.db.SMembers(ctx, participantSessionsKey(from.JoinCode, id)).Result()
+		if err != nil {
+			log.Printf("Failed to look up sessions for %s in round %s: %v", id, from.JoinCode, err)
+			continue
+		}
+		for _, token := range tokens {
+			sessionData, err := s.db.Get(ctx, sessionKey(token)).Result()
+			if err != nil {
+				continue // expired or kicked
+			}
+			var session Session
+			if err := json.Unmarshal([]byte(sessionData), &session); err != nil {
+				continue
+			}
+			session.RoundCode = to.JoinCode
+			if err := s.saveSession(&session, to); err != nil {
+				log.Printf("Failed to carry session over to round %s: %v", to.JoinCode, err)
+				continue
+			}
+			s.trackSession(to, id, token)
+		}
+
+		// So banning them in the new stage still knows which devices to block
+		if fingerprintData, err := s.db.HGet(ctx, roundFingerprintsKey(from.JoinCode), id).Result(); err == nil {
+			s.db.HSet(ctx, roundFingerprintsKey(to.JoinCode), id, fingerprintData)
+		}
+
+		if participant.UserID != "" {
+			s.recordRoundHistory(participant.UserID, to, id == to.HostID)
+		}
+	}
+
+	// Anyone banned from an earlier stage stays banned
+	if err := s.db.SUnionStore(ctx, roundBansKey(to.JoinCode), roundBansKey(from.JoinCode)).Err(); err != nil {
+		log.Printf("Failed to carry bans over to round %s: %v", to.JoinCode, err)
+	}
+	s.syncRoundExpiry(to)
+}
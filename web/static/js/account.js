@@ -0,0 +1,180 @@
+// account.js - Login, registration, leagues and round history
+
+document.addEventListener('DOMContentLoaded', () => {
+    // Sent back as X-CSRF-Token on every POST (see csrf.go)
+    const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
+    const loginForm = document.getElementById('login-form');
+    const registerForm = document.getElementById('register-form');
+    const logoutBtn = document.getElementById('logout-btn');
+    const historyList = document.getElementById('history-list');
+
+    // Login and register share the same request/response shape
+    function setupAccountForm(form, endpoint, usernameId, passwordId, errorId) {
+        if (!form) return;
+        const errorEl = document.getElementById(errorId);
+
+        form.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            errorEl.textContent = '';
+
+            const btn = form.querySelector('button[type="submit"]');
+            const originalText = btn.textContent;
+            btn.disabled = true;
+
+            try {
+                const response = await fetch(endpoint, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({
+                        username: document.getElementById(usernameId).value.trim(),
+                        password: document.getElementById(passwordId).value
+                    })
+                });
+
+                if (response.status === 429) {
+                    errorEl.textContent = await response.text();
+                    btn.disabled = false;
+                    btn.textContent = originalText;
+                    return;
+                }
+
+                const data = await response.json();
+
+                if (data.success) {
+                    window.location.reload();
+                } else {
+                    errorEl.textContent = data.error || 'Something went wrong';
+                    btn.disabled = false;
+                    btn.textContent = originalText;
+                }
+            } catch (err) {
+                errorEl.textContent = 'Connection error. Please try again.';
+                btn.disabled = false;
+                btn.textContent = originalText;
+            }
+        });
+    }
+
+    setupAccountForm(loginForm, '/api/account/login', 'login-username', 'login-password', 'login-error');
+    setupAccountForm(registerForm, '/api/account/register', 'register-username', 'register-password', 'register-error');
+
+    if (logoutBtn) {
+        logoutBtn.addEventListener('click', async () => {
+            try {
+                await fetch('/api/account/logout', { method: 'POST', headers: { 'X-CSRF-Token': csrfToken } });
+            } finally {
+                window.location.reload();
+            }
+        });
+    }
+
+    // === Round History ===
+    async function loadHistory() {
+        try {
+            const response = await fetch('/api/account/me');
+            const data = await response.json();
+
+            if (!data.history || data.history.length === 0) {
+                historyList.innerHTML = '<li class="text-muted">No rounds yet. Host or join one while logged in.</li>';
+                return;
+            }
+
+            historyList.innerHTML = data.history.map(entry => {
+                const submissions = (entry.submissions || []).map(sub => `
+                    <a href="/api/account/submissions/${encodeURIComponent(entry.roundId)}/${encodeURIComponent(sub.filename)}" class="download-link mt-1">
+                        <span><i data-lucide="music" class="icon-inline icon-primary"></i> ${escapeHtml(sub.originalName)}</span>
+                        <span><i data-lucide="download" class="icon-inline icon-secondary"></i></span>
+                    </a>
+                `).join('');
+
+                return `
+                    <li class="history-item">
+                        <div class="participant-info">
+                            <span class="participant-name">${escapeHtml(entry.roundName)}</span>
+                            ${entry.wasHost ? '<span class="badge badge-host">Host</span>' : ''}
+                        </div>
+                        <p class="text-muted history-meta">${escapeHtml(entry.joinCode)} &middot; ${new Date(entry.joinedAt).toLocaleDateString()}</p>
+                        ${submissions}
+                    </li>
+                `;
+            }).join('');
+            lucide.createIcons();
+        } catch (err) {
+            console.error('History error:', err);
+            historyList.innerHTML = '<li class="error-message">Failed to load history</li>';
+        }
+    }
+
+    // === Leagues ===
+    const leagueList = document.getElementById('league-list');
+    const leagueForm = document.getElementById('league-form');
+
+    async function loadLeagues() {
+        try {
+            const response = await fetch('/api/leagues');
+            const data = await response.json();
+
+            if (!data.leagues || data.leagues.length === 0) {
+                leagueList.innerHTML = '<li class="text-muted">No leagues yet.</li>';
+                return;
+            }
+
+            leagueList.innerHTML = data.leagues.map(league => `
+                <li class="history-item">
+                    <div class="participant-info">
+                        <a href="/league/${encodeURIComponent(league.code)}" class="participant-name">${escapeHtml(league.name)}</a>
+                        ${league.isOwner ? '<span class="badge badge-league">Owner</span>' : ''}
+                    </div>
+                    <p class="text-muted history-meta">${escapeHtml(league.code)} &middot; ${league.rounds} round${league.rounds === 1 ? '' : 's'}</p>
+                </li>
+            `).join('');
+        } catch (err) {
+            console.error('Leagues error:', err);
+            leagueList.innerHTML = '<li class="error-message">Failed to load leagues</li>';
+        }
+    }
+
+    if (leagueForm) {
+        leagueForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const errorEl = document.getElementById('league-error');
+            errorEl.textContent = '';
+
+            const btn = leagueForm.querySelector('button[type="submit"]');
+            btn.disabled = true;
+
+            try {
+                const response = await fetch('/api/leagues', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ name: document.getElementById('league-name').value.trim() })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    window.location.href = `/league/${data.code}`;
+                    return;
+                }
+                errorEl.textContent = data.error || 'Failed to create league';
+            } catch (err) {
+                errorEl.textContent = 'Connection error. Please try again.';
+            }
+            btn.disabled = false;
+        });
+    }
+
+    function escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text;
+        return div.innerHTML;
+    }
+
+    if (historyList) {
+        loadHistory();
+    }
+    if (leagueList) {
+        loadLeagues();
+    }
+});
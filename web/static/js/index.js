@@ -1,12 +1,37 @@
 // index.js - Landing page logic
 
 document.addEventListener('DOMContentLoaded', () => {
+    // Sent back as X-CSRF-Token on every POST (see csrf.go)
+    const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
     const joinForm = document.getElementById('join-form');
     const createForm = document.getElementById('create-form');
     const joinError = document.getElementById('join-error');
     const createError = document.getElementById('create-error');
     const joinCodeInput = document.getElementById('join-code');
 
+    const joinPasswordGroup = document.getElementById('join-password-group');
+    const joinPasswordInput = document.getElementById('join-password');
+    const joinInviteInput = document.getElementById('join-invite');
+
+    // Invite links look like /?code=ABC123&invite=xyz; prefill the join form from them
+    const params = new URLSearchParams(window.location.search);
+    if (params.get('code')) {
+        joinCodeInput.value = params.get('code').toUpperCase();
+    }
+    if (params.get('invite')) {
+        joinInviteInput.value = params.get('invite');
+        document.getElementById('join-invite-note').classList.remove('hidden');
+    }
+
+    // The password field only shows up once the server tells us the round has one
+    function handleAccessError(data) {
+        if (data.needsPassword) {
+            joinPasswordGroup.classList.remove('hidden');
+            joinPasswordInput.focus();
+        }
+    }
+
     // Auto-uppercase and filter join code input
     joinCodeInput.addEventListener('input', (e) => {
         e.target.value = e.target.value.toUpperCase().replace(/[^A-Z0-9]/g, '');
@@ -25,18 +50,28 @@ document.addEventListener('DOMContentLoaded', () => {
         try {
             const response = await fetch('/api/round/join', {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
                 body: JSON.stringify({
                     code: joinCodeInput.value.trim().toUpperCase(),
-                    displayName: document.getElementById('join-name').value.trim()
+                    displayName: document.getElementById('join-name').value.trim(),
+                    password: joinPasswordInput.value,
+                    invite: joinInviteInput.value
                 })
             });
 
+            if (response.status === 429) {
+                joinError.textContent = await response.text();
+                btn.disabled = false;
+                btn.textContent = originalText;
+                return;
+            }
+
             const data = await response.json();
 
             if (data.success) {
                 window.location.href = `/round/${data.code}`;
             } else {
+                handleAccessError(data);
                 joinError.textContent = data.error || 'Failed to join round';
                 btn.disabled = false;
                 btn.textContent = originalText;
@@ -48,6 +83,176 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    // Spectate: same code field, but follows the round instead of joining it
+    const spectateBtn = document.getElementById('spectate-btn');
+    spectateBtn.addEventListener('click', async () => {
+        joinError.textContent = '';
+        if (!joinCodeInput.value.trim()) {
+            joinError.textContent = 'Enter a round code to spectate';
+            return;
+        }
+
+        spectateBtn.disabled = true;
+
+        try {
+            const response = await fetch('/api/round/spectate', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                body: JSON.stringify({
+                    code: joinCodeInput.value.trim().toUpperCase(),
+                    displayName: document.getElementById('join-name').value.trim(),
+                    password: joinPasswordInput.value
+                })
+            });
+
+            if (response.status === 429) {
+                joinError.textContent = await response.text();
+                spectateBtn.disabled = false;
+                return;
+            }
+
+            const data = await response.json();
+
+            if (data.success) {
+                window.location.href = `/round/${data.code}`;
+            } else {
+                handleAccessError(data);
+                joinError.textContent = data.error || 'Failed to spectate round';
+                spectateBtn.disabled = false;
+            }
+        } catch (err) {
+            joinError.textContent = 'Connection error. Please try again.';
+            spectateBtn.disabled = false;
+        }
+    });
+
+    // Saved templates (see handlers_templates.go). Picking one hides the settings, since the template already has them.
+    const templateGroup = document.getElementById('template-group');
+    const templateSelect = document.getElementById('round-template');
+    const templateSummary = document.getElementById('template-summary');
+    const deleteTemplateBtn = document.getElementById('delete-template-btn');
+    const createSettings = document.getElementById('create-settings');
+    const roundNameInput = document.getElementById('round-name');
+    let templates = [];
+
+    function describeTemplate(t) {
+        const modeNames = { sample: 'Sample mode', telephone: 'Telephone mode', tournament: 'Tournament', sprint: 'Sprint', buildup: 'Build-up' };
+        const parts = [modeNames[t.mode] || 'Sample mode'];
+        if (t.mode === 'sprint') {
+            parts[0] += ` (${t.timeLimitMinutes} min${t.graceMinutes ? ` + ${t.graceMinutes} grace` : ''})`;
+        }
+        if (t.constraints && t.constraints.length) {
+            parts.push(`${t.constraints.length} roulette rule${t.constraints.length === 1 ? '' : 's'}${t.constraintsPerParticipant ? ' each' : ''}`);
+        }
+        if (t.leagueCode) parts.push(`league ${t.leagueCode}`);
+        if (t.lifetimeHours) parts.push(`lasts ${t.lifetimeHours}h`);
+        if (t.inviteOnly) parts.push('invite-only');
+        else if (t.hasPassword) parts.push('password');
+        if (t.allowGuestDownload) parts.push('everyone can download');
+        if (t.normalizeListening) parts.push('level-matched');
+        if (t.spectatorsCanVote) parts.push('spectators vote');
+        return parts.join(' · ');
+    }
+
+    function selectedTemplate() {
+        return templates.find(t => t.id === templateSelect.value);
+    }
+
+    function applyTemplateSelection() {
+        const t = selectedTemplate();
+        createSettings.classList.toggle('hidden', !!t);
+        deleteTemplateBtn.classList.toggle('hidden', !t);
+        templateSummary.classList.toggle('hidden', !t);
+        if (t) {
+            roundNameInput.value = t.name;
+            templateSummary.textContent = describeTemplate(t);
+        }
+    }
+
+    async function loadTemplates() {
+        try {
+            const response = await fetch('/api/templates');
+            if (!response.ok) return;
+            const data = await response.json();
+            templates = data.templates || [];
+        } catch (err) {
+            return; // templates are a shortcut; the plain form still works without them
+        }
+
+        templateSelect.querySelectorAll('option:not([value=""])').forEach(o => o.remove());
+        templates.forEach(t => {
+            const option = document.createElement('option');
+            option.value = t.id;
+            option.textContent = t.label;
+            templateSelect.appendChild(option);
+        });
+        templateGroup.classList.toggle('hidden', templates.length === 0);
+        applyTemplateSelection();
+    }
+
+    templateSelect.addEventListener('change', applyTemplateSelection);
+
+    deleteTemplateBtn.addEventListener('click', async () => {
+        const t = selectedTemplate();
+        if (!t || !confirm(`Delete the template "${t.label}"?`)) return;
+
+        deleteTemplateBtn.disabled = true;
+        try {
+            const response = await fetch(`/api/templates/${t.id}`, {
+                method: 'DELETE',
+                headers: { 'X-CSRF-Token': csrfToken }
+            });
+            if (!response.ok) {
+                createError.textContent = 'Failed to delete template';
+            }
+            templateSelect.value = '';
+            await loadTemplates();
+        } catch (err) {
+            createError.textContent = 'Connection error. Please try again.';
+        } finally {
+            deleteTemplateBtn.disabled = false;
+        }
+    });
+
+    loadTemplates();
+
+    // Leagues this account can host for; guests get a 401 and the picker just stays hidden.
+    // Coming from a league page (/?league=CODE) picks that league straight away.
+    const leagueGroup = document.getElementById('league-group');
+    const leagueSelect = document.getElementById('round-league');
+
+    async function loadLeagues() {
+        try {
+            const response = await fetch('/api/leagues');
+            if (!response.ok) return;
+            const data = await response.json();
+            (data.leagues || []).forEach(league => {
+                const option = document.createElement('option');
+                option.value = league.code;
+                option.textContent = league.name;
+                leagueSelect.appendChild(option);
+            });
+            if (data.leagues && data.leagues.length > 0) {
+                leagueGroup.classList.remove('hidden');
+            }
+            if (params.get('league')) {
+                leagueSelect.value = params.get('league').toUpperCase();
+            }
+        } catch (err) {
+            // Leagues are optional; the form works without them
+        }
+    }
+
+    loadLeagues();
+
+    // Sprints get a time limit and grace window; other modes don't need them
+    const sprintGroup = document.getElementById('sprint-group');
+    document.querySelectorAll('input[name="mode"]').forEach(radio => {
+        radio.addEventListener('change', () => {
+            sprintGroup.classList.toggle('hidden', document.querySelector('input[name="mode"]:checked').value !== 'sprint');
+        });
+    });
+
     // Create form submission
     createForm.addEventListener('submit', async (e) => {
         e.preventDefault();
@@ -58,18 +263,49 @@ document.addEventListener('DOMContentLoaded', () => {
         btn.disabled = true;
         btn.textContent = 'Creating...';
 
-        try {
-            const response = await fetch('/api/round/create', {
-                method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({
-                    name: document.getElementById('round-name').value.trim(),
+        // With a template picked, only the name and host go along; the server fills in the rest
+        const template = selectedTemplate();
+        const request = template
+            ? {
+                url: `/api/templates/${template.id}/create`,
+                body: {
+                    name: roundNameInput.value.trim(),
+                    hostName: document.getElementById('host-name').value.trim()
+                }
+            }
+            : {
+                url: '/api/round/create',
+                body: {
+                    name: roundNameInput.value.trim(),
                     hostName: document.getElementById('host-name').value.trim(),
                     mode: document.querySelector('input[name="mode"]:checked').value,
-                    allowGuestDownload: document.getElementById('allow-guest').checked
-                })
+                    allowGuestDownload: document.getElementById('allow-guest').checked,
+                    normalizeListening: document.getElementById('normalize-listening').checked,
+                    password: document.getElementById('round-password').value,
+                    inviteOnly: document.getElementById('invite-only').checked,
+                    lifetimeHours: parseInt(document.getElementById('round-lifetime').value, 10) || 0,
+                    leagueCode: leagueSelect.value,
+                    timeLimitMinutes: parseInt(document.getElementById('sprint-minutes').value, 10) || 0,
+                    graceMinutes: parseInt(document.getElementById('sprint-grace').value, 10) || 0,
+                    constraints: document.getElementById('round-constraints').value.split('\n'),
+                    constraintsPerParticipant: document.getElementById('constraints-per-participant').checked
+                }
+            };
+
+        try {
+            const response = await fetch(request.url, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                body: JSON.stringify(request.body)
             });
 
+            if (response.status === 429) {
+                createError.textContent = await response.text();
+                btn.disabled = false;
+                btn.textContent = originalText;
+                return;
+            }
+
             const data = await response.json();
 
             if (data.success) {
@@ -0,0 +1,70 @@
+// league.js - League owner controls (the rest of the league page is plain HTML)
+
+document.addEventListener('DOMContentLoaded', () => {
+    // Sent back as X-CSRF-Token on every POST (see csrf.go)
+    const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+    const code = document.getElementById('league-controls').dataset.code;
+
+    async function postLeague(path, body, errorEl) {
+        errorEl.textContent = '';
+        try {
+            const response = await fetch(`/api/league/${code}/${path}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                body: JSON.stringify(body)
+            });
+
+            const data = await response.json();
+
+            if (data.success) {
+                // Standings are rendered on the server, so the simplest way to show the new ones is a reload
+                window.location.reload();
+                return true;
+            }
+            errorEl.textContent = data.error || 'Something went wrong';
+        } catch (err) {
+            errorEl.textContent = 'Connection error. Please try again.';
+        }
+        return false;
+    }
+
+    const settingsForm = document.getElementById('league-settings-form');
+    settingsForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const errorEl = document.getElementById('league-settings-error');
+
+        // "10, 8, 6" -> [10, 8, 6]
+        const points = document.getElementById('league-points').value
+            .split(/[\s,]+/)
+            .filter(p => p !== '')
+            .map(p => parseInt(p, 10));
+        if (points.some(isNaN)) {
+            errorEl.textContent = 'Points should be whole numbers separated by commas';
+            return;
+        }
+
+        const btn = settingsForm.querySelector('button[type="submit"]');
+        btn.disabled = true;
+        const ok = await postLeague('settings', {
+            name: document.getElementById('league-name').value.trim(),
+            points,
+            participationPoints: parseInt(document.getElementById('league-participation').value, 10) || 0
+        }, errorEl);
+        if (!ok) btn.disabled = false;
+    });
+
+    const mergeBtn = document.getElementById('merge-btn');
+    if (mergeBtn) {
+        mergeBtn.addEventListener('click', async () => {
+            const from = document.getElementById('merge-from');
+            const into = document.getElementById('merge-into');
+            const fromName = from.options[from.selectedIndex].text;
+            const intoName = into.options[into.selectedIndex].text;
+            if (!confirm(`Move all of ${fromName}'s results to ${intoName}? This can't be undone.`)) return;
+
+            mergeBtn.disabled = true;
+            const ok = await postLeague('merge', { fromId: from.value, intoId: into.value }, document.getElementById('merge-error'));
+            if (!ok) mergeBtn.disabled = false;
+        });
+    }
+});
@@ -1,18 +1,25 @@
 // round.js - Round page functionality
 
 document.addEventListener('DOMContentLoaded', () => {
+    // Sent back as X-CSRF-Token on every POST (see csrf.go)
+    const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
     // Read data from data attributes
     const dataEl = document.getElementById('round-data');
     const code = dataEl.dataset.code;
     const state = dataEl.dataset.state;
     const mode = dataEl.dataset.mode;
     const isHost = dataEl.dataset.isHost === 'true';
+    const canManage = dataEl.dataset.canManage === 'true'; // host or co-host
     const isParticipant = dataEl.dataset.isParticipant === 'true';
+    const isSpectator = dataEl.dataset.isSpectator === 'true';
     const participantId = dataEl.dataset.participantId;
     const hasSample = dataEl.dataset.hasSample === 'true';
+    const usesSample = dataEl.dataset.usesSample === 'true'; // the host uploads a sample in this mode
+    const maxUploadMB = parseInt(dataEl.dataset.maxUploadMb, 10) || 32; // server's limit, from the config
 
     // Store in window for potential later use
-    window.ROUND_DATA = { code, state, mode, isHost, isParticipant, participantId, hasSample };
+    window.ROUND_DATA = { code, state, mode, isHost, canManage, isParticipant, isSpectator, participantId, hasSample };
 
     // Elements
     const toast = document.getElementById('toast');
@@ -60,7 +67,7 @@ document.addEventListener('DOMContentLoaded', () => {
             try {
                 const response = await fetch(`/api/round/${code}/leave`, {
                     method: 'POST',
-                    headers: { 'Content-Type': 'application/json' }
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken }
                 });
 
                 // Redirect home regardless of response
@@ -125,9 +132,9 @@ document.addEventListener('DOMContentLoaded', () => {
                 return;
             }
 
-            // Validate file size (32MB)
-            if (file.size > 32 * 1024 * 1024) {
-                showToast('File too large. Maximum size is 32MB.', 'error');
+            // Validate file size
+            if (file.size > maxUploadMB * 1024 * 1024) {
+                showToast(`File too large. Maximum size is ${maxUploadMB}MB.`, 'error');
                 return;
             }
 
@@ -144,6 +151,11 @@ document.addEventListener('DOMContentLoaded', () => {
             // Create form data
             const formData = new FormData();
             formData.append(fieldName, file);
+            // Build-up layers say what they add (see layers.go)
+            const creditInput = document.getElementById('layer-credit');
+            if (fieldName === 'audio' && creditInput) {
+                formData.append('credit', creditInput.value.trim());
+            }
 
             try {
                 const xhr = new XMLHttpRequest();
@@ -161,12 +173,16 @@ document.addEventListener('DOMContentLoaded', () => {
                     xhr.onload = () => {
                         if (xhr.status >= 200 && xhr.status < 300) {
                             resolve(JSON.parse(xhr.responseText));
+                        } else if (xhr.status === 429) {
+                            // Rate limited; the server's message says how long to wait
+                            resolve({ success: false, error: xhr.responseText.trim() });
                         } else {
                             reject(new Error(xhr.responseText));
                         }
                     };
                     xhr.onerror = () => reject(new Error('Network error'));
                     xhr.open('POST', endpoint);
+                    xhr.setRequestHeader('X-CSRF-Token', csrfToken);
                     xhr.send(formData);
                 });
 
@@ -227,12 +243,16 @@ document.addEventListener('DOMContentLoaded', () => {
                 }
                 // Update participant list
                 refreshParticipants();
+                // The layer stack and whose turn it is are drawn server-side
+                if (mode === 'buildup') {
+                    setTimeout(() => window.location.reload(), 1000);
+                }
             }
         );
     }
 
     // === Host: Sample Upload ===
-    if (isHost && mode === 'sample') {
+    if (canManage && usesSample) {
         const sampleArea = document.getElementById('sample-upload-area');
         const replaceSampleBtn = document.getElementById('replace-sample-btn');
 
@@ -276,14 +296,26 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // === Host: State Controls ===
     const startBtn = document.getElementById('start-round-btn');
+    const openVotingBtn = document.getElementById('open-voting-btn');
     const closeBtn = document.getElementById('close-round-btn');
 
     if (startBtn) {
-        startBtn.addEventListener('click', () => updateRoundState('active'));
+        startBtn.addEventListener('click', () => updateRoundState('active', startBtn));
+    }
+
+    if (openVotingBtn) {
+        openVotingBtn.addEventListener('click', () => updateRoundState('voting', openVotingBtn));
     }
 
     if (closeBtn) {
-        closeBtn.addEventListener('click', () => updateRoundState('closed'));
+        closeBtn.addEventListener('click', () => {
+            // Possible copies are listed above the button; make sure they've been looked at
+            const duplicates = parseInt(closeBtn.dataset.duplicates || '0', 10);
+            if (duplicates > 0 && !confirm(`${duplicates} possible duplicate ${duplicates === 1 ? 'entry is' : 'entries are'} flagged. Close and publish the results anyway?`)) {
+                return;
+            }
+            updateRoundState('closed', closeBtn);
+        });
     }
 
     // === Leave Round ===
@@ -300,7 +332,7 @@ document.addEventListener('DOMContentLoaded', () => {
             try {
                 const response = await fetch(`/api/round/${code}/leave`, {
                     method: 'POST',
-                    headers: { 'Content-Type': 'application/json' }
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken }
                 });
 
                 const data = await response.json();
@@ -324,8 +356,531 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
-    async function updateRoundState(newState) {
-        const btn = newState === 'active' ? startBtn : closeBtn;
+    // === Host: Moderation ===
+    // One delegated listener on the list, since refreshParticipants() rebuilds the buttons every poll
+    const participantsList = document.getElementById('participants-list');
+    const spectatorsList = document.getElementById('spectators-list');
+    if (isHost && participantsList) {
+        const moderate = async (e) => {
+            const btn = e.target.closest('button[data-action]');
+            if (!btn) return;
+
+            const action = btn.dataset.action;
+            const name = btn.dataset.name;
+            const prompts = {
+                ban: `Ban ${name}? They will be removed and can't rejoin this round.`,
+                kick: `Kick ${name}? Their submission and vote will be removed.`,
+                'transfer-host': `Make ${name} the host? You will become a regular participant.`
+            };
+            if (!confirm(prompts[action])) {
+                return;
+            }
+
+            btn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/${action}`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    // Tournament stages vote per match, so the button also says which match it's in
+                    body: JSON.stringify({ participantId: btn.dataset.id, matchId: btn.dataset.matchId || '' })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.message);
+                    if (action === 'transfer-host') {
+                        // We just lost our host controls
+                        setTimeout(() => window.location.reload(), 500);
+                    } else {
+                        // Spectators aren't in the polled list, so theirs is taken out here
+                        if (spectatorsList && spectatorsList.contains(btn)) {
+                            btn.closest('li').remove();
+                        }
+                        refreshParticipants();
+                    }
+                } else {
+                    showToast(data.error || 'Action failed', 'error');
+                    btn.disabled = false;
+                }
+            } catch (err) {
+                console.error('Moderation error:', err);
+                showToast('Action failed', 'error');
+                btn.disabled = false;
+            }
+        };
+        participantsList.addEventListener('click', moderate);
+        if (spectatorsList) {
+            spectatorsList.addEventListener('click', moderate);
+        }
+
+        participantsList.addEventListener('change', async (e) => {
+            const select = e.target.closest('select[data-action="role"]');
+            if (!select) return;
+
+            select.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/role`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ participantId: select.dataset.id, role: select.value })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.message);
+                } else {
+                    showToast(data.error || 'Failed to change role', 'error');
+                }
+            } catch (err) {
+                console.error('Role error:', err);
+                showToast('Failed to change role', 'error');
+            } finally {
+                refreshParticipants();
+            }
+        });
+    }
+
+    const lockToggle = document.getElementById('lock-lobby-toggle');
+    if (lockToggle) {
+        lockToggle.addEventListener('change', async () => {
+            lockToggle.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/lock`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ locked: lockToggle.checked })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.message);
+                } else {
+                    showToast(data.error || 'Failed to update lobby lock', 'error');
+                    lockToggle.checked = !lockToggle.checked;
+                }
+            } catch (err) {
+                console.error('Lock error:', err);
+                showToast('Failed to update lobby lock', 'error');
+                lockToggle.checked = !lockToggle.checked;
+            } finally {
+                lockToggle.disabled = false;
+            }
+        });
+    }
+
+    // === Round Expiry ===
+    const expiryEl = document.getElementById('round-expiry');
+    let expiresAt = expiryEl ? new Date(expiryEl.dataset.expiresAt) : null;
+
+    // "Expires in 3d 4h" is easier to read at a glance than a date; under an hour left it turns orange
+    function renderExpiry() {
+        if (!expiryEl || !expiresAt) return;
+        const ms = expiresAt - Date.now();
+        const text = document.getElementById('round-expiry-text');
+        if (ms <= 0) {
+            text.textContent = 'Expired';
+            return;
+        }
+        const minutes = Math.floor(ms / 60000);
+        const days = Math.floor(minutes / 1440);
+        const hours = Math.floor((minutes % 1440) / 60);
+        let remaining;
+        if (days > 0) {
+            remaining = `${days}d ${hours}h`;
+        } else if (hours > 0) {
+            remaining = `${hours}h ${minutes % 60}m`;
+        } else {
+            remaining = `${Math.max(minutes, 1)}m`;
+        }
+        text.textContent = `Expires in ${remaining}`;
+        expiryEl.title = expiresAt.toLocaleString();
+        expiryEl.classList.toggle('expiring-soon', ms < 60 * 60 * 1000);
+    }
+    renderExpiry();
+    setInterval(renderExpiry, 30000);
+
+    // === Sprint Clock ===
+    // Just a countdown; the server enforces the deadline and grace window on its own
+    const sprintClock = document.getElementById('sprint-clock');
+    if (sprintClock) {
+        const deadline = new Date(sprintClock.dataset.deadline);
+        const cutoff = new Date(sprintClock.dataset.cutoff);
+        const clockText = document.getElementById('sprint-clock-text');
+
+        const formatLeft = ms => {
+            const totalSeconds = Math.ceil(ms / 1000);
+            const hours = Math.floor(totalSeconds / 3600);
+            const minutes = Math.floor((totalSeconds % 3600) / 60);
+            const seconds = String(totalSeconds % 60).padStart(2, '0');
+            return hours > 0 ? `${hours}:${String(minutes).padStart(2, '0')}:${seconds}` : `${minutes}:${seconds}`;
+        };
+
+        const renderClock = () => {
+            const now = Date.now();
+            if (now < deadline) {
+                clockText.textContent = `${formatLeft(deadline - now)} left`;
+                sprintClock.classList.toggle('expiring-soon', deadline - now < 5 * 60 * 1000);
+            } else if (now < cutoff) {
+                clockText.textContent = `Grace window: ${formatLeft(cutoff - now)} left (uploads are marked late)`;
+                sprintClock.classList.add('expiring-soon');
+            } else {
+                clockText.textContent = "Time's up! Uploads are closed";
+                sprintClock.classList.remove('expiring-soon');
+                return false;
+            }
+            return true;
+        };
+
+        if (renderClock()) {
+            const timer = setInterval(() => {
+                if (!renderClock()) clearInterval(timer);
+            }, 1000);
+        }
+    }
+
+    const saveTemplateBtn = document.getElementById('save-template-btn');
+    if (saveTemplateBtn) {
+        saveTemplateBtn.addEventListener('click', async () => {
+            const labelInput = document.getElementById('template-label-input');
+            saveTemplateBtn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/template`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ label: labelInput.value.trim() })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    labelInput.value = '';
+                    showToast(data.message);
+                } else {
+                    showToast(data.error || 'Failed to save template', 'error');
+                }
+            } catch (err) {
+                console.error('Save template error:', err);
+                showToast('Failed to save template', 'error');
+            } finally {
+                saveTemplateBtn.disabled = false;
+            }
+        });
+    }
+
+    // Run it back: same settings in a brand new round, then straight over to it
+    const cloneBtn = document.getElementById('clone-round-btn');
+    if (cloneBtn) {
+        cloneBtn.addEventListener('click', async () => {
+            cloneBtn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/clone`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({
+                        name: document.getElementById('clone-name-input').value.trim(),
+                        inviteParticipants: document.getElementById('clone-invite-toggle').checked
+                    })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    window.location.href = `/round/${data.code}`;
+                } else {
+                    showToast(data.error || 'Failed to start a new round', 'error');
+                    cloneBtn.disabled = false;
+                }
+            } catch (err) {
+                console.error('Clone error:', err);
+                showToast('Failed to start a new round', 'error');
+                cloneBtn.disabled = false;
+            }
+        });
+    }
+
+    const extendBtn = document.getElementById('extend-round-btn');
+    if (extendBtn) {
+        extendBtn.addEventListener('click', async () => {
+            const hours = parseInt(document.getElementById('extend-hours-select').value, 10);
+            extendBtn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/extend`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ hours })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    expiresAt = new Date(data.expiresAt);
+                    renderExpiry();
+                    showToast(data.message);
+                } else {
+                    showToast(data.error || 'Failed to extend round', 'error');
+                }
+            } catch (err) {
+                console.error('Extend error:', err);
+                showToast('Failed to extend round', 'error');
+            } finally {
+                extendBtn.disabled = false;
+            }
+        });
+    }
+
+    // === Host: Constraint roulette pool ===
+    const saveRouletteBtn = document.getElementById('save-roulette-btn');
+    if (saveRouletteBtn) {
+        saveRouletteBtn.addEventListener('click', async () => {
+            const constraints = document.getElementById('roulette-pool').value.split('\n');
+            const perParticipant = document.getElementById('roulette-per-participant').checked;
+            saveRouletteBtn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/roulette`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ constraints, perParticipant })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.count ? `${data.count} rule${data.count === 1 ? '' : 's'} saved` : 'Roulette turned off');
+                    setTimeout(() => location.reload(), 800);
+                } else {
+                    showToast(data.error || 'Failed to save rules', 'error');
+                }
+            } catch (err) {
+                console.error('Roulette error:', err);
+                showToast('Failed to save rules', 'error');
+            } finally {
+                saveRouletteBtn.disabled = false;
+            }
+        });
+    }
+
+    // === Host: Access (password + invites) ===
+    const accessControls = document.getElementById('access-controls');
+    if (accessControls) {
+        const passwordInput = document.getElementById('round-password-input');
+        const setPasswordBtn = document.getElementById('set-password-btn');
+        const clearPasswordBtn = document.getElementById('clear-password-btn');
+        const inviteOnlyToggle = document.getElementById('invite-only-toggle');
+        const inviteLabelInput = document.getElementById('invite-label-input');
+        const createInviteBtn = document.getElementById('create-invite-btn');
+        const invitesList = document.getElementById('invites-list');
+        const inviteSummary = document.getElementById('invite-summary');
+
+        async function updateAccess(body) {
+            try {
+                const response = await fetch(`/api/round/${code}/access`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify(body)
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.message);
+                    passwordInput.value = '';
+                    passwordInput.placeholder = data.hasPassword ? 'Password set; enter a new one' : 'No password';
+                    clearPasswordBtn.classList.toggle('hidden', !data.hasPassword);
+                    inviteOnlyToggle.checked = data.inviteOnly;
+                } else {
+                    showToast(data.error || 'Failed to update access', 'error');
+                }
+            } catch (err) {
+                console.error('Access error:', err);
+                showToast('Failed to update access', 'error');
+            }
+        }
+
+        setPasswordBtn.addEventListener('click', () => {
+            if (!passwordInput.value) {
+                showToast('Enter a password first', 'error');
+                return;
+            }
+            updateAccess({ password: passwordInput.value });
+        });
+        clearPasswordBtn.addEventListener('click', () => updateAccess({ password: '' }));
+        inviteOnlyToggle.addEventListener('change', () => updateAccess({ inviteOnly: inviteOnlyToggle.checked }));
+
+        function inviteLink(token) {
+            return `${window.location.origin}/?code=${encodeURIComponent(code)}&invite=${encodeURIComponent(token)}`;
+        }
+
+        async function loadInvites() {
+            try {
+                const response = await fetch(`/api/round/${code}/invites`);
+                const data = await response.json();
+
+                inviteSummary.textContent = data.invites.length
+                    ? `${data.outstanding} outstanding, ${data.used} used`
+                    : '';
+                invitesList.innerHTML = data.invites.map(invite => {
+                    const label = invite.label ? escapeHtml(invite.label) : 'Unlabelled invite';
+                    if (invite.usedAt) {
+                        return `
+                        <li class="invite-item used">
+                            <span>${label}</span>
+                            <span class="text-muted">Used by ${escapeHtml(invite.usedByName)}</span>
+                        </li>`;
+                    }
+                    return `
+                        <li class="invite-item">
+                            <span>${label}</span>
+                            <span class="invite-actions">
+                                <button class="btn btn-outline btn-xs" data-invite-action="copy" data-token="${invite.token}">Copy Link</button>
+                                <button class="btn btn-outline btn-xs btn-danger" data-invite-action="revoke" data-token="${invite.token}">Revoke</button>
+                            </span>
+                        </li>`;
+                }).join('');
+            } catch (err) {
+                console.error('Invites error:', err);
+            }
+        }
+
+        createInviteBtn.addEventListener('click', async () => {
+            createInviteBtn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/invites`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ label: inviteLabelInput.value.trim() })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    inviteLabelInput.value = '';
+                    try {
+                        await navigator.clipboard.writeText(inviteLink(data.invite.token));
+                        showToast('Invite created and link copied!');
+                    } catch (err) {
+                        showToast('Invite created');
+                    }
+                    loadInvites();
+                } else {
+                    showToast(data.error || 'Failed to create invite', 'error');
+                }
+            } catch (err) {
+                console.error('Invite error:', err);
+                showToast('Failed to create invite', 'error');
+            } finally {
+                createInviteBtn.disabled = false;
+            }
+        });
+
+        invitesList.addEventListener('click', async (e) => {
+            const btn = e.target.closest('button[data-invite-action]');
+            if (!btn) return;
+
+            if (btn.dataset.inviteAction === 'copy') {
+                try {
+                    await navigator.clipboard.writeText(inviteLink(btn.dataset.token));
+                    showToast('Invite link copied!');
+                } catch (err) {
+                    prompt('Copy this invite link:', inviteLink(btn.dataset.token));
+                }
+                return;
+            }
+
+            try {
+                const response = await fetch(`/api/round/${code}/invites/${encodeURIComponent(btn.dataset.token)}`, {
+                    method: 'DELETE',
+                    headers: { 'X-CSRF-Token': csrfToken }
+                });
+                const data = await response.json();
+                if (data.success) {
+                    showToast(data.message);
+                } else {
+                    showToast(data.error || 'Failed to revoke invite', 'error');
+                }
+            } catch (err) {
+                console.error('Revoke error:', err);
+                showToast('Failed to revoke invite', 'error');
+            } finally {
+                loadInvites();
+            }
+        });
+
+        loadInvites();
+        // Keep the used/outstanding counts fresh as people join
+        setInterval(() => {
+            if (!document.hidden) loadInvites();
+        }, 10000);
+    }
+
+    // === Host: Spectator Voting Toggle ===
+    const spectatorVoteToggle = document.getElementById('spectator-vote-toggle');
+    if (spectatorVoteToggle) {
+        spectatorVoteToggle.addEventListener('change', async () => {
+            spectatorVoteToggle.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/settings`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ spectatorsCanVote: spectatorVoteToggle.checked })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(spectatorVoteToggle.checked ? 'Spectators can now vote' : 'Spectators can no longer vote');
+                } else {
+                    showToast(data.error || 'Failed to update settings', 'error');
+                    spectatorVoteToggle.checked = !spectatorVoteToggle.checked;
+                }
+            } catch (err) {
+                console.error('Settings error:', err);
+                showToast('Failed to update settings', 'error');
+                spectatorVoteToggle.checked = !spectatorVoteToggle.checked;
+            } finally {
+                spectatorVoteToggle.disabled = false;
+            }
+        });
+    }
+
+    // === Voting ===
+    document.querySelectorAll('.vote-btn').forEach(btn => {
+        btn.addEventListener('click', async () => {
+            btn.disabled = true;
+            try {
+                const response = await fetch(`/api/round/${code}/vote`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+                    body: JSON.stringify({ participantId: btn.dataset.id })
+                });
+
+                const data = await response.json();
+
+                if (data.success) {
+                    showToast(data.message);
+                    // Only one vote at a time (per match in a tournament), so move the highlight over
+                    const group = btn.closest('.match-ballot') || document;
+                    group.querySelectorAll('.vote-btn').forEach(other => {
+                        const isChosen = other.dataset.id === data.votedFor;
+                        other.textContent = isChosen ? 'Voted' : 'Vote';
+                        other.closest('.entry-item').classList.toggle('voted', isChosen);
+                    });
+                } else {
+                    showToast(data.error || 'Failed to vote', 'error');
+                }
+            } catch (err) {
+                console.error('Vote error:', err);
+                showToast('Failed to vote', 'error');
+            } finally {
+                btn.disabled = false;
+            }
+        });
+    });
+
+    async function updateRoundState(newState, btn) {
+        const originalText = btn ? btn.textContent : '';
         if (btn) {
             btn.disabled = true;
             btn.textContent = 'Updating...';
@@ -334,7 +889,7 @@ document.addEventListener('DOMContentLoaded', () => {
         try {
             const response = await fetch(`/api/round/${code}/state`, {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
+                headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
                 body: JSON.stringify({ state: newState })
             });
 
@@ -342,13 +897,18 @@ document.addEventListener('DOMContentLoaded', () => {
 
             if (data.success) {
                 showToast(`Round is now ${newState}`);
+                // A tournament stage that just closed has spawned the next one; take the host straight there
+                if (data.nextCode) {
+                    setTimeout(() => { window.location.href = `/round/${data.nextCode}`; }, 500);
+                    return;
+                }
                 // Reload to update UI
                 setTimeout(() => window.location.reload(), 500);
             } else {
                 showToast(data.error || 'Failed to update state', 'error');
                 if (btn) {
                     btn.disabled = false;
-                    btn.textContent = newState === 'active' ? 'Start Round' : 'Close Round';
+                    btn.textContent = originalText;
                 }
             }
         } catch (err) {
@@ -356,7 +916,7 @@ document.addEventListener('DOMContentLoaded', () => {
             showToast('Failed to update round state', 'error');
             if (btn) {
                 btn.disabled = false;
-                btn.textContent = newState === 'active' ? 'Start Round' : 'Close Round';
+                btn.textContent = originalText;
             }
         }
     }
@@ -369,23 +929,71 @@ document.addEventListener('DOMContentLoaded', () => {
             const response = await fetch(`/api/round/${code}/info`);
             const round = await response.json();
 
+            // We were kicked or banned by the host; our session is gone so there's nothing left to do here
+            if (isParticipant && !round.participants[participantId]) {
+                stopPolling();
+                showToast('You were removed from this round by the host', 'error');
+                setTimeout(() => {
+                    window.location.href = '/';
+                }, 2000);
+                return;
+            }
+
+            // Our role changed (promoted, demoted or handed hosting); reload so the right controls show up
+            if (isParticipant) {
+                const me = round.participants[participantId];
+                const nowCanManage = me.isHost || me.role === 'cohost';
+                if (me.isHost !== isHost || nowCanManage !== canManage) {
+                    window.location.reload();
+                    return;
+                }
+            }
+
+            // The host may have extended the round
+            if (round.expiresAt && expiryEl) {
+                expiresAt = new Date(round.expiresAt);
+                renderExpiry();
+            }
+
             // Update participant count
             const countEl = document.getElementById('participant-count');
             if (countEl) {
                 countEl.textContent = Object.keys(round.participants).length;
             }
 
+            // Spectators are counted separately and never listed
+            const spectatorCountEl = document.getElementById('spectator-count');
+            if (spectatorCountEl) {
+                document.getElementById('spectator-count-value').textContent = round.spectatorCount;
+                spectatorCountEl.classList.toggle('hidden', !round.spectatorCount);
+            }
+
             // Update participant list
             const list = document.getElementById('participants-list');
             if (list) {
                 list.innerHTML = Object.values(round.participants).map(p => {
                     const hasSubmitted = round.submissions && round.submissions[p.id];
+                    const rule = round.roulette && round.roulette.dealt && round.roulette.dealt[p.id];
                     return `
                     <li class="participant-item ${hasSubmitted ? 'submitted' : 'not-submitted'}" data-id="${p.id}">
                         <div class="participant-info">
                             <span class="participant-name">${escapeHtml(p.displayName)}</span>
-                            ${p.isHost ? '<span class="badge badge-host">Host</span>' : ''}
+                            ${roleBadge(p)}
+                            ${hasSubmitted && hasSubmitted.late ? '<span class="badge badge-late">Late</span>' : ''}
+                            ${hasSubmitted ? analysisTags(hasSubmitted.analysis) + jobTag(hasSubmitted.job) + sampleMatchTag(hasSubmitted.sampleMatch) + duplicateTags(hasSubmitted.duplicates) : ''}
+                            ${rule ? `<span class="participant-rule text-muted" title="Their rule">${escapeHtml(rule)}</span>` : ''}
                         </div>
+                        ${isHost && !p.isHost ? `
+                        <div class="moderation-actions">
+                            <select class="role-select" data-action="role" data-id="${p.id}" data-name="${escapeHtml(p.displayName)}">
+                                <option value="participant" ${!p.role || p.role === 'participant' ? 'selected' : ''}>Participant</option>
+                                <option value="cohost" ${p.role === 'cohost' ? 'selected' : ''}>Co-host</option>
+                                <option value="judge" ${p.role === 'judge' ? 'selected' : ''}>Judge</option>
+                            </select>
+                            <button class="btn btn-outline btn-xs" data-action="transfer-host" data-id="${p.id}" data-name="${escapeHtml(p.displayName)}">Make Host</button>
+                            <button class="btn btn-outline btn-xs" data-action="kick" data-id="${p.id}" data-name="${escapeHtml(p.displayName)}">Kick</button>
+                            <button class="btn btn-outline btn-xs btn-danger" data-action="ban" data-id="${p.id}" data-name="${escapeHtml(p.displayName)}">Ban</button>
+                        </div>` : ''}
                         ${hasSubmitted
                             ? '<span class="participant-status"><i data-lucide="check" class="icon-inline"></i></span>'
                             : '<span class="participant-status pending"><i data-lucide="clock" class="icon-inline"></i></span>'}
@@ -410,16 +1018,66 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    function roleBadge(p) {
+        if (p.isHost) return '<span class="badge badge-host">Host</span>';
+        if (p.role === 'cohost') return '<span class="badge badge-host">Co-host</span>';
+        if (p.role === 'judge') return '<span class="badge badge-judge">Judge</span>';
+        return '';
+    }
+
+    // Same as the "analysis" template: tempo, key and loudness, once the server has worked them out
+    function analysisTags(analysis) {
+        if (!analysis || (!analysis.bpm && !analysis.key && !analysis.loudness)) return '';
+        const tags = [];
+        if (analysis.bpm) tags.push(`<span class="analysis-tag">${Math.round(analysis.bpm)} BPM</span>`);
+        if (analysis.key) tags.push(`<span class="analysis-tag">${escapeHtml(analysis.key)}</span>`);
+        if (analysis.loudness) {
+            const { integrated, truePeak } = analysis.loudness;
+            tags.push(`<span class="analysis-tag" title="Integrated loudness, true peak ${truePeak.toFixed(1)} dBTP">${integrated.toFixed(1)} LUFS</span>`);
+        }
+        return `<span class="analysis-tags">${tags.join('')}</span>`;
+    }
+
+    // Same as the "job-status" template: only shown while the upload is still being processed, or if that failed
+    function jobTag(job) {
+        if (!job) return '';
+        if (job.state === 'pending' || job.state === 'processing') {
+            return '<span class="analysis-tags"><span class="analysis-tag analysis-pending">Analyzing...</span></span>';
+        }
+        if (job.state === 'failed') {
+            return `<span class="analysis-tags"><span class="analysis-tag analysis-failed" title="${escapeHtml(job.error || '')}">Analysis failed</span></span>`;
+        }
+        return '';
+    }
+
+    // Same as the "sample-match" template; the info API only sends scores to hosts, so nobody else sees these
+    function sampleMatchTag(match) {
+        if (!match) return '';
+        const title = match.flagged
+            ? 'Little or none of the sample lines up with this entry. Worth a listen: heavy pitching or stretching can hide it too'
+            : 'Share of the entry where the sample lines up';
+        return `<span class="analysis-tags"><span class="analysis-tag ${match.flagged ? 'sample-match-flagged' : 'sample-match'}" title="${title}">Sample ${Math.round(match.coverage * 100)}%</span></span>`;
+    }
+
+    function duplicateTags(duplicates) {
+        if (!duplicates || duplicates.length === 0) return '';
+        const tags = duplicates.map(d => {
+            const text = d.kind === 'exact' ? 'Duplicate' : `Similar ${Math.round(d.similarity * 100)}%`;
+            return `<span class="analysis-tag duplicate-flagged" title="${escapeHtml(d.label)}">${text}</span>`;
+        });
+        return `<span class="analysis-tags">${tags.join('')}</span>`;
+    }
+
     function escapeHtml(text) {
         const div = document.createElement('div');
         div.textContent = text;
         return div.innerHTML;
     }
 
-    // Start polling (every 5 seconds)
+    // Start polling (every 5 seconds; visitors who haven't joined share the join rate limit, so they check in less often)
     function startPolling() {
         if (pollInterval) return;
-        pollInterval = setInterval(refreshParticipants, 5000);
+        pollInterval = setInterval(refreshParticipants, isParticipant || isSpectator ? 5000 : 15000);
     }
 
     function stopPolling() {